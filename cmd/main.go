@@ -4,13 +4,24 @@ import (
 	"context"
 	"flag"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/limeleaf-coop/knbn/pkg"
 	docdb "github.com/limeleaf-coop/knbn/pkg/db"
+	"github.com/limeleaf-coop/knbn/templs"
+)
+
+// The change log keeps enough of the latest changes for event streams that
+// fall behind to catch up, and is pruned down to them every pruneInterval.
+const (
+	changesKept   = 10000
+	pruneInterval = time.Hour
 )
 
 func main() {
@@ -19,6 +30,13 @@ func main() {
 	address := flag.String("address", ":8080", "addr to bind the HTTP server to")
 	database := flag.String("database", "./knbn.sqlite", "database file location")
 	seedDataDir := flag.String("seed-data-dir", "", "directory containing .json file of seed data")
+	baseURL := flag.String("base-url", "http://localhost:8080", "URL the server is reached at, for links in email")
+	mailFrom := flag.String("mail-from", "knbn <knbn@localhost>", "address email is sent from")
+	mailDir := flag.String("mail-dir", "", "directory to write email to instead of sending it")
+	smtpAddr := flag.String("smtp-addr", "", "host:port of the SMTP server to send email through, otherwise email is logged")
+	logMailBody := flag.Bool("log-mail-body", false, "log the body of email, with it's sign in and invitation links, when email is logged")
+	smtpUsername := flag.String("smtp-username", "", "username for the SMTP server, the password is read from $KNBN_SMTP_PASSWORD")
+	storage := flag.String("storage", "embedded", "how to store lists and cards: \"embedded\" in their board's document or \"normalized\" in documents of their own")
 	flag.Parse()
 
 	db, err := docdb.Open(*database)
@@ -29,6 +47,87 @@ func main() {
 	defer db.Close()
 	slog.Info("opened database", "database", *database)
 
+	if err := db.Collection("accounts").EnsureIndex(ctx, "$.Email", docdb.IndexOptions{Unique: true}); err != nil {
+		slog.Error("error indexing accounts", "error", err)
+		os.Exit(1)
+	}
+
+	if err := db.Collection("tokens").EnsureIndex(ctx, "$.Expires", docdb.IndexOptions{}); err != nil {
+		slog.Error("error indexing sign in tokens", "error", err)
+		os.Exit(1)
+	}
+
+	for _, keypath := range []string{"$.Attempts", "$.Expires"} {
+		if err := db.Collection("outbox").EnsureIndex(ctx, keypath, docdb.IndexOptions{}); err != nil {
+			slog.Error("error indexing outbox", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	if err := db.Collection("sessions").EnsureIndex(ctx, "$.AccountID", docdb.IndexOptions{}); err != nil {
+		slog.Error("error indexing sessions", "error", err)
+		os.Exit(1)
+	}
+
+	if err := db.Collection("sessions").EnsureIndex(ctx, "$.Expires", docdb.IndexOptions{}); err != nil {
+		slog.Error("error indexing sessions", "error", err)
+		os.Exit(1)
+	}
+
+	for _, keypath := range []string{"$.BoardID", "$.AccountID"} {
+		if err := db.Collection("members").EnsureIndex(ctx, keypath, docdb.IndexOptions{}); err != nil {
+			slog.Error("error indexing members", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	for _, keypath := range []string{"$.WorkspaceID", "$.AccountID"} {
+		if err := db.Collection("workspace_members").EnsureIndex(ctx, keypath, docdb.IndexOptions{}); err != nil {
+			slog.Error("error indexing workspace members", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	if err := db.Collection("workspaces").EnsureIndex(ctx, "$.Name", docdb.IndexOptions{}); err != nil {
+		slog.Error("error indexing workspaces", "error", err)
+		os.Exit(1)
+	}
+
+	for _, keypath := range []string{"$.Email", "$.WorkspaceID", "$.BoardID", "$.Expires"} {
+		if err := db.Collection("invitations").EnsureIndex(ctx, keypath, docdb.IndexOptions{}); err != nil {
+			slog.Error("error indexing invitations", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	if err := db.Collection("boards").EnsureIndex(ctx, "$.WorkspaceID", docdb.IndexOptions{}); err != nil {
+		slog.Error("error indexing boards", "error", err)
+		os.Exit(1)
+	}
+
+	var mailer pkg.Mailer = pkg.LogMailer{Body: *logMailBody}
+	switch {
+	case *smtpAddr != "":
+		mailer, err = pkg.NewSMTPMailer(*smtpAddr, *mailFrom, *smtpUsername, os.Getenv("KNBN_SMTP_PASSWORD"))
+	case *mailDir != "":
+		mailer, err = pkg.NewFileMailer(*mailDir, *mailFrom)
+	}
+	if err != nil {
+		slog.Error("error setting up email", "error", err)
+		os.Exit(1)
+	}
+
+	var boards pkg.BoardStore
+	switch *storage {
+	case "embedded":
+		boards = pkg.NewEmbeddedStore(db)
+	case "normalized":
+		boards = pkg.NewNormalizedStore(db)
+	default:
+		slog.Error("unknown storage", "storage", *storage)
+		os.Exit(1)
+	}
+
 	if *seedDataDir != "" {
 		if err := db.SeedFromDir(ctx, *seedDataDir); err != nil {
 			slog.Error("error seeding database", "error", err)
@@ -36,20 +135,135 @@ func main() {
 		slog.Info("seeded database", "dir", *seedDataDir)
 	}
 
+	if err := pkg.AssignIDs(ctx, db); err != nil {
+		slog.Error("error assigning IDs to lists and cards", "error", err)
+		os.Exit(1)
+	}
+
+	if err := pkg.NormalizeEmails(ctx, db); err != nil {
+		slog.Error("error normalizing account emails", "error", err)
+		os.Exit(1)
+	}
+
+	if err := boards.Init(ctx); err != nil {
+		slog.Error("error setting up board storage", "storage", *storage, "error", err)
+		os.Exit(1)
+	}
+
+	if err := pkg.AssignWorkspaces(ctx, db, "Boards"); err != nil {
+		slog.Error("error assigning boards to a workspace", "error", err)
+		os.Exit(1)
+	}
+
+	sessions := pkg.NewSessions(db)
+	workspaces := pkg.NewWorkspaces(db)
+	members := pkg.NewMembers(db)
+	invitations := pkg.NewInvitations(db, strings.TrimSuffix(*baseURL, "/"))
+
+	// Every route but signing in and out requires a signed in account, and
+	// routes on a workspace or a board require the account to have a role on
+	// it.
+	auth := func(h http.HandlerFunc) http.HandlerFunc { return sessions.RequireAccount(workspaces.Current(h)) }
+	member := func(h http.HandlerFunc) http.HandlerFunc {
+		return auth(workspaces.Require(templs.WorkspaceRoleMember)(h))
+	}
+	admin := func(h http.HandlerFunc) http.HandlerFunc {
+		return auth(workspaces.Require(templs.WorkspaceRoleAdmin)(h))
+	}
+	view := func(h http.HandlerFunc) http.HandlerFunc { return auth(members.Require(templs.RoleViewer)(h)) }
+	edit := func(h http.HandlerFunc) http.HandlerFunc { return auth(members.Require(templs.RoleEditor)(h)) }
+	own := func(h http.HandlerFunc) http.HandlerFunc { return auth(members.Require(templs.RoleOwner)(h)) }
+
 	mux := http.NewServeMux()
-	mux.HandleFunc("GET /boards/{boardId}/lists/{listIdx}/cards/{cardIdx}/title", pkg.TitleHandler(db))
-	mux.HandleFunc("GET /boards/{boardId}/lists/{listIdx}/cards/{cardIdx}/title/edit", pkg.EditTitleHandler(db))
-	mux.HandleFunc("GET /boards/{boardId}/lists/{listIdx}/title", pkg.TitleHandler(db))
-	mux.HandleFunc("GET /boards/{boardId}/lists/{listIdx}/title/edit", pkg.EditTitleHandler(db))
-	mux.HandleFunc("GET /boards/{id}", pkg.BoardHandler(db))
-	mux.HandleFunc("GET /boards", pkg.BoardsHandler(db))
-	mux.HandleFunc("POST /sign-in", pkg.SignInHandler(db))
-	mux.HandleFunc("GET /", pkg.IndexHandler)
+	mux.HandleFunc("GET /boards/{boardId}/title", view(pkg.BoardTitleHandler(boards)))
+	mux.HandleFunc("PUT /boards/{boardId}/title", edit(pkg.UpdateBoardTitleHandler(boards)))
+	mux.HandleFunc("GET /boards/{boardId}/title/edit", edit(pkg.EditBoardTitleHandler(boards)))
+	mux.HandleFunc("GET /boards/{boardId}/duplicate", edit(pkg.ConfirmDuplicateBoardHandler(boards)))
+	mux.HandleFunc("POST /boards/{boardId}/duplicate", edit(pkg.DuplicateBoardHandler(boards)))
+	mux.HandleFunc("GET /boards/{boardId}/delete", own(pkg.ConfirmDeleteBoardHandler(boards)))
+	mux.HandleFunc("DELETE /boards/{boardId}", own(pkg.DeleteBoardHandler(boards)))
+	mux.HandleFunc("GET /boards/{boardId}/members", view(pkg.MembersHandler(members, invitations)))
+	mux.HandleFunc("POST /boards/{boardId}/members", own(pkg.AddMemberHandler(members, invitations)))
+	mux.HandleFunc("DELETE /boards/{boardId}/members/{accountId}", own(pkg.RemoveMemberHandler(members, invitations)))
+	mux.HandleFunc("DELETE /boards/{boardId}/invitations/{invitationId}", own(pkg.RevokeInvitationHandler(members, invitations)))
+	mux.HandleFunc("GET /boards/{boardId}/labels", edit(pkg.LabelsHandler(boards)))
+	mux.HandleFunc("POST /boards/{boardId}/labels", edit(pkg.AddLabelHandler(boards)))
+	mux.HandleFunc("PUT /boards/{boardId}/labels/{labelId}", edit(pkg.UpdateLabelHandler(boards)))
+	mux.HandleFunc("DELETE /boards/{boardId}/labels/{labelId}", edit(pkg.DeleteLabelHandler(boards)))
+	mux.HandleFunc("POST /boards/{boardId}/move", edit(pkg.MoveHandler(boards)))
+	mux.HandleFunc("POST /boards/{boardId}/lists", edit(pkg.CreateListHandler(boards)))
+	mux.HandleFunc("GET /boards/{boardId}/lists/{listId}", view(pkg.ListHandler(boards)))
+	mux.HandleFunc("DELETE /boards/{boardId}/lists/{listId}", edit(pkg.DeleteListHandler(boards)))
+	mux.HandleFunc("GET /boards/{boardId}/lists/{listId}/delete", edit(pkg.ConfirmDeleteListHandler(boards)))
+	mux.HandleFunc("GET /boards/{boardId}/lists/{listId}/title", view(pkg.TitleHandler(boards)))
+	mux.HandleFunc("PUT /boards/{boardId}/lists/{listId}/title", edit(pkg.UpdateTitleHandler(boards)))
+	mux.HandleFunc("GET /boards/{boardId}/lists/{listId}/title/edit", edit(pkg.EditTitleHandler(boards)))
+	mux.HandleFunc("POST /boards/{boardId}/lists/{listId}/cards", edit(pkg.CreateCardHandler(boards)))
+	mux.HandleFunc("GET /boards/{boardId}/cards/{cardId}", view(pkg.CardHandler(boards)))
+	mux.HandleFunc("DELETE /boards/{boardId}/cards/{cardId}", edit(pkg.DeleteCardHandler(boards)))
+	mux.HandleFunc("GET /boards/{boardId}/cards/{cardId}/desc", view(pkg.DescHandler(boards)))
+	mux.HandleFunc("PUT /boards/{boardId}/cards/{cardId}/desc", edit(pkg.UpdateDescHandler(boards)))
+	mux.HandleFunc("GET /boards/{boardId}/cards/{cardId}/desc/edit", edit(pkg.EditDescHandler(boards)))
+	mux.HandleFunc("PUT /boards/{boardId}/cards/{cardId}/labels", edit(pkg.UpdateCardLabelsHandler(boards)))
+	mux.HandleFunc("GET /boards/{boardId}/cards/{cardId}/title", view(pkg.TitleHandler(boards)))
+	mux.HandleFunc("PUT /boards/{boardId}/cards/{cardId}/title", edit(pkg.UpdateTitleHandler(boards)))
+	mux.HandleFunc("GET /boards/{boardId}/cards/{cardId}/title/edit", edit(pkg.EditTitleHandler(boards)))
+	mux.HandleFunc("GET /boards/{boardId}/events", view(pkg.BoardEventsHandler(db, boards, sessions, members)))
+	mux.HandleFunc("GET /boards/{boardId}/search", view(pkg.SearchHandler(boards, members)))
+	mux.HandleFunc("GET /boards/{boardId}", view(pkg.BoardHandler(boards)))
+	mux.HandleFunc("GET /boards", auth(pkg.BoardsHandler(boards, members)))
+	mux.HandleFunc("POST /boards", auth(pkg.CreateBoardHandler(boards)))
+	mux.HandleFunc("GET /search", auth(pkg.SearchHandler(boards, members)))
+	mux.HandleFunc("POST /workspaces", auth(pkg.CreateWorkspaceHandler(workspaces, sessions)))
+	mux.HandleFunc("POST /workspaces/switch", auth(pkg.SwitchWorkspaceHandler(sessions)))
+	mux.HandleFunc("GET /workspaces/{workspaceId}", member(pkg.WorkspaceHandler(workspaces, invitations)))
+	mux.HandleFunc("POST /workspaces/{workspaceId}/members", admin(pkg.AddWorkspaceMemberHandler(workspaces, invitations)))
+	mux.HandleFunc("DELETE /workspaces/{workspaceId}/members/{accountId}", admin(pkg.RemoveWorkspaceMemberHandler(workspaces, invitations)))
+	mux.HandleFunc("DELETE /workspaces/{workspaceId}/invitations/{invitationId}", admin(pkg.RevokeWorkspaceInvitationHandler(workspaces, invitations)))
+	mux.HandleFunc("GET /invitations/{token}", pkg.InvitationHandler(db))
+	mux.HandleFunc("POST /invitations/{token}", pkg.AcceptInvitationHandler(db, sessions))
+	mux.HandleFunc("POST /sign-in", pkg.SignInHandler(db, strings.TrimSuffix(*baseURL, "/")))
+	mux.HandleFunc("GET /sign-in/{token}", pkg.SignInLinkHandler(db))
+	mux.HandleFunc("POST /sign-in/{token}", pkg.SignInTokenHandler(db, sessions))
+	mux.HandleFunc("POST /sign-out", pkg.SignOutHandler(sessions))
+	mux.HandleFunc("POST /sign-out/all", auth(pkg.SignOutAllHandler(sessions)))
+	mux.HandleFunc("GET /account", auth(pkg.AccountHandler))
+	mux.HandleFunc("GET /", pkg.IndexHandler(sessions))
+
+	// Event streams stay open until the request context is done, so cancel
+	// every request context on shutdown instead of waiting on them forever.
+	baseCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
 	srv := &http.Server{
-		Addr:    *address,
-		Handler: mux,
+		Addr:        *address,
+		Handler:     mux,
+		BaseContext: func(net.Listener) context.Context { return baseCtx },
 	}
+	srv.RegisterOnShutdown(cancel)
+
+	go func() {
+		if err := pkg.NewOutbox(db, mailer).Run(baseCtx); err != nil {
+			slog.Error("error starting outbox", "error", err)
+		}
+	}()
+
+	go func() {
+		ticker := time.NewTicker(pruneInterval)
+		defer ticker.Stop()
+
+		for {
+			if err := db.PruneChanges(baseCtx, changesKept); err != nil && baseCtx.Err() == nil {
+				slog.Error("error pruning changes", "error", err)
+			}
+
+			select {
+			case <-baseCtx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
 
 	go func() {
 		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
@@ -4,6 +4,7 @@ go 1.22
 
 require (
 	github.com/a-h/templ v0.2.543
+	github.com/yuin/goldmark v1.7.8
 	modernc.org/sqlite v1.29.1
 )
 
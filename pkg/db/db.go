@@ -1,4 +1,4 @@
-// Package litedoc provides a document database that uses SQLite as it's storage
+// Package db provides a document database that uses SQLite as it's storage
 // engine.
 package db
 
@@ -11,26 +11,75 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"regexp"
 	"strings"
+	"sync"
 
-	_ "modernc.org/sqlite"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
 )
 
+// Collection names can not be bound as parameters so they are validated and
+// quoted with quoteIdent before being placed into a statement. Keypaths are
+// validated and placed into statements with quoteLiteral so SQLite can match
+// them against expression indexes. Every other value, including document IDs
+// and data, is bound as a parameter.
 const (
-	sqlCreateTable = "CREATE TABLE IF NOT EXISTS %s (id TEXT PRIMARY KEY, data JSON)"
-	sqlInsert      = "INSERT INTO %s (id, data) VALUES ('%s', '%s')"
-	sqlUpdate      = "UPDATE %s SET data = '%s' WHERE (id = '%s')"
-	sqlSelect      = "SELECT data FROM %s WHERE (id = '%s')"
-	sqlSelectAll   = "SELECT id, data FROM %s ORDER BY id"
-	sqlQuery       = "SELECT %s.id, %s.data FROM %s, json_tree(%s.data) WHERE (fullkey LIKE '%s' AND value %s %v)"
-	sqlDelete      = "DELETE FROM %s WHERE (id = '%s')"
+	sqlCreateTable     = `CREATE TABLE IF NOT EXISTS %s (id TEXT PRIMARY KEY, data JSON, rev INTEGER NOT NULL DEFAULT 1)`
+	sqlInsert          = `INSERT INTO %s (id, data) VALUES (?, ?)`
+	sqlUpdate          = `UPDATE %s SET data = ?, rev = rev + 1 WHERE (id = ?) RETURNING rev`
+	sqlUpdateIfRev     = `UPDATE %s SET data = ?, rev = rev + 1 WHERE (id = ? AND rev = ?) RETURNING rev`
+	sqlSelect          = `SELECT data, rev FROM %s WHERE (id = ?)`
+	sqlSelectRev       = `SELECT rev FROM %s WHERE (id = ?)`
+	sqlSelectAll       = `SELECT id, data, rev FROM %s ORDER BY id`
+	sqlDelete          = `DELETE FROM %s WHERE (id = ?)`
+	sqlDeleteIfRev     = `DELETE FROM %s WHERE (id = ? AND rev = ?)`
+	sqlListCollections = `SELECT name FROM sqlite_master WHERE (type = 'table' AND name NOT LIKE 'sqlite\_%' ESCAPE '\' AND name NOT LIKE '\_%' ESCAPE '\')`
+	sqlHasRevColumn    = `SELECT COUNT(*) FROM pragma_table_info(?) WHERE (name = 'rev')`
+	sqlAddRevColumn    = `ALTER TABLE %s ADD COLUMN rev INTEGER NOT NULL DEFAULT 1`
 
 	// Pulled from PocketBase.io for how it opens a SQLite connection.
 	//
 	// Note: the busy_timeout pragma must be first because
 	// the connection needs to be set to block on busy before WAL mode
 	// is set in case it hasn't been already set by another connection.
-	pragmas = "?_pragma=busy_timeout(10000)&_pragma=journal_mode(WAL)&_pragma=journal_size_limit(200000000)&_pragma=synchronous(NORMAL)&_pragma=foreign_keys(ON)&_pragma=temp_store(MEMORY)&_pragma=cache_size(-16000)"
+	//
+	// Transactions begin with BEGIN IMMEDIATE so a transaction that reads
+	// before it writes can not fail to upgrade to a write lock half way
+	// through.
+	pragmas = "?_pragma=busy_timeout(10000)&_pragma=journal_mode(WAL)&_pragma=journal_size_limit(200000000)&_pragma=synchronous(NORMAL)&_pragma=foreign_keys(ON)&_pragma=temp_store(MEMORY)&_pragma=cache_size(-16000)&_txlock=immediate"
+)
+
+var (
+	// ErrInvalidCollection is returned when a Collection ID is not a valid
+	// collection name. IDs must start with a letter and contain only letters,
+	// digits, underscores, and hyphens.
+	ErrInvalidCollection = errors.New("invalid collection id")
+
+	// ErrInvalidKeypath is returned when a keypath is not made up of only
+	// object keys, array indexes, and array wildcards such as
+	// "$.Lists[0].Title" or "$.Lists[*].Cards[*].Title".
+	ErrInvalidKeypath = errors.New("invalid keypath")
+
+	// ErrInvalidOp is returned when querying with an unknown Op.
+	ErrInvalidOp = errors.New("invalid op")
+
+	// ErrNotFound is returned when a Document does not exist.
+	ErrNotFound = errors.New("document not found")
+
+	// ErrConflict is returned by SetIfRevision, PatchIfRevision and
+	// DeleteIfRevision when the Document was written since the revision it was
+	// read at.
+	ErrConflict = errors.New("document revision conflict")
+
+	// ErrDuplicate is returned when a write would give two Documents the same
+	// ID or the same value at a keypath with a unique index.
+	ErrDuplicate = errors.New("duplicate document")
+)
+
+var (
+	collectionRegexp = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_-]*$`)
+	keypathRegexp    = regexp.MustCompile(`^\$(\.[A-Za-z_][A-Za-z0-9_]*|\[([0-9]+|\*)\])*$`)
 )
 
 // Op is a comparison operator when querying for documents.
@@ -43,6 +92,9 @@ const (
 	OpLessThanEqual
 	OpGreaterThan
 	OpGreaterThanEqual
+
+	// OpIn matches values equal to any element of a slice.
+	OpIn
 )
 
 func (op Op) String() string {
@@ -59,26 +111,160 @@ func (op Op) String() string {
 		return ">"
 	case OpGreaterThanEqual:
 		return ">="
+	case OpIn:
+		return "IN"
 	default:
 		return ""
 	}
 }
 
+// validateCollection checks that id is safe to use as a table name.
+func validateCollection(id string) error {
+	if !collectionRegexp.MatchString(id) {
+		return fmt.Errorf("%w: %q", ErrInvalidCollection, id)
+	}
+
+	return nil
+}
+
+// quoteIdent quotes a validated identifier for use within a statement.
+func quoteIdent(id string) string {
+	return `"` + id + `"`
+}
+
+// quoteLiteral quotes a validated keypath as a string literal for use within a
+// statement. Validated keypaths never contain quotes.
+func quoteLiteral(keypath string) string {
+	return "'" + keypath + "'"
+}
+
+// bindValue converts val into a type SQLite compares the same way it compares
+// JSON values.
+func bindValue(val any) any {
+	switch v := val.(type) {
+	case []byte:
+		return string(v)
+	case json.RawMessage:
+		return string(v)
+	case bool:
+		if v {
+			return 1
+		}
+		return 0
+	}
+
+	return val
+}
+
+// querier is the set of methods shared by *sql.DB and *sql.Tx so a Collection
+// can run its statements against either.
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// wrapErr wraps SQLite constraint errors with the matching package error.
+func wrapErr(err error) error {
+	var sqliteErr *sqlite.Error
+	if !errors.As(err, &sqliteErr) {
+		return err
+	}
+
+	switch sqliteErr.Code() {
+	case sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY, sqlite3.SQLITE_CONSTRAINT_UNIQUE:
+		return fmt.Errorf("%w: %v", ErrDuplicate, err)
+	}
+
+	return err
+}
+
 // Database holds the underlying SQLite database connection.
 type Database struct {
 	sqlite *sql.DB
+
+	mu       sync.Mutex
+	notifyCh chan struct{}
 }
 
-// Open create a SQLite connection at the specified path location.
+// Open create a SQLite connection at the specified path location and migrates
+// any Collections created before Documents had revisions.
 func Open(path string) (*Database, error) {
-	db, err := sql.Open("sqlite", path+pragmas)
+	sqlite, err := sql.Open("sqlite", path+pragmas)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Database{
-		sqlite: db,
-	}, nil
+	db := &Database{
+		sqlite:   sqlite,
+		notifyCh: make(chan struct{}),
+	}
+
+	if err := db.migrate(context.Background()); err != nil {
+		sqlite.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// migrate creates the change log and search index, adds the rev column to Collections that
+// don't have one, makes sure every Collection records it's changes without
+// their data, and leaves search triggers only on Collections with search
+// keypaths. Existing Documents start at revision 1.
+func (db *Database) migrate(ctx context.Context) error {
+	if _, err := db.sqlite.ExecContext(ctx, sqlCreateChanges); err != nil {
+		return err
+	}
+	if _, err := db.sqlite.ExecContext(ctx, sqlCreateSearch); err != nil {
+		return err
+	}
+
+	r, err := db.sqlite.QueryContext(ctx, sqlListCollections)
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0)
+	for r.Next() {
+		var name string
+		if err := r.Scan(&name); err != nil {
+			r.Close()
+			return err
+		}
+		names = append(names, name)
+	}
+	r.Close()
+
+	if err := r.Err(); err != nil {
+		return err
+	}
+
+	if err := db.dropChangesData(ctx, names); err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if validateCollection(name) != nil {
+			continue
+		}
+
+		var n int
+		if err := db.sqlite.QueryRowContext(ctx, sqlHasRevColumn, name).Scan(&n); err != nil {
+			return err
+		}
+		if n == 0 {
+			if _, err := db.sqlite.ExecContext(ctx, fmt.Sprintf(sqlAddRevColumn, quoteIdent(name))); err != nil {
+				return err
+			}
+		}
+
+		if err := db.Collection(name).createTriggers(ctx); err != nil {
+			return err
+		}
+	}
+
+	return db.migrateSearch(ctx, names)
 }
 
 // Close calls Close on the underlying database.
@@ -95,8 +281,7 @@ func (db *Database) SeedFromDir(ctx context.Context, dir string) error {
 	for _, collection := range collections {
 		col := db.Collection(collection.Name())
 
-		_, err := col.database.sqlite.ExecContext(ctx, fmt.Sprintf(sqlCreateTable, col.ID))
-		if err != nil {
+		if err := col.create(ctx); err != nil {
 			return err
 		}
 
@@ -120,13 +305,15 @@ func (db *Database) SeedFromDir(ctx context.Context, dir string) error {
 
 			doc.data = data
 
-			_, err = doc.collection.database.sqlite.ExecContext(ctx, fmt.Sprintf(sqlInsert, doc.collection.ID, doc.ID, doc.data))
+			_, err = doc.collection.q.ExecContext(ctx, fmt.Sprintf(sqlInsert, quoteIdent(doc.collection.ID)), doc.ID, string(doc.data))
 			if err != nil {
-				return err
+				return wrapErr(err)
 			}
 		}
 	}
 
+	db.notify()
+
 	return nil
 }
 
@@ -134,6 +321,7 @@ func (db *Database) SeedFromDir(ctx context.Context, dir string) error {
 func (db *Database) Collection(id string) *Collection {
 	return &Collection{
 		database: db,
+		q:        db.sqlite,
 		ID:       id,
 	}
 }
@@ -141,9 +329,24 @@ func (db *Database) Collection(id string) *Collection {
 // Collection represents the top level structure that holds Documents.
 type Collection struct {
 	database *Database
+	q        querier
 	ID       string
 }
 
+// create creates the table backing the Collection and the triggers recording
+// it's changes if they do not exist.
+func (c *Collection) create(ctx context.Context) error {
+	if err := validateCollection(c.ID); err != nil {
+		return err
+	}
+
+	if _, err := c.q.ExecContext(ctx, fmt.Sprintf(sqlCreateTable, quoteIdent(c.ID))); err != nil {
+		return err
+	}
+
+	return c.createTriggers(ctx)
+}
+
 // Document returns a reference to a Document within the Collection.
 func (c *Collection) Document(id string) *Document {
 	return &Document{
@@ -152,69 +355,48 @@ func (c *Collection) Document(id string) *Document {
 	}
 }
 
+// QueryAll returns every Document in the Collection ordered by ID.
 func (c *Collection) QueryAll(ctx context.Context) ([]*Document, error) {
-	sql := fmt.Sprintf(sqlSelectAll, c.ID)
-
-	r, err := c.database.sqlite.QueryContext(ctx, sql)
-	if err != nil {
+	if err := validateCollection(c.ID); err != nil {
 		return nil, err
 	}
 
-	docs := make([]*Document, 0)
-	for r.Next() {
-		if err := r.Err(); err != nil {
-			return nil, err
-		}
-
-		doc := Document{}
-
-		if err := r.Scan(&doc.ID, &doc.data); err != nil {
-			return nil, err
-		}
-
-		docs = append(docs, &doc)
+	r, err := c.q.QueryContext(ctx, fmt.Sprintf(sqlSelectAll, quoteIdent(c.ID)))
+	if err != nil {
+		return nil, err
 	}
 
-	return docs, nil
+	return c.scan(r)
 }
 
 // Query returns a list of Documents where the values at keypath match the value
-// based on the Op used.
+// based on the Op used. A keypath matches exactly the value it addresses unless
+// it contains "[*]" wildcards, in which case a Document matches if any array
+// element matches, for example "$.Lists[*].Cards[*].Title". Each Document is
+// returned at most once.
 func (c *Collection) Query(ctx context.Context, keypath string, op Op, val any) ([]*Document, error) {
-	switch v := val.(type) {
-	case string:
-		val = "'" + v + "'"
-	case []byte:
-		val = "'" + string(v) + "'"
-	case bool:
-		val = 0
-		if v {
-			val = 1
-		}
-	}
-
-	sql := fmt.Sprintf(sqlQuery, c.ID, c.ID, c.ID, c.ID, keypath, op, val)
+	return c.Where(keypath, op, val).Documents(ctx)
+}
 
-	r, err := c.database.sqlite.QueryContext(ctx, sql)
-	if err != nil {
-		return nil, err
-	}
+// scan reads every id and data row into Documents belonging to the Collection.
+func (c *Collection) scan(r *sql.Rows) ([]*Document, error) {
+	defer r.Close()
 
 	docs := make([]*Document, 0)
 	for r.Next() {
-		if err := r.Err(); err != nil {
-			return nil, err
-		}
-
-		doc := Document{}
+		doc := Document{collection: c}
 
-		if err := r.Scan(&doc.ID, &doc.data); err != nil {
+		if err := r.Scan(&doc.ID, &doc.data, &doc.Revision); err != nil {
 			return nil, err
 		}
 
 		docs = append(docs, &doc)
 	}
 
+	if err := r.Err(); err != nil {
+		return nil, err
+	}
+
 	return docs, nil
 }
 
@@ -223,6 +405,10 @@ type Document struct {
 	collection *Collection
 	ID         string
 	data       []byte
+
+	// Revision starts at 1 when the Document is created and is incremented by
+	// every write. It is set by Create, Set, SetIfRevision, Get, and queries.
+	Revision int64
 }
 
 // DataTo unmarshals the JSON data into the doc type if the JSON data exists.
@@ -238,61 +424,105 @@ func (d *Document) DataTo(doc any) error {
 // references creating the Collection if it does not already exist. The Document
 // is stored as it's JSON encoded format.
 func (d *Document) Create(ctx context.Context, doc any) error {
-	_, err := d.collection.database.sqlite.ExecContext(ctx, fmt.Sprintf(sqlCreateTable, d.collection.ID))
-	if err != nil {
+	if err := d.collection.create(ctx); err != nil {
 		return err
 	}
 
 	buf := bytes.NewBuffer(nil)
 
-	err = json.NewEncoder(buf).Encode(doc)
+	err := json.NewEncoder(buf).Encode(doc)
 	if err != nil {
 		return err
 	}
 
-	_, err = d.collection.database.sqlite.ExecContext(ctx, fmt.Sprintf(sqlInsert, d.collection.ID, d.ID, buf.String()))
+	_, err = d.collection.q.ExecContext(ctx, fmt.Sprintf(sqlInsert, quoteIdent(d.collection.ID)), d.ID, buf.String())
 	if err != nil {
-		return err
+		return wrapErr(err)
 	}
 
+	d.data = buf.Bytes()
+	d.Revision = 1
+	d.collection.notify()
+
 	return nil
 }
 
 // Set will update a Document with the doc type within the Collection it
 // references creating the Collection if it does not already exist. Set will
-// fail if the Document does not already exist in the database. Create should be
-// used first.
+// fail with ErrNotFound if the Document does not already exist in the database.
+// Create should be used first.
 func (d *Document) Set(ctx context.Context, doc any) error {
-	_, err := d.collection.database.sqlite.ExecContext(ctx, fmt.Sprintf(sqlCreateTable, d.collection.ID))
+	return d.set(ctx, doc, sqlUpdate)
+}
+
+// SetIfRevision will update a Document like Set only if it's stored revision
+// is still rev, otherwise it fails with ErrConflict. Use the Revision from Get
+// as rev to make sure no other writes are lost.
+func (d *Document) SetIfRevision(ctx context.Context, doc any, rev int64) error {
+	err := d.set(ctx, doc, sqlUpdateIfRev, rev)
+	if !errors.Is(err, ErrNotFound) {
+		return err
+	}
+
+	// The update matched nothing, so tell a missing Document apart from one
+	// that was written since rev.
+	err = d.collection.q.QueryRowContext(ctx, fmt.Sprintf(sqlSelectRev, quoteIdent(d.collection.ID)), d.ID).Scan(&d.Revision)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%w: %s", ErrNotFound, d.ID)
+	}
 	if err != nil {
 		return err
 	}
 
+	return fmt.Errorf("%w: %s is at revision %d not %d", ErrConflict, d.ID, d.Revision, rev)
+}
+
+func (d *Document) set(ctx context.Context, doc any, query string, args ...any) error {
+	if err := d.collection.create(ctx); err != nil {
+		return err
+	}
+
 	buf := bytes.NewBuffer(nil)
 
-	err = json.NewEncoder(buf).Encode(doc)
+	err := json.NewEncoder(buf).Encode(doc)
 	if err != nil {
 		return err
 	}
 
-	_, err = d.collection.database.sqlite.ExecContext(ctx, fmt.Sprintf(sqlUpdate, d.collection.ID, buf.String(), d.ID))
+	args = append([]any{buf.String(), d.ID}, args...)
+
+	err = d.collection.q.QueryRowContext(ctx, fmt.Sprintf(query, quoteIdent(d.collection.ID)), args...).Scan(&d.Revision)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%w: %s", ErrNotFound, d.ID)
+	}
 	if err != nil {
-		return err
+		return wrapErr(err)
 	}
 
+	d.data = buf.Bytes()
+	d.collection.notify()
+
 	return nil
 }
 
 // Get will find a single Document by it's ID and call DataTo for you to
-// decode the JSON into the doc's type.
+// decode the JSON into the doc's type. Get fails with ErrNotFound if the
+// Document does not exist.
 func (d *Document) Get(ctx context.Context, doc any) error {
-	r := d.collection.database.sqlite.QueryRowContext(ctx, fmt.Sprintf(sqlSelect, d.collection.ID, d.ID))
+	if err := validateCollection(d.collection.ID); err != nil {
+		return err
+	}
+
+	r := d.collection.q.QueryRowContext(ctx, fmt.Sprintf(sqlSelect, quoteIdent(d.collection.ID)), d.ID)
 	if r.Err() != nil {
 		return r.Err()
 	}
 
 	data := make([]byte, 0)
-	err := r.Scan(&data)
+	err := r.Scan(&data, &d.Revision)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%w: %s", ErrNotFound, d.ID)
+	}
 	if err != nil {
 		return err
 	}
@@ -304,10 +534,48 @@ func (d *Document) Get(ctx context.Context, doc any) error {
 
 // Delete will remove the Document from the Collection it references.
 func (d *Document) Delete(ctx context.Context) error {
-	_, err := d.collection.database.sqlite.ExecContext(ctx, fmt.Sprintf(sqlDelete, d.collection.ID, d.ID))
+	if err := validateCollection(d.collection.ID); err != nil {
+		return err
+	}
+
+	_, err := d.collection.q.ExecContext(ctx, fmt.Sprintf(sqlDelete, quoteIdent(d.collection.ID)), d.ID)
 	if err != nil {
 		return err
 	}
 
+	d.collection.notify()
+
 	return nil
 }
+
+// DeleteIfRevision will remove the Document like Delete only if it's stored
+// revision is still rev, otherwise it fails with ErrConflict. Unlike Delete it
+// fails with ErrNotFound if the Document does not exist.
+func (d *Document) DeleteIfRevision(ctx context.Context, rev int64) error {
+	if err := validateCollection(d.collection.ID); err != nil {
+		return err
+	}
+
+	res, err := d.collection.q.ExecContext(ctx, fmt.Sprintf(sqlDeleteIfRev, quoteIdent(d.collection.ID)), d.ID, rev)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		d.collection.notify()
+		return nil
+	}
+
+	err = d.collection.q.QueryRowContext(ctx, fmt.Sprintf(sqlSelectRev, quoteIdent(d.collection.ID)), d.ID).Scan(&d.Revision)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%w: %s", ErrNotFound, d.ID)
+	}
+	if err != nil {
+		return err
+	}
+
+	return fmt.Errorf("%w: %s is at revision %d not %d", ErrConflict, d.ID, d.Revision, rev)
+}
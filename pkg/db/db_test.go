@@ -2,7 +2,12 @@ package db_test
 
 import (
 	"context"
+	"database/sql"
+	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
+	"regexp"
 	"testing"
 
 	docdb "github.com/limeleaf-coop/knbn/pkg/db"
@@ -63,3 +68,265 @@ func TestDocument(t *testing.T) {
 		t.Error("not enough docs")
 	}
 }
+
+func openTestDB(t *testing.T) *docdb.Database {
+	t.Helper()
+
+	db, err := docdb.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return db
+}
+
+func TestDocumentUntrustedText(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	names := []string{
+		"Blain's Board",
+		`back\slash \"quoted\" \n`,
+		"ünïcødé 看板 🗂️",
+		"'); DROP TABLE test; --",
+		`" OR 1=1 --`,
+		"100% _wild_ %",
+	}
+
+	for idx, name := range names {
+		id := fmt.Sprintf("doc-'%d'", idx)
+
+		d1 := doc{Name: name, Age: idx}
+		if err := db.Collection("test").Document(id).Create(ctx, &d1); err != nil {
+			t.Fatalf("Create(%q): %v", name, err)
+		}
+
+		var d2 doc
+		if err := db.Collection("test").Document(id).Get(ctx, &d2); err != nil {
+			t.Fatalf("Get(%q): %v", name, err)
+		}
+		if d2.Name != name {
+			t.Errorf("Get .Name = %q, want %q", d2.Name, name)
+		}
+
+		d1.Name = name + name
+		if err := db.Collection("test").Document(id).Set(ctx, &d1); err != nil {
+			t.Fatalf("Set(%q): %v", name, err)
+		}
+		if err := db.Collection("test").Document(id).Get(ctx, &d2); err != nil {
+			t.Fatalf("Get(%q): %v", name, err)
+		}
+		if d2.Name != name+name {
+			t.Errorf("Get .Name = %q, want %q", d2.Name, name+name)
+		}
+
+		docs, err := db.Collection("test").Query(ctx, "$.Name", docdb.OpEqual, name+name)
+		if err != nil {
+			t.Fatalf("Query(%q): %v", name, err)
+		}
+		if len(docs) != 1 || docs[0].ID != id {
+			t.Errorf("Query(%q) returned %d docs, want %q", name, len(docs), id)
+		}
+	}
+
+	docs, err := db.Collection("test").QueryAll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != len(names) {
+		t.Errorf("QueryAll returned %d docs, want %d", len(docs), len(names))
+	}
+
+	if err := db.Collection("test").Document("doc-'0'").Delete(ctx); err != nil {
+		t.Fatal(err)
+	}
+	docs, err = db.Collection("test").QueryAll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != len(names)-1 {
+		t.Errorf("QueryAll after Delete returned %d docs, want %d", len(docs), len(names)-1)
+	}
+}
+
+func TestInvalidIdentifiers(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	for _, id := range []string{"", "test; DROP TABLE test", `te"st`, "_internal", "1test"} {
+		err := db.Collection(id).Document("a").Create(ctx, &doc{})
+		if !errors.Is(err, docdb.ErrInvalidCollection) {
+			t.Errorf("Create in %q: got %v, want ErrInvalidCollection", id, err)
+		}
+	}
+
+	if err := db.Collection("test").Document("a").Create(ctx, &doc{}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, keypath := range []string{"", "Name", "$.Name' OR 1=1 --", "$.Na%", "$.Numbers[x]"} {
+		_, err := db.Collection("test").Query(ctx, keypath, docdb.OpEqual, "a")
+		if !errors.Is(err, docdb.ErrInvalidKeypath) {
+			t.Errorf("Query(%q): got %v, want ErrInvalidKeypath", keypath, err)
+		}
+	}
+
+	_, err := db.Collection("test").Query(ctx, "$.Name", docdb.Op(42), "a")
+	if !errors.Is(err, docdb.ErrInvalidOp) {
+		t.Errorf("Query with Op(42): got %v, want ErrInvalidOp", err)
+	}
+}
+
+func TestDocumentRevision(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	d := db.Collection("test").Document("a")
+	if err := d.Create(ctx, &doc{Name: "one"}); err != nil {
+		t.Fatal(err)
+	}
+	if d.Revision != 1 {
+		t.Errorf("Revision after Create = %d, want 1", d.Revision)
+	}
+
+	// Two readers see the same revision.
+	var d1, d2 doc
+	r1 := db.Collection("test").Document("a")
+	r2 := db.Collection("test").Document("a")
+	if err := r1.Get(ctx, &d1); err != nil {
+		t.Fatal(err)
+	}
+	if err := r2.Get(ctx, &d2); err != nil {
+		t.Fatal(err)
+	}
+
+	d1.Name = "two"
+	if err := r1.SetIfRevision(ctx, &d1, r1.Revision); err != nil {
+		t.Fatal(err)
+	}
+	if r1.Revision != 2 {
+		t.Errorf("Revision after SetIfRevision = %d, want 2", r1.Revision)
+	}
+
+	// The second reader's write is rejected instead of overwriting the first.
+	d2.Name = "lost"
+	err := r2.SetIfRevision(ctx, &d2, r2.Revision)
+	if !errors.Is(err, docdb.ErrConflict) {
+		t.Errorf("stale SetIfRevision: got %v, want ErrConflict", err)
+	}
+	if r2.Revision != 2 {
+		t.Errorf("Revision after conflict = %d, want 2", r2.Revision)
+	}
+
+	var got doc
+	if err := db.Collection("test").Document("a").Get(ctx, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != "two" {
+		t.Errorf(".Name = %q, want %q", got.Name, "two")
+	}
+
+	if err := d.Set(ctx, &doc{Name: "three"}); err != nil {
+		t.Fatal(err)
+	}
+	if d.Revision != 3 {
+		t.Errorf("Revision after Set = %d, want 3", d.Revision)
+	}
+
+	docs, err := db.Collection("test").QueryAll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 1 || docs[0].Revision != 3 {
+		t.Errorf("QueryAll did not return revision 3")
+	}
+
+	missing := db.Collection("test").Document("missing")
+	if err := missing.Get(ctx, &got); !errors.Is(err, docdb.ErrNotFound) {
+		t.Errorf("Get missing: got %v, want ErrNotFound", err)
+	}
+	if err := missing.Set(ctx, &got); !errors.Is(err, docdb.ErrNotFound) {
+		t.Errorf("Set missing: got %v, want ErrNotFound", err)
+	}
+	if err := missing.SetIfRevision(ctx, &got, 1); !errors.Is(err, docdb.ErrNotFound) {
+		t.Errorf("SetIfRevision missing: got %v, want ErrNotFound", err)
+	}
+}
+
+func TestDocumentDeleteIfRevision(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	d := db.Collection("test").Document("a")
+	if err := d.Create(ctx, &doc{Name: "one"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Set(ctx, &doc{Name: "two"}); err != nil {
+		t.Fatal(err)
+	}
+
+	err := d.DeleteIfRevision(ctx, 1)
+	if !errors.Is(err, docdb.ErrConflict) {
+		t.Errorf("stale DeleteIfRevision: got %v, want ErrConflict", err)
+	}
+
+	if err := d.DeleteIfRevision(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	var got doc
+	if err := d.Get(ctx, &got); !errors.Is(err, docdb.ErrNotFound) {
+		t.Errorf("Get deleted: got %v, want ErrNotFound", err)
+	}
+	if err := d.DeleteIfRevision(ctx, 2); !errors.Is(err, docdb.ErrNotFound) {
+		t.Errorf("DeleteIfRevision missing: got %v, want ErrNotFound", err)
+	}
+}
+
+func TestOpenMigratesRevisions(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "test.db")
+
+	legacy, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = legacy.Exec(`CREATE TABLE boards (id TEXT PRIMARY KEY, data JSON); INSERT INTO boards (id, data) VALUES ('ops', '{"Name":"Ops"}')`)
+	legacy.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := docdb.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var d doc
+	ops := db.Collection("boards").Document("ops")
+	if err := ops.Get(ctx, &d); err != nil {
+		t.Fatal(err)
+	}
+	if d.Name != "Ops" || ops.Revision != 1 {
+		t.Errorf("Get = %q at revision %d, want \"Ops\" at revision 1", d.Name, ops.Revision)
+	}
+	if err := ops.SetIfRevision(ctx, &d, 1); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNewID(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		id := docdb.NewID()
+		if !regexp.MustCompile(`^[0-9a-v]{20}$`).MatchString(id) {
+			t.Fatalf("NewID = %q, want 20 lowercase letters and digits", id)
+		}
+		if seen[id] {
+			t.Fatalf("NewID returned %q twice", id)
+		}
+		seen[id] = true
+	}
+}
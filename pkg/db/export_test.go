@@ -0,0 +1,29 @@
+package db
+
+import "context"
+
+// ExplainQuery returns the query plan SQLite uses to run q.
+func ExplainQuery(ctx context.Context, q *Query) (string, error) {
+	sql, args, err := q.build()
+	if err != nil {
+		return "", err
+	}
+
+	r, err := q.collection.q.QueryContext(ctx, "EXPLAIN QUERY PLAN "+sql, args...)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	plan := ""
+	for r.Next() {
+		var id, parent, notused int
+		var detail string
+		if err := r.Scan(&id, &parent, &notused, &detail); err != nil {
+			return "", err
+		}
+		plan += detail + "\n"
+	}
+
+	return plan, r.Err()
+}
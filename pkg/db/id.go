@@ -0,0 +1,21 @@
+package db
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+)
+
+// idEncoding writes IDs with lowercase letters and digits only so they are
+// safe in URLs, HTML ids and keypaths alike.
+var idEncoding = base32.NewEncoding("0123456789abcdefghijklmnopqrstuv").WithPadding(base32.NoPadding)
+
+// NewID returns a random 20 character ID for a Document or a value within
+// one. IDs are unique without coordinating with the database.
+func NewID() string {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+
+	return idEncoding.EncodeToString(b)
+}
@@ -0,0 +1,139 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"strings"
+)
+
+const (
+	sqlCreateIndex = `CREATE %sINDEX IF NOT EXISTS %s ON %s (%s)`
+	sqlDropIndex   = `DROP INDEX IF EXISTS %s`
+	sqlListIndexes = `SELECT name, sql FROM sqlite_master WHERE (type = 'index' AND tbl_name = ? AND name LIKE 'idx\_%' ESCAPE '\') ORDER BY name`
+)
+
+var (
+	indexNameRegexp    = regexp.MustCompile(`[^A-Za-z0-9]+`)
+	indexKeypathRegexp = regexp.MustCompile(`json_extract\(data, '([^']*)'\)`)
+)
+
+// IndexOptions configures an index created with EnsureIndex.
+type IndexOptions struct {
+	// Unique prevents two Documents in the Collection from having the same
+	// value at the keypath. Documents without a value at the keypath are not
+	// considered duplicates of each other.
+	Unique bool
+}
+
+// Index is an index on a keypath within a Collection.
+type Index struct {
+	Name    string
+	Keypath string
+	Unique  bool
+}
+
+// indexName returns the name of the index on keypath. The hash keeps names of
+// keypaths that sanitize to the same string, like "$.a_b" and "$.a.b", apart.
+func (c *Collection) indexName(keypath string) string {
+	h := fnv.New32a()
+	h.Write([]byte(keypath))
+
+	sanitized := strings.Trim(indexNameRegexp.ReplaceAllString(keypath, "_"), "_")
+
+	return fmt.Sprintf("idx_%s_%s_%08x", c.ID, sanitized, h.Sum32())
+}
+
+// EnsureIndex creates an index on keypath if one does not already exist so
+// Query and Where conditions on the keypath don't have to scan every Document.
+// If the index exists with different options it is recreated. Keypaths with
+// wildcards can not be indexed.
+func (c *Collection) EnsureIndex(ctx context.Context, keypath string, opts IndexOptions) error {
+	kp, err := parseKeypath(keypath)
+	if err != nil {
+		return err
+	}
+	if kp.hasWildcard() {
+		return fmt.Errorf("%w: can not index wildcard %q", ErrInvalidKeypath, keypath)
+	}
+
+	if err := c.create(ctx); err != nil {
+		return err
+	}
+
+	indexes, err := c.Indexes(ctx)
+	if err != nil {
+		return err
+	}
+
+	name := c.indexName(keypath)
+	for _, index := range indexes {
+		if index.Name == name && index.Unique != opts.Unique {
+			if err := c.DropIndex(ctx, keypath); err != nil {
+				return err
+			}
+		}
+	}
+
+	unique := ""
+	if opts.Unique {
+		unique = "UNIQUE "
+	}
+
+	_, err = c.q.ExecContext(ctx, fmt.Sprintf(sqlCreateIndex, unique, quoteIdent(name), quoteIdent(c.ID), kp.extract("data", kp[0])))
+
+	return wrapErr(err)
+}
+
+// Indexes lists the indexes created by EnsureIndex on the Collection.
+func (c *Collection) Indexes(ctx context.Context) ([]Index, error) {
+	if err := validateCollection(c.ID); err != nil {
+		return nil, err
+	}
+
+	r, err := c.q.QueryContext(ctx, sqlListIndexes, c.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	indexes := make([]Index, 0)
+	for r.Next() {
+		var name, sql string
+		if err := r.Scan(&name, &sql); err != nil {
+			return nil, err
+		}
+
+		match := indexKeypathRegexp.FindStringSubmatch(sql)
+		if match == nil {
+			continue
+		}
+
+		indexes = append(indexes, Index{
+			Name:    name,
+			Keypath: match[1],
+			Unique:  strings.HasPrefix(sql, "CREATE UNIQUE"),
+		})
+	}
+
+	if err := r.Err(); err != nil {
+		return nil, err
+	}
+
+	return indexes, nil
+}
+
+// DropIndex removes the index on keypath if it exists.
+func (c *Collection) DropIndex(ctx context.Context, keypath string) error {
+	if err := validateCollection(c.ID); err != nil {
+		return err
+	}
+	if _, err := parseKeypath(keypath); err != nil {
+		return err
+	}
+
+	_, err := c.q.ExecContext(ctx, fmt.Sprintf(sqlDropIndex, quoteIdent(c.indexName(keypath))))
+
+	return err
+}
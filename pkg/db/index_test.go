@@ -0,0 +1,103 @@
+package db_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	docdb "github.com/limeleaf-coop/knbn/pkg/db"
+)
+
+type account struct {
+	Email string
+}
+
+func TestEnsureIndex(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	accounts := db.Collection("accounts")
+
+	if err := accounts.EnsureIndex(ctx, "$.Email", docdb.IndexOptions{Unique: true}); err != nil {
+		t.Fatal(err)
+	}
+	// Ensuring the same index twice is a no-op.
+	if err := accounts.EnsureIndex(ctx, "$.Email", docdb.IndexOptions{Unique: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := accounts.Document("blain").Create(ctx, &account{Email: "blain@limeleaf.io"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := accounts.Document("erik").Create(ctx, &account{Email: "erik@limeleaf.io"}); err != nil {
+		t.Fatal(err)
+	}
+
+	err := accounts.Document("imposter").Create(ctx, &account{Email: "blain@limeleaf.io"})
+	if !errors.Is(err, docdb.ErrDuplicate) {
+		t.Errorf("Create with duplicate email: got %v, want ErrDuplicate", err)
+	}
+	err = accounts.Document("erik").Set(ctx, &account{Email: "blain@limeleaf.io"})
+	if !errors.Is(err, docdb.ErrDuplicate) {
+		t.Errorf("Set with duplicate email: got %v, want ErrDuplicate", err)
+	}
+	err = accounts.Document("erik").Create(ctx, &account{Email: "erik@example.com"})
+	if !errors.Is(err, docdb.ErrDuplicate) {
+		t.Errorf("Create with duplicate id: got %v, want ErrDuplicate", err)
+	}
+
+	plan, err := docdb.ExplainQuery(ctx, accounts.Where("$.Email", docdb.OpEqual, "blain@limeleaf.io"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(plan, "USING INDEX idx_accounts_Email") {
+		t.Errorf("query plan does not use index:\n%s", plan)
+	}
+
+	docs, err := accounts.Query(ctx, "$.Email", docdb.OpEqual, "blain@limeleaf.io")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 1 || docs[0].ID != "blain" {
+		t.Errorf("Query returned %d docs, want blain", len(docs))
+	}
+
+	indexes, err := accounts.Indexes(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(indexes) != 1 || indexes[0].Keypath != "$.Email" || !indexes[0].Unique {
+		t.Errorf("Indexes = %+v, want one unique index on $.Email", indexes)
+	}
+
+	// Recreating the index without Unique allows duplicates.
+	if err := accounts.EnsureIndex(ctx, "$.Email", docdb.IndexOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := accounts.Document("imposter").Create(ctx, &account{Email: "blain@limeleaf.io"}); err != nil {
+		t.Error(err)
+	}
+
+	// Making it unique again fails while duplicates exist.
+	err = accounts.EnsureIndex(ctx, "$.Email", docdb.IndexOptions{Unique: true})
+	if !errors.Is(err, docdb.ErrDuplicate) {
+		t.Errorf("EnsureIndex with duplicates: got %v, want ErrDuplicate", err)
+	}
+
+	if err := accounts.DropIndex(ctx, "$.Email"); err != nil {
+		t.Fatal(err)
+	}
+	indexes, err = accounts.Indexes(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(indexes) != 0 {
+		t.Errorf("Indexes after DropIndex = %+v, want none", indexes)
+	}
+
+	err = accounts.EnsureIndex(ctx, "$.Emails[*]", docdb.IndexOptions{})
+	if !errors.Is(err, docdb.ErrInvalidKeypath) {
+		t.Errorf("EnsureIndex on wildcard: got %v, want ErrInvalidKeypath", err)
+	}
+}
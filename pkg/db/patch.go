@@ -0,0 +1,336 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// A patch compiles to a chain of common table expressions where every step
+// selects the document after one operation as d, and optionally a value
+// carried to the next step as v. A step that can't be applied selects NULL,
+// which every later step passes along, so the UPDATE matches nothing.
+const (
+	sqlPatch          = `WITH s0(d, v) AS (SELECT data, NULL FROM %[1]s WHERE (id = ?))%[2]s UPDATE %[1]s SET data = p.d, rev = rev + 1 FROM s%[3]d AS p WHERE (%[1]s.id = ? AND p.d IS NOT NULL%[4]s) RETURNING %[1]s.data, %[1]s.rev`
+	sqlPatchStep      = `, s%d(d, v) AS (SELECT %s, %s FROM s%d)`
+	sqlPatchArrayInit = `json_set(d, %[1]s, json((SELECT json_group_array(json(v) ORDER BY k) FROM (SELECT key AS k, d -> fullkey AS v FROM json_each(d, %[1]s) UNION ALL SELECT %[2]d - 0.5, %[3]s))))`
+)
+
+var (
+	// ErrPatchFailed is returned when a patch can not be applied to a
+	// Document, such as when a "test" operation does not match or a path does
+	// not exist.
+	ErrPatchFailed = errors.New("patch failed")
+
+	// ErrInvalidPatch is returned when a patch is malformed.
+	ErrInvalidPatch = errors.New("invalid patch")
+)
+
+var (
+	pointerKeyRegexp   = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	pointerIndexRegexp = regexp.MustCompile(`^(0|[1-9][0-9]*)$`)
+)
+
+// Patch is a partial update applied to a Document with Document.Patch. It is
+// either a JSONPatch or a MergePatch.
+type Patch interface {
+	steps() ([]patchStep, error)
+}
+
+type patchStep struct {
+	doc   string
+	value string
+	args  []any
+}
+
+// PatchOp is a single RFC 6902 JSON Patch operation. Path and From are JSON
+// Pointers such as "/Lists/2/Cards/0/Title". Object keys in pointers must be
+// valid keypath keys and numeric segments always address array elements.
+type PatchOp struct {
+	Op    string `json:"op"`
+	Path  string `json:"path"`
+	From  string `json:"from,omitempty"`
+	Value any    `json:"value,omitempty"`
+}
+
+// JSONPatch is an RFC 6902 JSON Patch. The operations are applied in order and
+// either all of them are applied or none are. Values in "test" operations are
+// compared by their minified JSON so object keys must be in the same order.
+type JSONPatch []PatchOp
+
+// MergePatch is an RFC 7396 JSON Merge Patch document.
+type MergePatch json.RawMessage
+
+func (p MergePatch) steps() ([]patchStep, error) {
+	if !json.Valid(p) {
+		return nil, fmt.Errorf("%w: merge patch is not valid JSON", ErrInvalidPatch)
+	}
+
+	return []patchStep{{doc: "json_patch(d, json(?))", value: "NULL", args: []any{string(p)}}}, nil
+}
+
+func (p JSONPatch) steps() ([]patchStep, error) {
+	steps := make([]patchStep, 0, len(p))
+
+	for idx, op := range p {
+		path, err := parsePointer(op.Path)
+		if err != nil {
+			return nil, fmt.Errorf("operation %d: %w", idx, err)
+		}
+
+		switch op.Op {
+		case "add", "replace", "test":
+			value, err := json.Marshal(op.Value)
+			if err != nil {
+				return nil, fmt.Errorf("%w: operation %d: %v", ErrInvalidPatch, idx, err)
+			}
+
+			var step patchStep
+			switch op.Op {
+			case "add":
+				step, err = path.add("json(?)")
+			case "replace":
+				step, err = path.replace()
+			case "test":
+				step, err = path.test()
+			}
+			if err != nil {
+				return nil, fmt.Errorf("operation %d: %w", idx, err)
+			}
+
+			step.args = append(step.args, string(value))
+			steps = append(steps, step)
+		case "remove":
+			step, err := path.remove()
+			if err != nil {
+				return nil, fmt.Errorf("operation %d: %w", idx, err)
+			}
+
+			steps = append(steps, step)
+		case "move", "copy":
+			from, err := parsePointer(op.From)
+			if err != nil {
+				return nil, fmt.Errorf("operation %d: %w", idx, err)
+			}
+			if from.append {
+				return nil, fmt.Errorf("%w: operation %d: can not %s from %q", ErrInvalidPatch, idx, op.Op, op.From)
+			}
+
+			var step patchStep
+			if op.Op == "move" {
+				if strings.HasPrefix(op.Path, op.From+"/") {
+					return nil, fmt.Errorf("%w: operation %d: can not move %q into itself", ErrInvalidPatch, idx, op.From)
+				}
+				step, err = from.remove()
+			} else {
+				step = patchStep{doc: "iif(json_type(d, " + from.literal() + ") IS NOT NULL, d, NULL)"}
+			}
+			if err != nil {
+				return nil, fmt.Errorf("operation %d: %w", idx, err)
+			}
+			step.value = "d -> " + from.literal()
+
+			add, err := path.add("json(v)")
+			if err != nil {
+				return nil, fmt.Errorf("operation %d: %w", idx, err)
+			}
+
+			steps = append(steps, step, add)
+		default:
+			return nil, fmt.Errorf("%w: operation %d: unknown op %q", ErrInvalidPatch, idx, op.Op)
+		}
+	}
+
+	return steps, nil
+}
+
+// pointer is a JSON Pointer translated into SQLite path segments.
+type pointer struct {
+	parent string
+	last   string
+	index  int
+	array  bool
+	append bool
+	root   bool
+}
+
+// parsePointer translates an RFC 6901 JSON Pointer into a SQLite path.
+func parsePointer(s string) (pointer, error) {
+	if s == "" {
+		return pointer{root: true}, nil
+	}
+	if !strings.HasPrefix(s, "/") {
+		return pointer{}, fmt.Errorf("%w: %q", ErrInvalidKeypath, s)
+	}
+
+	segments := strings.Split(s[1:], "/")
+
+	p := pointer{parent: "$"}
+	for idx, segment := range segments {
+		segment = strings.NewReplacer("~1", "/", "~0", "~").Replace(segment)
+		last := idx == len(segments)-1
+
+		var part string
+		switch {
+		case segment == "-" && last:
+			part = "[#]"
+			p.array = true
+			p.append = true
+		case pointerIndexRegexp.MatchString(segment):
+			part = "[" + segment + "]"
+			p.index, _ = strconv.Atoi(segment)
+			p.array = true
+		case pointerKeyRegexp.MatchString(segment):
+			part = "." + segment
+			p.array = false
+		default:
+			return pointer{}, fmt.Errorf("%w: %q", ErrInvalidKeypath, s)
+		}
+
+		if last {
+			p.last = part
+		} else {
+			p.parent += part
+		}
+	}
+
+	return p, nil
+}
+
+func (p pointer) literal() string {
+	if p.root {
+		return quoteLiteral("$")
+	}
+
+	return quoteLiteral(p.parent + p.last)
+}
+
+// exists guards expr so it only runs if the pointer addresses a value.
+func (p pointer) exists(expr string) string {
+	return "iif(json_type(d, " + p.literal() + ") IS NOT NULL, " + expr + ", NULL)"
+}
+
+func (p pointer) add(value string) (patchStep, error) {
+	parent := quoteLiteral(p.parent)
+
+	switch {
+	case p.root:
+		return patchStep{doc: "iif(d IS NOT NULL, " + value + ", NULL)", value: "NULL"}, nil
+	case p.append:
+		return patchStep{doc: "iif(json_type(d, " + parent + ") = 'array', json_insert(d, " + p.literal() + ", " + value + "), NULL)", value: "NULL"}, nil
+	case p.array:
+		// SQLite can only insert at the end of an array, so inserting before an
+		// existing element rebuilds the array in order around the new value.
+		insert := fmt.Sprintf(sqlPatchArrayInit, parent, p.index, value)
+		return patchStep{doc: fmt.Sprintf("iif(json_type(d, %[1]s) = 'array' AND json_array_length(d, %[1]s) >= %[2]d, %[3]s, NULL)", parent, p.index, insert), value: "NULL"}, nil
+	default:
+		return patchStep{doc: "iif(json_type(d, " + parent + ") = 'object', json_set(d, " + p.literal() + ", " + value + "), NULL)", value: "NULL"}, nil
+	}
+}
+
+func (p pointer) replace() (patchStep, error) {
+	if p.append {
+		return patchStep{}, fmt.Errorf("%w: can not replace \"-\"", ErrInvalidPatch)
+	}
+	if p.root {
+		return patchStep{doc: "iif(d IS NOT NULL, json(?), NULL)", value: "NULL"}, nil
+	}
+
+	return patchStep{doc: p.exists("json_replace(d, " + p.literal() + ", json(?))"), value: "NULL"}, nil
+}
+
+func (p pointer) remove() (patchStep, error) {
+	if p.append || p.root {
+		return patchStep{}, fmt.Errorf("%w: can not remove %q", ErrInvalidPatch, p.parent+p.last)
+	}
+
+	return patchStep{doc: p.exists("json_remove(d, " + p.literal() + ")"), value: "NULL"}, nil
+}
+
+func (p pointer) test() (patchStep, error) {
+	if p.append {
+		return patchStep{}, fmt.Errorf("%w: can not test \"-\"", ErrInvalidPatch)
+	}
+
+	return patchStep{doc: "iif((d -> " + p.literal() + ") = json(?), d, NULL)", value: "NULL"}, nil
+}
+
+// Patch applies a JSONPatch or MergePatch to the Document in a single UPDATE
+// statement so concurrent writes to other parts of the Document are not lost.
+// Patch fails with ErrPatchFailed without changing the Document if any
+// operation can not be applied. A JSONPatch without any operations leaves the
+// data as it is but still increments the revision, like an empty MergePatch.
+func (d *Document) Patch(ctx context.Context, patch Patch) error {
+	return d.patch(ctx, patch, 0)
+}
+
+// PatchIfRevision applies a patch like Patch only if the Document's stored
+// revision is still rev, otherwise it fails with ErrConflict.
+func (d *Document) PatchIfRevision(ctx context.Context, patch Patch, rev int64) error {
+	if rev < 1 {
+		return fmt.Errorf("%w: %s is never at revision %d", ErrConflict, d.ID, rev)
+	}
+
+	return d.patch(ctx, patch, rev)
+}
+
+// patch applies the patch, only if the Document is at revision rev when rev is
+// not 0.
+func (d *Document) patch(ctx context.Context, patch Patch, rev int64) error {
+	if err := validateCollection(d.collection.ID); err != nil {
+		return err
+	}
+
+	steps, err := patch.steps()
+	if err != nil {
+		return err
+	}
+
+	ctes := make([]string, len(steps))
+	args := []any{d.ID}
+	for idx, step := range steps {
+		ctes[idx] = fmt.Sprintf(sqlPatchStep, idx+1, step.doc, step.value, idx)
+		args = append(args, step.args...)
+	}
+	args = append(args, d.ID)
+
+	cond := ""
+	if rev != 0 {
+		cond = " AND rev = ?"
+		args = append(args, rev)
+	}
+
+	query := fmt.Sprintf(sqlPatch, quoteIdent(d.collection.ID), strings.Join(ctes, ""), len(steps), cond)
+
+	var data []byte
+	err = d.collection.q.QueryRowContext(ctx, query, args...).Scan(&data, &d.Revision)
+	if err == nil {
+		d.data = data
+		d.collection.notify()
+		return nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return wrapErr(err)
+	}
+
+	// Nothing was updated, so find out whether the Document is missing, has
+	// moved on from rev, or the patch did not apply.
+	var stored int64
+	err = d.collection.q.QueryRowContext(ctx, fmt.Sprintf(sqlSelectRev, quoteIdent(d.collection.ID)), d.ID).Scan(&stored)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return fmt.Errorf("%w: %s", ErrNotFound, d.ID)
+	case err != nil:
+		return err
+	case rev != 0 && rev != stored:
+		d.Revision = stored
+		return fmt.Errorf("%w: %s is at revision %d not %d", ErrConflict, d.ID, stored, rev)
+	default:
+		return fmt.Errorf("%w: %s", ErrPatchFailed, d.ID)
+	}
+}
@@ -0,0 +1,220 @@
+package db_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+
+	docdb "github.com/limeleaf-coop/knbn/pkg/db"
+)
+
+// canonical re-encodes JSON so object keys are sorted.
+func canonical(t *testing.T, data string) string {
+	t.Helper()
+
+	var v any
+	if err := json.Unmarshal([]byte(data), &v); err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(b)
+}
+
+func TestDocumentPatch(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	const board = `{"Title":"Ops","Lists":[{"Title":"Backlog","Cards":[{"Title":"LLC"},{"Title":"Email"}]},{"Title":"Done","Cards":[]}]}`
+
+	tests := []struct {
+		name  string
+		patch docdb.Patch
+		want  string
+		err   error
+	}{
+		{
+			name:  "replace",
+			patch: docdb.JSONPatch{{Op: "replace", Path: "/Lists/0/Cards/1/Title", Value: "Blain's \"email\""}},
+			want:  `{"Title":"Ops","Lists":[{"Title":"Backlog","Cards":[{"Title":"LLC"},{"Title":"Blain's \"email\""}]},{"Title":"Done","Cards":[]}]}`,
+		},
+		{
+			name:  "add object member",
+			patch: docdb.JSONPatch{{Op: "add", Path: "/Lists/1/Color", Value: map[string]any{"Name": "green", "Dark": true}}},
+			want:  `{"Title":"Ops","Lists":[{"Title":"Backlog","Cards":[{"Title":"LLC"},{"Title":"Email"}]},{"Title":"Done","Cards":[],"Color":{"Name":"green","Dark":true}}]}`,
+		},
+		{
+			name:  "add array element",
+			patch: docdb.JSONPatch{{Op: "add", Path: "/Lists/0/Cards/1", Value: map[string]any{"Title": "New"}}},
+			want:  `{"Title":"Ops","Lists":[{"Title":"Backlog","Cards":[{"Title":"LLC"},{"Title":"New"},{"Title":"Email"}]},{"Title":"Done","Cards":[]}]}`,
+		},
+		{
+			name:  "add to end of array",
+			patch: docdb.JSONPatch{{Op: "add", Path: "/Lists/1/Cards/-", Value: map[string]any{"Title": "Last"}}, {Op: "add", Path: "/Lists/1/Cards/1", Value: "end"}},
+			want:  `{"Title":"Ops","Lists":[{"Title":"Backlog","Cards":[{"Title":"LLC"},{"Title":"Email"}]},{"Title":"Done","Cards":[{"Title":"Last"},"end"]}]}`,
+		},
+		{
+			name:  "remove",
+			patch: docdb.JSONPatch{{Op: "remove", Path: "/Lists/0/Cards/0"}},
+			want:  `{"Title":"Ops","Lists":[{"Title":"Backlog","Cards":[{"Title":"Email"}]},{"Title":"Done","Cards":[]}]}`,
+		},
+		{
+			name:  "move between arrays",
+			patch: docdb.JSONPatch{{Op: "move", From: "/Lists/0/Cards/1", Path: "/Lists/1/Cards/0"}},
+			want:  `{"Title":"Ops","Lists":[{"Title":"Backlog","Cards":[{"Title":"LLC"}]},{"Title":"Done","Cards":[{"Title":"Email"}]}]}`,
+		},
+		{
+			name:  "move within array",
+			patch: docdb.JSONPatch{{Op: "move", From: "/Lists/0/Cards/1", Path: "/Lists/0/Cards/0"}},
+			want:  `{"Title":"Ops","Lists":[{"Title":"Backlog","Cards":[{"Title":"Email"},{"Title":"LLC"}]},{"Title":"Done","Cards":[]}]}`,
+		},
+		{
+			name:  "copy",
+			patch: docdb.JSONPatch{{Op: "copy", From: "/Lists/0/Title", Path: "/Lists/1/Title"}},
+			want:  `{"Title":"Ops","Lists":[{"Title":"Backlog","Cards":[{"Title":"LLC"},{"Title":"Email"}]},{"Title":"Backlog","Cards":[]}]}`,
+		},
+		{
+			name:  "test then replace",
+			patch: docdb.JSONPatch{{Op: "test", Path: "/Lists/0/Title", Value: "Backlog"}, {Op: "replace", Path: "/Title", Value: "Tested"}},
+			want:  `{"Title":"Tested","Lists":[{"Title":"Backlog","Cards":[{"Title":"LLC"},{"Title":"Email"}]},{"Title":"Done","Cards":[]}]}`,
+		},
+		{
+			name:  "replace root",
+			patch: docdb.JSONPatch{{Op: "replace", Path: "", Value: map[string]any{"Title": "Root"}}},
+			want:  `{"Title":"Root"}`,
+		},
+		{
+			name:  "merge patch",
+			patch: docdb.MergePatch(`{"Title":"Merged","Owner":"blain","Lists":null}`),
+			want:  `{"Title":"Merged","Owner":"blain"}`,
+		},
+		{
+			name:  "failed test",
+			patch: docdb.JSONPatch{{Op: "replace", Path: "/Title", Value: "Changed"}, {Op: "test", Path: "/Lists/0/Title", Value: "Doing"}},
+			err:   docdb.ErrPatchFailed,
+		},
+		{
+			name:  "replace missing",
+			patch: docdb.JSONPatch{{Op: "replace", Path: "/Lists/5/Title", Value: "x"}},
+			err:   docdb.ErrPatchFailed,
+		},
+		{
+			name:  "add past end of array",
+			patch: docdb.JSONPatch{{Op: "add", Path: "/Lists/0/Cards/3", Value: "x"}},
+			err:   docdb.ErrPatchFailed,
+		},
+		{
+			name:  "add to missing parent",
+			patch: docdb.JSONPatch{{Op: "add", Path: "/Missing/Title", Value: "x"}},
+			err:   docdb.ErrPatchFailed,
+		},
+		{
+			name:  "move into itself",
+			patch: docdb.JSONPatch{{Op: "move", From: "/Lists/0", Path: "/Lists/0/Cards/0"}},
+			err:   docdb.ErrInvalidPatch,
+		},
+		{
+			name:  "unknown op",
+			patch: docdb.JSONPatch{{Op: "upsert", Path: "/Title"}},
+			err:   docdb.ErrInvalidPatch,
+		},
+		{
+			name:  "untrusted pointer",
+			patch: docdb.JSONPatch{{Op: "replace", Path: "/Title') --", Value: "x"}},
+			err:   docdb.ErrInvalidKeypath,
+		},
+		{
+			name:  "invalid merge patch",
+			patch: docdb.MergePatch(`{"Title":`),
+			err:   docdb.ErrInvalidPatch,
+		},
+	}
+
+	for idx, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := db.Collection("boards").Document(fmt.Sprint(idx))
+			if err := d.Create(ctx, json.RawMessage(board)); err != nil {
+				t.Fatal(err)
+			}
+
+			err := d.Patch(ctx, tt.patch)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Patch returned %v, want %v", err, tt.err)
+			}
+
+			var got json.RawMessage
+			if err := db.Collection("boards").Document(fmt.Sprint(idx)).Get(ctx, &got); err != nil {
+				t.Fatal(err)
+			}
+
+			want := tt.want
+			if tt.err != nil {
+				want = board
+			}
+			if canonical(t, string(got)) != canonical(t, want) {
+				t.Errorf("got %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestDocumentPatchEmpty(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	d := db.Collection("boards").Document("ops")
+	if err := d.Create(ctx, json.RawMessage(`{"Title":"Ops"}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.PatchIfRevision(ctx, docdb.JSONPatch{}, 1); err != nil {
+		t.Fatal(err)
+	}
+	if d.Revision != 2 {
+		t.Errorf("Revision = %d, want 2", d.Revision)
+	}
+	var got kanban
+	if err := d.DataTo(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Title != "Ops" {
+		t.Errorf("Title = %q, want it unchanged", got.Title)
+	}
+
+	err := d.PatchIfRevision(ctx, docdb.JSONPatch{}, 1)
+	if !errors.Is(err, docdb.ErrConflict) {
+		t.Errorf("stale empty PatchIfRevision: got %v, want ErrConflict", err)
+	}
+}
+
+func TestDocumentPatchIfRevision(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	d := db.Collection("boards").Document("ops")
+	if err := d.Create(ctx, json.RawMessage(`{"Title":"Ops"}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.PatchIfRevision(ctx, docdb.MergePatch(`{"Title":"One"}`), 1); err != nil {
+		t.Fatal(err)
+	}
+	if d.Revision != 2 {
+		t.Errorf("Revision = %d, want 2", d.Revision)
+	}
+
+	err := d.PatchIfRevision(ctx, docdb.MergePatch(`{"Title":"Stale"}`), 1)
+	if !errors.Is(err, docdb.ErrConflict) {
+		t.Errorf("stale PatchIfRevision: got %v, want ErrConflict", err)
+	}
+
+	err = db.Collection("boards").Document("missing").Patch(ctx, docdb.MergePatch(`{}`))
+	if !errors.Is(err, docdb.ErrNotFound) {
+		t.Errorf("Patch missing: got %v, want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,272 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+const (
+	sqlQueryBuilder      = `SELECT id, data, rev FROM %s WHERE %s ORDER BY %s LIMIT %d OFFSET %d`
+	sqlWildcardCondition = `EXISTS (SELECT 1 FROM %s WHERE %s %s %s)`
+	sqlInValues          = `(SELECT value FROM json_each(?))`
+	sqlWildcardSource    = `json_each(%s, %s) AS w%d`
+)
+
+// keypath is a validated keypath split at each "[*]" wildcard. Every part after
+// the first is relative to the array element matched by the wildcard before it.
+type keypath []string
+
+func parseKeypath(s string) (keypath, error) {
+	if !keypathRegexp.MatchString(s) {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidKeypath, s)
+	}
+
+	kp := keypath(strings.Split(s, "[*]"))
+	for idx := 1; idx < len(kp); idx++ {
+		kp[idx] = "$" + kp[idx]
+	}
+
+	return kp, nil
+}
+
+// hasWildcard reports whether the keypath matches more than one value.
+func (kp keypath) hasWildcard() bool {
+	return len(kp) > 1
+}
+
+// extract returns the json_extract of the keypath part from value.
+func (kp keypath) extract(value string, part string) string {
+	return "json_extract(" + value + ", " + quoteLiteral(part) + ")"
+}
+
+// operand returns the right hand side of a comparison with op, which is a
+// single parameter holding a JSON array for OpIn.
+func operand(op Op) string {
+	if op == OpIn {
+		return sqlInValues
+	}
+
+	return "?"
+}
+
+// condition compiles the keypath into a condition comparing the value it
+// addresses with a single parameter. Keypaths without wildcards use
+// json_extract directly so the condition can use an index created by
+// EnsureIndex. Wildcards are expanded with one json_each per "[*]" inside an
+// EXISTS so a Document matches once no matter how many of its array elements
+// match.
+func (kp keypath) condition(op Op) string {
+	if !kp.hasWildcard() {
+		return kp.extract("data", kp[0]) + " " + op.String() + " " + operand(op)
+	}
+
+	var (
+		sources = make([]string, 0, len(kp)-1)
+		value   = "data"
+	)
+	for idx, part := range kp[:len(kp)-1] {
+		sources = append(sources, fmt.Sprintf(sqlWildcardSource, value, quoteLiteral(part), idx))
+		value = fmt.Sprintf("w%d.value", idx)
+	}
+
+	if last := kp[len(kp)-1]; last != "$" {
+		value = kp.extract(value, last)
+	}
+
+	return fmt.Sprintf(sqlWildcardCondition, strings.Join(sources, ", "), value, op, operand(op))
+}
+
+// Direction is the sort order of a keypath in Query.OrderBy.
+type Direction int
+
+const (
+	Asc Direction = iota
+	Desc
+)
+
+func (dir Direction) String() string {
+	switch dir {
+	case Asc:
+		return "ASC"
+	case Desc:
+		return "DESC"
+	default:
+		return ""
+	}
+}
+
+// Query is a composable query for Documents in a Collection that compiles to a
+// single SQL statement. Conditions are combined in the order they are added so
+// c.Where(a).And(b).Or(c) matches (a AND b) OR c.
+type Query struct {
+	collection *Collection
+	where      string
+	args       []any
+	orderBy    []string
+	limit      int
+	offset     int
+	err        error
+}
+
+// Where starts a Query matching Documents where the value at keypath compares
+// to val based on the Op used.
+func (c *Collection) Where(keypath string, op Op, val any) *Query {
+	return c.query().And(keypath, op, val)
+}
+
+// WhereID starts a Query matching Documents whose ID compares to val based on
+// the Op used.
+func (c *Collection) WhereID(op Op, val any) *Query {
+	q := c.query()
+	if op.String() == "" {
+		q.setErr(fmt.Errorf("%w: %d", ErrInvalidOp, op))
+		return q
+	}
+
+	return q.add("AND", "id "+op.String()+" "+operand(op), op, val)
+}
+
+// OrderBy starts a Query matching every Document in the Collection sorted by
+// the value at keypath.
+func (c *Collection) OrderBy(keypath string, dir Direction) *Query {
+	return c.query().OrderBy(keypath, dir)
+}
+
+func (c *Collection) query() *Query {
+	return &Query{
+		collection: c,
+		limit:      -1,
+	}
+}
+
+// And narrows the Query to Documents also matching the condition.
+func (q *Query) And(keypath string, op Op, val any) *Query {
+	return q.combine("AND", keypath, op, val)
+}
+
+// Or widens the Query to Documents matching either the conditions so far or
+// the condition.
+func (q *Query) Or(keypath string, op Op, val any) *Query {
+	return q.combine("OR", keypath, op, val)
+}
+
+func (q *Query) combine(logic string, path string, op Op, val any) *Query {
+	kp, err := parseKeypath(path)
+	if err != nil {
+		q.setErr(err)
+		return q
+	}
+	if op.String() == "" {
+		q.setErr(fmt.Errorf("%w: %d", ErrInvalidOp, op))
+		return q
+	}
+
+	return q.add(logic, kp.condition(op), op, val)
+}
+
+// add combines the compiled condition cond, which compares with val, with the
+// conditions so far.
+func (q *Query) add(logic string, cond string, op Op, val any) *Query {
+	if op == OpIn {
+		values, err := json.Marshal(val)
+		if err != nil {
+			q.setErr(fmt.Errorf("%w: %v", ErrInvalidOp, err))
+			return q
+		}
+		val = string(values)
+	}
+
+	if q.where == "" {
+		q.where = cond
+	} else {
+		q.where = "(" + q.where + ") " + logic + " (" + cond + ")"
+	}
+	q.args = append(q.args, bindValue(val))
+
+	return q
+}
+
+// OrderBy sorts the results by the value at keypath. Calling OrderBy more than
+// once sorts by each keypath in turn. Documents with equal values are always
+// sorted by ID last so results are stable between pages. The keypath can not
+// contain wildcards.
+func (q *Query) OrderBy(path string, dir Direction) *Query {
+	kp, err := parseKeypath(path)
+	if err != nil {
+		q.setErr(err)
+		return q
+	}
+	if kp.hasWildcard() {
+		q.setErr(fmt.Errorf("%w: can not order by wildcard %q", ErrInvalidKeypath, path))
+		return q
+	}
+	if dir.String() == "" {
+		q.setErr(fmt.Errorf("invalid direction: %d", dir))
+		return q
+	}
+
+	q.orderBy = append(q.orderBy, kp.extract("data", kp[0])+" "+dir.String())
+
+	return q
+}
+
+// Limit caps the number of Documents returned. A negative n removes the limit.
+func (q *Query) Limit(n int) *Query {
+	q.limit = n
+	return q
+}
+
+// Offset skips the first n Documents.
+func (q *Query) Offset(n int) *Query {
+	if n < 0 {
+		q.setErr(fmt.Errorf("invalid offset: %d", n))
+		return q
+	}
+
+	q.offset = n
+	return q
+}
+
+// setErr records the first error found while building so it can be returned
+// by Documents.
+func (q *Query) setErr(err error) {
+	if q.err == nil {
+		q.err = err
+	}
+}
+
+// build compiles the Query into a single statement and its arguments.
+func (q *Query) build() (string, []any, error) {
+	if q.err != nil {
+		return "", nil, q.err
+	}
+	if err := validateCollection(q.collection.ID); err != nil {
+		return "", nil, err
+	}
+
+	where := q.where
+	if where == "" {
+		where = "1"
+	}
+
+	orderBy := strings.Join(append(q.orderBy[:len(q.orderBy):len(q.orderBy)], "id"), ", ")
+
+	return fmt.Sprintf(sqlQueryBuilder, quoteIdent(q.collection.ID), where, orderBy, q.limit, q.offset), q.args, nil
+}
+
+// Documents runs the Query and returns the matching Documents.
+func (q *Query) Documents(ctx context.Context) ([]*Document, error) {
+	sql, args, err := q.build()
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := q.collection.q.QueryContext(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return q.collection.scan(r)
+}
@@ -0,0 +1,322 @@
+package db_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	docdb "github.com/limeleaf-coop/knbn/pkg/db"
+)
+
+type board struct {
+	Title     string
+	Owner     string
+	UpdatedAt int
+	Archived  bool
+}
+
+func seedBoards(t *testing.T, db *docdb.Database) {
+	t.Helper()
+
+	ctx := context.Background()
+	boards := []board{
+		{Title: "Ops", Owner: "blain", UpdatedAt: 30},
+		{Title: "CRM", Owner: "blain", UpdatedAt: 10},
+		{Title: "Hiring", Owner: "erik", UpdatedAt: 20},
+		{Title: "Old", Owner: "blain", UpdatedAt: 40, Archived: true},
+		{Title: "John's", Owner: "john", UpdatedAt: 50},
+	}
+
+	for idx, b := range boards {
+		if err := db.Collection("boards").Document(fmt.Sprintf("b%d", idx)).Create(ctx, &b); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func titles(t *testing.T, docs []*docdb.Document) []string {
+	t.Helper()
+
+	titles := make([]string, len(docs))
+	for idx, doc := range docs {
+		var b board
+		if err := doc.DataTo(&b); err != nil {
+			t.Fatal(err)
+		}
+		titles[idx] = b.Title
+	}
+
+	return titles
+}
+
+func TestQueryBuilder(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	seedBoards(t, db)
+
+	boards := db.Collection("boards")
+
+	tests := []struct {
+		name  string
+		query *docdb.Query
+		want  []string
+	}{
+		{
+			name:  "where and order by desc",
+			query: boards.Where("$.Owner", docdb.OpEqual, "blain").And("$.Archived", docdb.OpEqual, false).OrderBy("$.UpdatedAt", docdb.Desc),
+			want:  []string{"Ops", "CRM"},
+		},
+		{
+			name:  "or",
+			query: boards.Where("$.Owner", docdb.OpEqual, "erik").Or("$.Owner", docdb.OpEqual, "john").OrderBy("$.Title", docdb.Asc),
+			want:  []string{"Hiring", "John's"},
+		},
+		{
+			name:  "and then or",
+			query: boards.Where("$.Owner", docdb.OpEqual, "blain").And("$.UpdatedAt", docdb.OpGreaterThan, 20).Or("$.Title", docdb.OpEqual, "John's").OrderBy("$.UpdatedAt", docdb.Asc),
+			want:  []string{"Ops", "Old", "John's"},
+		},
+		{
+			name:  "limit and offset",
+			query: boards.OrderBy("$.UpdatedAt", docdb.Desc).Limit(2).Offset(1),
+			want:  []string{"Old", "Ops"},
+		},
+		{
+			name:  "offset without limit",
+			query: boards.OrderBy("$.UpdatedAt", docdb.Asc).Offset(3),
+			want:  []string{"Old", "John's"},
+		},
+		{
+			name:  "in",
+			query: boards.Where("$.Owner", docdb.OpIn, []string{"erik", "john"}).OrderBy("$.Title", docdb.Asc),
+			want:  []string{"Hiring", "John's"},
+		},
+		{
+			name:  "in nothing",
+			query: boards.Where("$.Owner", docdb.OpIn, []string{}),
+			want:  []string{},
+		},
+		{
+			name:  "where id",
+			query: boards.WhereID(docdb.OpIn, []string{"b1", "b2"}).And("$.UpdatedAt", docdb.OpGreaterThan, 15),
+			want:  []string{"Hiring"},
+		},
+		{
+			name:  "untrusted value",
+			query: boards.Where("$.Title", docdb.OpEqual, "' OR 1=1 --"),
+			want:  []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			docs, err := tt.query.Documents(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := titles(t, docs)
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueryBuilderInvalid(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	seedBoards(t, db)
+
+	boards := db.Collection("boards")
+
+	_, err := boards.Where("$.Owner", docdb.OpEqual, "blain").And("$.Owner) OR (1", docdb.OpEqual, "x").Documents(ctx)
+	if !errors.Is(err, docdb.ErrInvalidKeypath) {
+		t.Errorf("got %v, want ErrInvalidKeypath", err)
+	}
+
+	_, err = boards.OrderBy("$.Title; DROP TABLE boards", docdb.Asc).Documents(ctx)
+	if !errors.Is(err, docdb.ErrInvalidKeypath) {
+		t.Errorf("got %v, want ErrInvalidKeypath", err)
+	}
+
+	_, err = boards.Where("$.Owner", docdb.Op(-1), "blain").Documents(ctx)
+	if !errors.Is(err, docdb.ErrInvalidOp) {
+		t.Errorf("got %v, want ErrInvalidOp", err)
+	}
+}
+
+type kanban struct {
+	Title string
+	Lists []kanbanList
+}
+
+type kanbanList struct {
+	Title string
+	Cards []kanbanCard
+}
+
+type kanbanCard struct {
+	Title string
+	Tags  []string
+}
+
+func TestQueryKeypaths(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	kanbans := map[string]kanban{
+		"ops": {Title: "Ops", Lists: []kanbanList{
+			{Title: "Backlog", Cards: []kanbanCard{{Title: "Set up LLC", Tags: []string{"admin"}}, {Title: "Email", Tags: []string{"admin", "it"}}}},
+			{Title: "Done", Cards: []kanbanCard{{Title: "Email"}}},
+		}},
+		"crm": {Title: "CRM", Lists: []kanbanList{
+			{Title: "Leads", Cards: []kanbanCard{{Title: "ACME_Corp"}}},
+		}},
+		"xyz": {Title: "100%", Lists: []kanbanList{}},
+	}
+	for id, k := range kanbans {
+		if err := db.Collection("kanbans").Document(id).Create(ctx, &k); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		keypath string
+		val     any
+		want    []string
+	}{
+		{keypath: "$.Lists[*].Cards[*].Title", val: "Email", want: []string{"ops"}},
+		{keypath: "$.Lists[*].Cards[*].Tags[*]", val: "it", want: []string{"ops"}},
+		{keypath: "$.Lists[1].Cards[0].Title", val: "Email", want: []string{"ops"}},
+		{keypath: "$.Lists[0].Cards[0].Title", val: "Email", want: []string{}},
+		{keypath: "$.Lists[*].Cards[*].Title", val: "ACME%", want: []string{}},
+		{keypath: "$.Lists[*].Cards[*].Title", val: "ACME_Corp", want: []string{"crm"}},
+		{keypath: "$.Title", val: "100%", want: []string{"xyz"}},
+		{keypath: "$.Title", val: "1000", want: []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s=%v", tt.keypath, tt.val), func(t *testing.T) {
+			docs, err := db.Collection("kanbans").Query(ctx, tt.keypath, docdb.OpEqual, tt.val)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := make([]string, len(docs))
+			for idx, doc := range docs {
+				got[idx] = doc.ID
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	docs, err := db.Collection("kanbans").Query(ctx, "$.Lists[*].Cards[*].Tags[*]", docdb.OpIn, []string{"it", "hr"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 1 || docs[0].ID != "ops" {
+		t.Errorf("wildcard OpIn got %d documents, want ops", len(docs))
+	}
+
+	_, err = db.Collection("kanbans").OrderBy("$.Lists[*].Title", docdb.Asc).Documents(ctx)
+	if !errors.Is(err, docdb.ErrInvalidKeypath) {
+		t.Errorf("OrderBy wildcard: got %v, want ErrInvalidKeypath", err)
+	}
+}
+
+const benchmarkKanbans = 3000
+
+func seedKanbans(b *testing.B) string {
+	b.Helper()
+
+	ctx := context.Background()
+	path := filepath.Join(b.TempDir(), "bench.db")
+
+	db, err := docdb.Open(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+
+	err = db.RunInTx(ctx, func(tx *docdb.Tx) error {
+		for i := 0; i < benchmarkKanbans; i++ {
+			k := kanban{Title: fmt.Sprintf("Board %d", i)}
+			for l := 0; l < 4; l++ {
+				list := kanbanList{Title: fmt.Sprintf("List %d-%d", i, l)}
+				for c := 0; c < 8; c++ {
+					list.Cards = append(list.Cards, kanbanCard{Title: fmt.Sprintf("Card %d-%d-%d", i, l, c), Tags: []string{"a", "b"}})
+				}
+				k.Lists = append(k.Lists, list)
+			}
+
+			if err := tx.Collection("kanbans").Document(fmt.Sprint(i)).Create(ctx, &k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	return path
+}
+
+func BenchmarkQuery(b *testing.B) {
+	ctx := context.Background()
+	path := seedKanbans(b)
+
+	db, err := docdb.Open(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+
+	// The json_tree scan Query used before json_extract, kept for comparison.
+	legacy, err := sql.Open("sqlite", path)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer legacy.Close()
+
+	b.Run("json_extract", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			docs, err := db.Collection("kanbans").Query(ctx, "$.Title", docdb.OpEqual, "Board 1500")
+			if err != nil || len(docs) != 1 {
+				b.Fatal(err, len(docs))
+			}
+		}
+	})
+
+	b.Run("json_each", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			docs, err := db.Collection("kanbans").Query(ctx, "$.Lists[*].Cards[*].Title", docdb.OpEqual, "Card 1500-2-3")
+			if err != nil || len(docs) != 1 {
+				b.Fatal(err, len(docs))
+			}
+		}
+	})
+
+	b.Run("json_tree", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			r, err := legacy.QueryContext(ctx, `SELECT kanbans.id, kanbans.data FROM kanbans, json_tree(kanbans.data) WHERE (fullkey LIKE ? AND value = ?)`, "$.Lists[%].Cards[%].Title", "Card 1500-2-3")
+			if err != nil {
+				b.Fatal(err)
+			}
+			n := 0
+			for r.Next() {
+				n++
+			}
+			r.Close()
+			if n != 1 {
+				b.Fatal(n)
+			}
+		}
+	})
+}
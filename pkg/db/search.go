@@ -0,0 +1,360 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// Text values at a Collection's search keypaths are copied into _search_text
+// by triggers on every write and indexed by the _search FTS5 table, which uses
+// _search_text as it's external content. It can't be called _search_content
+// since FTS5 keeps it's own shadow tables under names like that.
+//
+// Only Collections with search keypaths have the triggers, and they match
+// keypaths in plain SQL so any SQLite client can write to a Collection. Each
+// keypath is stored with a GLOB pattern matching the json_tree fullkeys it
+// addresses, where wildcards match any index. A wildcard's "*" could match
+// across several levels of the Document, like "0].Cards[1", so the fullkey
+// must also have as many "[" as the keypath.
+const (
+	sqlCreateSearch = `CREATE TABLE IF NOT EXISTS _search_fields (collection TEXT NOT NULL, keypath TEXT NOT NULL, pattern TEXT NOT NULL DEFAULT '', PRIMARY KEY (collection, keypath));
+CREATE TABLE IF NOT EXISTS _search_text (rowid INTEGER PRIMARY KEY, collection TEXT NOT NULL, id TEXT NOT NULL, path TEXT NOT NULL, body TEXT NOT NULL);
+CREATE INDEX IF NOT EXISTS _search_text_document ON _search_text (collection, id);
+CREATE VIRTUAL TABLE IF NOT EXISTS _search USING fts5(body, content='_search_text', content_rowid='rowid', tokenize='porter unicode61');
+CREATE TRIGGER IF NOT EXISTS _search_text_insert AFTER INSERT ON _search_text BEGIN INSERT INTO _search (rowid, body) VALUES (NEW.rowid, NEW.body); END;
+CREATE TRIGGER IF NOT EXISTS _search_text_delete AFTER DELETE ON _search_text BEGIN INSERT INTO _search (_search, rowid, body) VALUES ('delete', OLD.rowid, OLD.body); END`
+	sqlCreateSearchTriggers = `CREATE TRIGGER IF NOT EXISTS %[2]s AFTER INSERT ON %[1]s BEGIN ` + sqlIndexNew + ` END;
+CREATE TRIGGER IF NOT EXISTS %[3]s AFTER UPDATE ON %[1]s BEGIN DELETE FROM _search_text WHERE (collection = %[5]s AND id = OLD.id); ` + sqlIndexNew + ` END;
+CREATE TRIGGER IF NOT EXISTS %[4]s AFTER DELETE ON %[1]s BEGIN DELETE FROM _search_text WHERE (collection = %[5]s AND id = OLD.id); END`
+	sqlIndexNew       = `INSERT INTO _search_text (collection, id, path, body) SELECT DISTINCT %[5]s, NEW.id, t.fullkey, t.atom FROM _search_fields AS f, json_tree(NEW.data) AS t WHERE (f.collection = %[5]s AND t.type = 'text' AND ` + sqlKeypathMatch + `);`
+	sqlKeypathMatch   = `t.fullkey GLOB f.pattern AND length(t.fullkey) - length(replace(t.fullkey, '[', '')) = length(f.keypath) - length(replace(f.keypath, '[', ''))`
+	sqlSearchFields   = `SELECT keypath FROM _search_fields WHERE (collection = ?) ORDER BY keypath`
+	sqlDeleteFields   = `DELETE FROM _search_fields WHERE (collection = ?)`
+	sqlInsertField    = `INSERT INTO _search_fields (collection, keypath, pattern) VALUES (?, ?, ?)`
+	sqlHasPattern     = `SELECT COUNT(*) FROM pragma_table_info('_search_fields') WHERE (name = 'pattern')`
+	sqlAddPattern     = `ALTER TABLE _search_fields ADD COLUMN pattern TEXT NOT NULL DEFAULT ''`
+	sqlAllFields      = `SELECT DISTINCT keypath FROM _search_fields`
+	sqlSetPattern     = `UPDATE _search_fields SET pattern = ? WHERE (keypath = ?)`
+	sqlDeleteContent  = `DELETE FROM _search_text WHERE (collection = ?)`
+	sqlReindexContent = `INSERT INTO _search_text (collection, id, path, body) SELECT DISTINCT %[2]s, c.id, t.fullkey, t.atom FROM %[1]s AS c, _search_fields AS f, json_tree(c.data) AS t WHERE (f.collection = %[2]s AND t.type = 'text' AND ` + sqlKeypathMatch + `)`
+	sqlSearch         = `SELECT c.id, c.path, snippet(_search, 0, char(2), char(3), '…', 12), bm25(_search), d.data FROM _search JOIN _search_text AS c ON (c.rowid = _search.rowid) JOIN %[1]s AS d ON (d.id = c.id) WHERE (_search MATCH ? AND c.collection = ? AND d.id IN (SELECT id FROM %[1]s WHERE %[2]s)) ORDER BY bm25(_search) LIMIT ?`
+
+	// searchLimit is the most results returned by a search.
+	searchLimit = 50
+)
+
+// keypathPattern returns the GLOB pattern matching the json_tree fullkeys
+// addressed by keypath, so "$.Lists[*].Title" becomes "$.Lists[[]*].Title".
+// Keypaths only hold names, indexes and wildcards, so "[" is the only
+// character that needs escaping.
+func keypathPattern(keypath string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(keypath, "[", "[[]"), "[[]*]", "[[][0-9]*]")
+}
+
+// SnippetPart is part of the text around a search match.
+type SnippetPart struct {
+	Text  string
+	Match bool
+}
+
+// SearchResult is a text value within a Document matching a search.
+type SearchResult struct {
+	// ID is the ID of the matching Document.
+	ID string
+
+	// Keypath addresses the matching value within the Document, such as
+	// "$.Lists[2].Cards[0].Title".
+	Keypath string
+
+	// Snippet is the matching value, shortened around the matching terms.
+	Snippet []SnippetPart
+
+	// Rank orders results from best to worst match. Lower is better.
+	Rank float64
+
+	data []byte
+}
+
+// DataTo unmarshals the matching Document's JSON data into the doc type.
+func (r SearchResult) DataTo(doc any) error {
+	if r.data == nil {
+		return errors.New("no data")
+	}
+
+	return json.Unmarshal(r.data, &doc)
+}
+
+// createSearchTriggers creates the triggers that keep the search index up to
+// date with the Collection.
+func (c *Collection) createSearchTriggers(ctx context.Context) error {
+	args := append(append([]any{quoteIdent(c.ID)}, c.searchTriggers()...), quoteLiteral(c.ID))
+	_, err := c.q.ExecContext(ctx, fmt.Sprintf(sqlCreateSearchTriggers, args...))
+
+	return err
+}
+
+// dropSearchTriggers drops the triggers that keep the search index up to date
+// with the Collection.
+func (c *Collection) dropSearchTriggers(ctx context.Context) error {
+	_, err := c.q.ExecContext(ctx, fmt.Sprintf(sqlDropTriggers, c.searchTriggers()...))
+
+	return err
+}
+
+// searchTriggers returns the names of the triggers that keep the search index
+// up to date with the Collection.
+func (c *Collection) searchTriggers() []any {
+	return []any{
+		quoteIdent("_search_" + c.ID + "_insert"),
+		quoteIdent("_search_" + c.ID + "_update"),
+		quoteIdent("_search_" + c.ID + "_delete"),
+	}
+}
+
+// migrateSearch gives search keypaths stored before they had patterns their
+// pattern, then recreates the search triggers of the Collections with search
+// keypaths and drops them from the rest, since older triggers were created
+// on every Collection and called a function only this package registers.
+func (db *Database) migrateSearch(ctx context.Context, collections []string) error {
+	var n int
+	if err := db.sqlite.QueryRowContext(ctx, sqlHasPattern).Scan(&n); err != nil {
+		return err
+	}
+	if n == 0 {
+		if _, err := db.sqlite.ExecContext(ctx, sqlAddPattern); err != nil {
+			return err
+		}
+	}
+
+	r, err := db.sqlite.QueryContext(ctx, sqlAllFields)
+	if err != nil {
+		return err
+	}
+
+	keypaths := make([]string, 0)
+	for r.Next() {
+		var keypath string
+		if err := r.Scan(&keypath); err != nil {
+			r.Close()
+			return err
+		}
+		keypaths = append(keypaths, keypath)
+	}
+	r.Close()
+
+	if err := r.Err(); err != nil {
+		return err
+	}
+
+	for _, keypath := range keypaths {
+		if _, err := db.sqlite.ExecContext(ctx, sqlSetPattern, keypathPattern(keypath), keypath); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range collections {
+		if validateCollection(name) != nil {
+			continue
+		}
+
+		c := db.Collection(name)
+		if err := c.dropSearchTriggers(ctx); err != nil {
+			return err
+		}
+
+		fields, err := c.searchFields(ctx)
+		if err != nil {
+			return err
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		if err := c.createSearchTriggers(ctx); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// EnsureSearchIndex makes the text values at keypaths searchable with Search,
+// replacing any keypaths given before. Keypaths may contain wildcards such as
+// "$.Lists[*].Cards[*].Title". Existing Documents are indexed again only if
+// the keypaths changed. Passing no keypaths stops indexing the Collection.
+func (c *Collection) EnsureSearchIndex(ctx context.Context, keypaths ...string) error {
+	for _, keypath := range keypaths {
+		if _, err := parseKeypath(keypath); err != nil {
+			return err
+		}
+	}
+
+	if err := c.create(ctx); err != nil {
+		return err
+	}
+
+	existing, err := c.searchFields(ctx)
+	if err != nil {
+		return err
+	}
+
+	want := append([]string(nil), keypaths...)
+	slices.Sort(want)
+	if strings.Join(existing, "\n") == strings.Join(want, "\n") {
+		return nil
+	}
+
+	if _, err := c.q.ExecContext(ctx, sqlDeleteFields, c.ID); err != nil {
+		return err
+	}
+	for _, keypath := range want {
+		if _, err := c.q.ExecContext(ctx, sqlInsertField, c.ID, keypath, keypathPattern(keypath)); err != nil {
+			return wrapErr(err)
+		}
+	}
+
+	if _, err := c.q.ExecContext(ctx, sqlDeleteContent, c.ID); err != nil {
+		return err
+	}
+
+	if len(want) == 0 {
+		return c.dropSearchTriggers(ctx)
+	}
+	if err := c.createSearchTriggers(ctx); err != nil {
+		return err
+	}
+	_, err = c.q.ExecContext(ctx, fmt.Sprintf(sqlReindexContent, quoteIdent(c.ID), quoteLiteral(c.ID)))
+
+	return err
+}
+
+func (c *Collection) searchFields(ctx context.Context) ([]string, error) {
+	r, err := c.q.QueryContext(ctx, sqlSearchFields, c.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	keypaths := make([]string, 0)
+	for r.Next() {
+		var keypath string
+		if err := r.Scan(&keypath); err != nil {
+			return nil, err
+		}
+		keypaths = append(keypaths, keypath)
+	}
+
+	return keypaths, r.Err()
+}
+
+// Search returns the text values within the Collection's Documents that match
+// every word in query, best matches first. The last word also matches as a
+// prefix so results can be shown while typing.
+func (c *Collection) Search(ctx context.Context, query string) ([]SearchResult, error) {
+	return c.search(ctx, query, "1", nil)
+}
+
+// Search returns the text values within the Document that match every word in
+// query like Collection.Search.
+func (d *Document) Search(ctx context.Context, query string) ([]SearchResult, error) {
+	return d.collection.search(ctx, query, "id = ?", []any{d.ID})
+}
+
+// Search returns the text values within the Documents matching the Query that
+// match every word in query like Collection.Search. The Query's conditions are
+// applied before the results are limited, but it's order, limit and offset are
+// ignored.
+func (q *Query) Search(ctx context.Context, query string) ([]SearchResult, error) {
+	if q.err != nil {
+		return nil, q.err
+	}
+
+	where := q.where
+	if where == "" {
+		where = "1"
+	}
+
+	return q.collection.search(ctx, query, where, q.args)
+}
+
+// search finds matches within the Documents matching the condition where,
+// which is given args.
+func (c *Collection) search(ctx context.Context, query string, where string, args []any) ([]SearchResult, error) {
+	if err := validateCollection(c.ID); err != nil {
+		return nil, err
+	}
+
+	match := matchExpression(query)
+	if match == "" {
+		return []SearchResult{}, nil
+	}
+
+	args = append(append([]any{match, c.ID}, args...), searchLimit)
+	r, err := c.q.QueryContext(ctx, fmt.Sprintf(sqlSearch, quoteIdent(c.ID), where), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	results := make([]SearchResult, 0)
+	for r.Next() {
+		var result SearchResult
+		var snippet string
+		if err := r.Scan(&result.ID, &result.Keypath, &snippet, &result.Rank, &result.data); err != nil {
+			return nil, err
+		}
+		result.Snippet = parseSnippet(snippet)
+
+		results = append(results, result)
+	}
+
+	return results, r.Err()
+}
+
+// matchExpression turns free text into an FTS5 query matching every word, so
+// user input can't use, or break on, FTS5 query syntax.
+func matchExpression(query string) string {
+	words := strings.FieldsFunc(query, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	if len(words) == 0 {
+		return ""
+	}
+
+	for idx, word := range words {
+		words[idx] = `"` + word + `"`
+	}
+	words[len(words)-1] += "*"
+
+	return strings.Join(words, " ")
+}
+
+// parseSnippet splits a snippet on the markers placed around each match.
+func parseSnippet(snippet string) []SnippetPart {
+	parts := make([]SnippetPart, 0)
+
+	for snippet != "" {
+		start := strings.IndexByte(snippet, '\x02')
+		if start < 0 {
+			parts = append(parts, SnippetPart{Text: snippet})
+			break
+		}
+		if start > 0 {
+			parts = append(parts, SnippetPart{Text: snippet[:start]})
+		}
+		snippet = snippet[start+1:]
+
+		end := strings.IndexByte(snippet, '\x03')
+		if end < 0 {
+			end = len(snippet)
+		}
+		parts = append(parts, SnippetPart{Text: snippet[:end], Match: true})
+		snippet = strings.TrimPrefix(snippet[end:], "\x03")
+	}
+
+	return parts
+}
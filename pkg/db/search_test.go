@@ -0,0 +1,250 @@
+package db_test
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	docdb "github.com/limeleaf-coop/knbn/pkg/db"
+)
+
+func snippetText(parts []docdb.SnippetPart) string {
+	text := ""
+	for _, part := range parts {
+		if part.Match {
+			text += "[" + part.Text + "]"
+		} else {
+			text += part.Text
+		}
+	}
+
+	return text
+}
+
+func TestCollectionSearch(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	kanbans := db.Collection("kanbans")
+
+	ops := kanban{Title: "Ops", Lists: []kanbanList{
+		{Title: "Backlog", Cards: []kanbanCard{{Title: "Set up LLC"}, {Title: "Decide on email provider"}}},
+		{Title: "Emailing", Cards: []kanbanCard{}},
+	}}
+	if err := kanbans.Document("ops").Create(ctx, &ops); err != nil {
+		t.Fatal(err)
+	}
+
+	// Documents written before the index exists are indexed when it's made.
+	if err := kanbans.EnsureSearchIndex(ctx, "$.Lists[*].Title", "$.Lists[*].Cards[*].Title"); err != nil {
+		t.Fatal(err)
+	}
+
+	crm := kanban{Title: "CRM", Lists: []kanbanList{
+		{Title: "Leads", Cards: []kanbanCard{{Title: "Email ACME about the renewal"}}},
+	}}
+	if err := kanbans.Document("crm").Create(ctx, &crm); err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := kanbans.Search(ctx, "email")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[string]string{}
+	for _, result := range results {
+		got[result.ID+" "+result.Keypath] = snippetText(result.Snippet)
+	}
+	want := map[string]string{
+		"ops $.Lists[0].Cards[1].Title": "Decide on [email] provider",
+		"ops $.Lists[1].Title":          "[Emailing]",
+		"crm $.Lists[0].Cards[0].Title": "[Email] ACME about the renewal",
+	}
+	if len(got) != len(want) {
+		t.Errorf("got %d results, want %d: %v", len(got), len(want), got)
+	}
+	for key, snippet := range want {
+		if got[key] != snippet {
+			t.Errorf("%s: got %q, want %q", key, got[key], snippet)
+		}
+	}
+
+	// The index follows updates, patches, and deletes.
+	ops.Lists[0].Cards[1].Title = "Decide on Fastmail"
+	if err := kanbans.Document("ops").Set(ctx, &ops); err != nil {
+		t.Fatal(err)
+	}
+	if err := kanbans.Document("crm").Patch(ctx, docdb.JSONPatch{{Op: "replace", Path: "/Lists/0/Title", Value: "Email leads"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	results, err = kanbans.Document("crm").Search(ctx, "lead email")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Keypath != "$.Lists[0].Title" {
+		t.Errorf("Document.Search got %+v, want crm's first list", results)
+	}
+
+	// Query.Search only searches the Documents matching the Query, and every
+	// result carries it's Document's data.
+	results, err = kanbans.Where("$.Title", docdb.OpEqual, "CRM").Search(ctx, "email")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Errorf("Query.Search got %+v, want crm's list and card", results)
+	}
+	for _, result := range results {
+		var doc kanban
+		if err := result.DataTo(&doc); err != nil {
+			t.Fatal(err)
+		}
+		if result.ID != "crm" || doc.Title != "CRM" {
+			t.Errorf("Query.Search got %s with title %q, want crm", result.ID, doc.Title)
+		}
+	}
+
+	if err := kanbans.Document("crm").Delete(ctx); err != nil {
+		t.Fatal(err)
+	}
+	results, err = kanbans.Search(ctx, "email")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Keypath != "$.Lists[1].Title" {
+		t.Errorf("Search after delete got %+v, want only ops' Emailing list", results)
+	}
+
+	// Board titles aren't indexed and search syntax is treated as text.
+	for _, query := range []string{"Ops", `" OR NEAR(`, "", "-email"} {
+		results, err := kanbans.Search(ctx, query)
+		if err != nil {
+			t.Errorf("Search(%q): %v", query, err)
+		}
+		if query == "Ops" && len(results) != 0 {
+			t.Errorf("Search(%q) got %d results, want 0", query, len(results))
+		}
+	}
+
+	// Prefixes of the last word match while typing.
+	results, err = kanbans.Search(ctx, "fast")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || snippetText(results[0].Snippet) != "Decide on [Fastmail]" {
+		t.Errorf("prefix Search got %+v", results)
+	}
+}
+
+func TestSearchWildcardDepth(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	kanbans := db.Collection("kanbans")
+	if err := kanbans.EnsureSearchIndex(ctx, "$.Lists[*].Title"); err != nil {
+		t.Fatal(err)
+	}
+
+	ops := kanban{Title: "Ops", Lists: []kanbanList{
+		{Title: "Backlog", Cards: []kanbanCard{{Title: "Email ACME"}}},
+		{Title: "Emailing"},
+	}}
+	if err := kanbans.Document("ops").Create(ctx, &ops); err != nil {
+		t.Fatal(err)
+	}
+
+	// "$.Lists[*].Title" doesn't reach into "$.Lists[0].Cards[0].Title".
+	results, err := kanbans.Search(ctx, "email")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Keypath != "$.Lists[1].Title" {
+		t.Errorf("Search got %+v, want only the Emailing list", results)
+	}
+}
+
+func TestSearchPlainSQL(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "test.db")
+
+	// Search triggers used to be created on every Collection and call
+	// keypath_match, which other SQLite clients don't have.
+	legacy, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = legacy.Exec(`CREATE TABLE _search_fields (collection TEXT NOT NULL, keypath TEXT NOT NULL, PRIMARY KEY (collection, keypath));
+INSERT INTO _search_fields (collection, keypath) VALUES ('kanbans', '$.Lists[*].Title');
+CREATE TABLE kanbans (id TEXT PRIMARY KEY, data JSON);
+CREATE TABLE notes (id TEXT PRIMARY KEY, data JSON);
+CREATE TRIGGER _search_kanbans_insert AFTER INSERT ON kanbans BEGIN SELECT keypath_match('$', NEW.id); END;
+CREATE TRIGGER _search_notes_insert AFTER INSERT ON notes BEGIN SELECT keypath_match('$', NEW.id); END`)
+	legacy.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := docdb.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Only Collections with search keypaths keep search triggers.
+	other, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	var triggers []string
+	r, err := other.Query(`SELECT name FROM sqlite_master WHERE (type = 'trigger' AND name LIKE '\_search\_%' ESCAPE '\' AND tbl_name != '_search_text') ORDER BY name`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for r.Next() {
+		var name string
+		if err := r.Scan(&name); err != nil {
+			t.Fatal(err)
+		}
+		triggers = append(triggers, name)
+	}
+	r.Close()
+	want := []string{"_search_kanbans_delete", "_search_kanbans_insert", "_search_kanbans_update"}
+	if len(triggers) != len(want) {
+		t.Fatalf("got search triggers %v, want %v", triggers, want)
+	}
+	for idx := range want {
+		if triggers[idx] != want[idx] {
+			t.Errorf("got search triggers %v, want %v", triggers, want)
+		}
+	}
+
+	// Writes from plain SQL are indexed.
+	if _, err := other.Exec(`INSERT INTO notes (id, data) VALUES ('a', '{"Title":"Email"}')`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Exec(`INSERT INTO kanbans (id, data) VALUES ('ops', '{"Title":"Ops","Lists":[{"Title":"Emailing"}]}')`); err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := db.Collection("kanbans").Search(ctx, "email")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Keypath != "$.Lists[0].Title" {
+		t.Errorf("Search got %+v, want ops' Emailing list", results)
+	}
+
+	// Removing every keypath removes the triggers too.
+	if err := db.Collection("kanbans").EnsureSearchIndex(ctx); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	if err := other.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE (type = 'trigger' AND name LIKE '\_search\_kanbans%' ESCAPE '\')`).Scan(&n); err != nil || n != 0 {
+		t.Errorf("got %d search triggers, %v, want 0", n, err)
+	}
+}
@@ -0,0 +1,101 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+const (
+	// txRetries is how many times RunInTx retries a transaction that failed
+	// because the database was busy.
+	txRetries = 5
+
+	// txRetryDelay is the delay before the first retry and is doubled for
+	// every retry after that.
+	txRetryDelay = 10 * time.Millisecond
+)
+
+// Tx is a SQLite transaction. Collections and Documents referenced through a Tx
+// read and write within the transaction.
+type Tx struct {
+	database *Database
+	sqlite   *sql.Tx
+}
+
+// Collection returns a reference to a database collection bound to the
+// transaction.
+func (tx *Tx) Collection(id string) *Collection {
+	return &Collection{
+		database: tx.database,
+		q:        tx.sqlite,
+		ID:       id,
+	}
+}
+
+// RunInTx calls fn within a transaction. The transaction is committed if fn
+// returns nil and rolled back if fn returns an error or panics. If the database
+// is busy the whole transaction is retried, so fn may be called more than once
+// and should not have side effects outside of the transaction.
+func (db *Database) RunInTx(ctx context.Context, fn func(tx *Tx) error) error {
+	delay := txRetryDelay
+
+	for attempt := 0; ; attempt++ {
+		err := db.runInTx(ctx, fn)
+		if err == nil || !isBusy(err) || attempt >= txRetries {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+
+		delay *= 2
+	}
+}
+
+func (db *Database) runInTx(ctx context.Context, fn func(tx *Tx) error) (err error) {
+	sqltx, err := db.sqlite.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			sqltx.Rollback()
+			panic(p)
+		}
+	}()
+
+	if err := fn(&Tx{database: db, sqlite: sqltx}); err != nil {
+		if rbErr := sqltx.Rollback(); rbErr != nil {
+			return errors.Join(err, rbErr)
+		}
+		return err
+	}
+
+	if err := sqltx.Commit(); err != nil {
+		return err
+	}
+
+	db.notify()
+
+	return nil
+}
+
+// isBusy reports whether err was caused by the database being locked by
+// another connection.
+func isBusy(err error) bool {
+	var sqliteErr *sqlite.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+
+	return sqliteErr.Code()&0xff == sqlite3.SQLITE_BUSY
+}
@@ -0,0 +1,139 @@
+package db_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	docdb "github.com/limeleaf-coop/knbn/pkg/db"
+)
+
+type counter struct {
+	Count int
+}
+
+func TestRunInTxCommit(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	if err := db.Collection("test").Document("from").Create(ctx, &doc{Name: "from", Age: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	err := db.RunInTx(ctx, func(tx *docdb.Tx) error {
+		var d doc
+		if err := tx.Collection("test").Document("from").Get(ctx, &d); err != nil {
+			return err
+		}
+
+		if err := tx.Collection("test").Document("to").Create(ctx, &d); err != nil {
+			return err
+		}
+
+		docs, err := tx.Collection("test").Query(ctx, "$.Name", docdb.OpEqual, "from")
+		if err != nil {
+			return err
+		}
+		if len(docs) != 2 {
+			t.Errorf("Query within tx returned %d docs, want 2", len(docs))
+		}
+
+		return tx.Collection("test").Document("from").Delete(ctx)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	docs, err := db.Collection("test").QueryAll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 1 || docs[0].ID != "to" {
+		t.Errorf("QueryAll after commit returned %d docs, want only \"to\"", len(docs))
+	}
+}
+
+func TestRunInTxRollback(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	if err := db.Collection("test").Document("a").Create(ctx, &doc{Name: "before"}); err != nil {
+		t.Fatal(err)
+	}
+
+	errBoom := errors.New("boom")
+	err := db.RunInTx(ctx, func(tx *docdb.Tx) error {
+		if err := tx.Collection("test").Document("a").Set(ctx, &doc{Name: "after"}); err != nil {
+			return err
+		}
+		return errBoom
+	})
+	if !errors.Is(err, errBoom) {
+		t.Errorf("RunInTx returned %v, want %v", err, errBoom)
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("RunInTx did not re-panic")
+			}
+		}()
+
+		db.RunInTx(ctx, func(tx *docdb.Tx) error {
+			if err := tx.Collection("test").Document("a").Set(ctx, &doc{Name: "after"}); err != nil {
+				return err
+			}
+			panic("boom")
+		})
+	}()
+
+	var d doc
+	if err := db.Collection("test").Document("a").Get(ctx, &d); err != nil {
+		t.Fatal(err)
+	}
+	if d.Name != "before" {
+		t.Errorf(".Name = %q after rollback, want %q", d.Name, "before")
+	}
+}
+
+func TestRunInTxConcurrent(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	if err := db.Collection("counters").Document("c").Create(ctx, &counter{}); err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 20
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			err := db.RunInTx(ctx, func(tx *docdb.Tx) error {
+				var c counter
+				doc := tx.Collection("counters").Document("c")
+				if err := doc.Get(ctx, &c); err != nil {
+					return err
+				}
+				c.Count++
+				return doc.Set(ctx, &c)
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	var c counter
+	if err := db.Collection("counters").Document("c").Get(ctx, &c); err != nil {
+		t.Fatal(err)
+	}
+	if c.Count != n {
+		t.Errorf(".Count = %d, want %d", c.Count, n)
+	}
+}
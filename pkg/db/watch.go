@@ -0,0 +1,263 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// Every Collection has triggers that record each write to the _changes table
+// in the same transaction as the write, so the change log can't miss a write
+// no matter which statement or connection made it. Only the ID and revision
+// of the Document are recorded, never it's data, so the change log doesn't
+// keep copies of anything deleted or overwritten, like queued email. Reading
+// changes joins the Documents as they are now to fill in their data.
+const (
+	sqlCreateChanges = `CREATE TABLE IF NOT EXISTS _changes (seq INTEGER PRIMARY KEY AUTOINCREMENT, collection TEXT NOT NULL, id TEXT NOT NULL, kind TEXT NOT NULL, rev INTEGER NOT NULL);
+CREATE INDEX IF NOT EXISTS _changes_collection ON _changes (collection, seq);
+CREATE INDEX IF NOT EXISTS _changes_document ON _changes (collection, id, seq)`
+	sqlCreateTriggers = `CREATE TRIGGER IF NOT EXISTS %[2]s AFTER INSERT ON %[1]s BEGIN INSERT INTO _changes (collection, id, kind, rev) VALUES (%[5]s, NEW.id, 'created', NEW.rev); END;
+CREATE TRIGGER IF NOT EXISTS %[3]s AFTER UPDATE ON %[1]s BEGIN INSERT INTO _changes (collection, id, kind, rev) VALUES (%[5]s, NEW.id, 'updated', NEW.rev); END;
+CREATE TRIGGER IF NOT EXISTS %[4]s AFTER DELETE ON %[1]s BEGIN INSERT INTO _changes (collection, id, kind, rev) VALUES (%[5]s, OLD.id, 'deleted', OLD.rev); END`
+	sqlDropTriggers    = `DROP TRIGGER IF EXISTS %[1]s; DROP TRIGGER IF EXISTS %[2]s; DROP TRIGGER IF EXISTS %[3]s`
+	sqlHasChangesData  = `SELECT COUNT(*) FROM pragma_table_info('_changes') WHERE (name = 'data')`
+	sqlDropChangesData = `ALTER TABLE _changes DROP COLUMN data`
+	sqlLastSeq         = `SELECT COALESCE(MAX(seq), 0) FROM _changes`
+	sqlChangesFrom     = `SELECT c.seq, c.id, c.kind, c.rev, d.data FROM _changes AS c LEFT JOIN %s AS d ON (c.kind != 'deleted' AND d.id = c.id) WHERE (c.collection = ? AND (? = '' OR c.id = ?) AND c.seq > ?) ORDER BY c.seq LIMIT ?`
+	sqlPruneChanges    = `DELETE FROM _changes WHERE (seq <= (SELECT MAX(seq) FROM _changes) - ?)`
+
+	// watchBatch is how many changes a watcher reads at a time.
+	watchBatch = 100
+
+	// watchPoll is how often a watcher checks for changes written by other
+	// processes, which it isn't notified about.
+	watchPoll = time.Second
+)
+
+// ChangeKind is the kind of write that made a Change.
+type ChangeKind string
+
+const (
+	ChangeCreated ChangeKind = "created"
+	ChangeUpdated ChangeKind = "updated"
+	ChangeDeleted ChangeKind = "deleted"
+)
+
+// Change is a single write to a Document.
+type Change struct {
+	// Seq orders every Change in the Database. Pass the Seq of the last
+	// Change handled to WatchSince to resume watching after it.
+	Seq        int64
+	Kind       ChangeKind
+	Collection string
+	ID         string
+	Revision   int64
+	data       []byte
+}
+
+// DataTo unmarshals the Document's JSON data into the doc type. The data is
+// read along with the Change, so it is from a later revision if the Document
+// has been written to since. Deleted Documents have no data.
+func (c Change) DataTo(doc any) error {
+	if c.data == nil {
+		return errors.New("no data")
+	}
+
+	return json.Unmarshal(c.data, &doc)
+}
+
+// createTriggers creates the triggers that record changes to the Collection.
+func (c *Collection) createTriggers(ctx context.Context) error {
+	args := append(append([]any{quoteIdent(c.ID)}, c.changeTriggers()...), quoteLiteral(c.ID))
+	_, err := c.q.ExecContext(ctx, fmt.Sprintf(sqlCreateTriggers, args...))
+
+	return err
+}
+
+// changeTriggers returns the names of the triggers that record changes to the
+// Collection.
+func (c *Collection) changeTriggers() []any {
+	return []any{
+		quoteIdent("_changes_" + c.ID + "_insert"),
+		quoteIdent("_changes_" + c.ID + "_update"),
+		quoteIdent("_changes_" + c.ID + "_delete"),
+	}
+}
+
+// dropChangesData removes the data column from change logs made when changes
+// recorded each Document's data, along with the triggers that wrote to it so
+// they are created again without it.
+func (db *Database) dropChangesData(ctx context.Context, collections []string) error {
+	var n int
+	if err := db.sqlite.QueryRowContext(ctx, sqlHasChangesData).Scan(&n); err != nil || n == 0 {
+		return err
+	}
+
+	for _, name := range collections {
+		if validateCollection(name) != nil {
+			continue
+		}
+
+		if _, err := db.sqlite.ExecContext(ctx, fmt.Sprintf(sqlDropTriggers, db.Collection(name).changeTriggers()...)); err != nil {
+			return err
+		}
+	}
+
+	_, err := db.sqlite.ExecContext(ctx, sqlDropChangesData)
+
+	return err
+}
+
+// PruneChanges deletes all but the latest keep Changes so the change log
+// doesn't grow forever. Watchers that are behind skip the deleted Changes, so
+// keep should cover however far behind they can fall.
+func (db *Database) PruneChanges(ctx context.Context, keep int64) error {
+	_, err := db.sqlite.ExecContext(ctx, sqlPruneChanges, keep)
+
+	return err
+}
+
+// changed returns a channel that is closed on the next call to notify.
+func (db *Database) changed() <-chan struct{} {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.notifyCh
+}
+
+// notify wakes every watcher after a write is committed.
+func (db *Database) notify() {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	close(db.notifyCh)
+	db.notifyCh = make(chan struct{})
+}
+
+// notify wakes every watcher after a write unless the Collection is bound to a
+// transaction, in which case RunInTx notifies after it commits.
+func (c *Collection) notify() {
+	if c.q == c.database.sqlite {
+		c.database.notify()
+	}
+}
+
+// LastSeq returns the sequence number of the latest Change to any Document, or
+// 0 if nothing has been written yet. Watching since it sees every Change made
+// after LastSeq is called.
+func (db *Database) LastSeq(ctx context.Context) (int64, error) {
+	var seq int64
+	err := db.sqlite.QueryRowContext(ctx, sqlLastSeq).Scan(&seq)
+
+	return seq, err
+}
+
+// Watch returns a channel of every Change to Documents in the Collection made
+// after Watch is called. The channel is closed when ctx is done.
+func (c *Collection) Watch(ctx context.Context) (<-chan Change, error) {
+	return c.watch(ctx, "", -1)
+}
+
+// WatchSince returns a channel of every Change to Documents in the Collection
+// after the Change with sequence number seq, including ones made before
+// WatchSince is called. The channel is closed when ctx is done.
+func (c *Collection) WatchSince(ctx context.Context, seq int64) (<-chan Change, error) {
+	return c.watch(ctx, "", seq)
+}
+
+// Watch returns a channel of every Change to the Document made after Watch is
+// called. The channel is closed when ctx is done.
+func (d *Document) Watch(ctx context.Context) (<-chan Change, error) {
+	return d.collection.watch(ctx, d.ID, -1)
+}
+
+// WatchSince returns a channel of every Change to the Document after the Change
+// with sequence number seq, including ones made before WatchSince is called.
+// The channel is closed when ctx is done.
+func (d *Document) WatchSince(ctx context.Context, seq int64) (<-chan Change, error) {
+	return d.collection.watch(ctx, d.ID, seq)
+}
+
+// watch streams changes to the Collection, or only to the Document id if it is
+// not empty, after seq. A negative seq starts after the latest change.
+func (c *Collection) watch(ctx context.Context, id string, seq int64) (<-chan Change, error) {
+	// The Collection's table is joined when reading changes, so it has to
+	// exist even if nothing has been written to it yet.
+	if err := c.create(ctx); err != nil {
+		return nil, err
+	}
+
+	if seq < 0 {
+		if err := c.q.QueryRowContext(ctx, sqlLastSeq).Scan(&seq); err != nil {
+			return nil, err
+		}
+	}
+
+	ch := make(chan Change)
+
+	go func() {
+		defer close(ch)
+
+		for {
+			// Grab the notification channel before reading so a write
+			// between reading and waiting still wakes this watcher.
+			wait := c.database.changed()
+
+			changes, err := c.changesFrom(ctx, id, seq)
+			if err != nil && ctx.Err() == nil {
+				slog.Error("error reading changes", "collection", c.ID, "id", id, "error", err)
+			}
+
+			for _, change := range changes {
+				select {
+				case ch <- change:
+					seq = change.Seq
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			if len(changes) == watchBatch {
+				continue
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-wait:
+			case <-time.After(watchPoll):
+			}
+		}
+	}()
+
+	return ch, nil
+}
+
+func (c *Collection) changesFrom(ctx context.Context, id string, seq int64) ([]Change, error) {
+	r, err := c.q.QueryContext(ctx, fmt.Sprintf(sqlChangesFrom, quoteIdent(c.ID)), c.ID, id, id, seq, watchBatch)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	changes := make([]Change, 0)
+	for r.Next() {
+		change := Change{Collection: c.ID}
+
+		var data sql.RawBytes
+		if err := r.Scan(&change.Seq, &change.ID, &change.Kind, &change.Revision, &data); err != nil {
+			return nil, err
+		}
+		if data != nil {
+			change.data = append([]byte(nil), data...)
+		}
+
+		changes = append(changes, change)
+	}
+
+	return changes, r.Err()
+}
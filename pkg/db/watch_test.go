@@ -0,0 +1,245 @@
+package db_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	docdb "github.com/limeleaf-coop/knbn/pkg/db"
+)
+
+func nextChange(t *testing.T, changes <-chan docdb.Change) docdb.Change {
+	t.Helper()
+
+	select {
+	case change, ok := <-changes:
+		if !ok {
+			t.Fatal("changes closed")
+		}
+		return change
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for change")
+	}
+
+	return docdb.Change{}
+}
+
+func TestCollectionWatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db := openTestDB(t)
+
+	if err := db.Collection("test").Document("before").Create(ctx, &doc{Name: "before"}); err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := db.Collection("test").Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	docChanges, err := db.Collection("test").Document("a").Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := db.Collection("test").Document("a")
+	if err := a.Create(ctx, &doc{Name: "one"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Collection("test").Document("b").Create(ctx, &doc{Name: "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Set(ctx, &doc{Name: "two"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Patch(ctx, docdb.MergePatch(`{"Name":"three"}`)); err != nil {
+		t.Fatal(err)
+	}
+	err = db.RunInTx(ctx, func(tx *docdb.Tx) error {
+		return tx.Collection("test").Document("a").Delete(ctx)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		id   string
+		kind docdb.ChangeKind
+		rev  int64
+		name string
+	}{
+		{"a", docdb.ChangeCreated, 1, ""},
+		{"b", docdb.ChangeCreated, 1, "b"},
+		{"a", docdb.ChangeUpdated, 2, ""},
+		{"a", docdb.ChangeUpdated, 3, ""},
+		{"a", docdb.ChangeDeleted, 3, ""},
+	}
+
+	var last int64
+	for _, w := range want {
+		change := nextChange(t, changes)
+		if change.ID != w.id || change.Kind != w.kind || change.Revision != w.rev {
+			t.Errorf("got %s %s at %d, want %s %s at %d", change.Kind, change.ID, change.Revision, w.kind, w.id, w.rev)
+		}
+		if change.Seq <= last {
+			t.Errorf("Seq %d is not after %d", change.Seq, last)
+		}
+		last = change.Seq
+
+		// Changes carry the Document's data as it is when they're read,
+		// which for "a" depends on how far the watcher has got.
+		var d doc
+		if w.kind == docdb.ChangeDeleted {
+			if change.DataTo(&d) == nil {
+				t.Error("deleted change has data")
+			}
+		} else if w.name != "" {
+			if err := change.DataTo(&d); err != nil || d.Name != w.name {
+				t.Errorf("DataTo = %q, %v, want %q", d.Name, err, w.name)
+			}
+		}
+
+		if w.id != "a" {
+			continue
+		}
+		if docChange := nextChange(t, docChanges); docChange.Seq != change.Seq {
+			t.Errorf("Document.Watch got seq %d, want %d", docChange.Seq, change.Seq)
+		}
+	}
+
+	cancel()
+	for range changes {
+	}
+}
+
+func TestCollectionWatchSince(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	path := filepath.Join(t.TempDir(), "test.db")
+
+	db, err := docdb.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, id := range []string{"a", "b", "c"} {
+		if err := db.Collection("test").Document(id).Create(ctx, &doc{Name: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	changes, err := db.Collection("test").WatchSince(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := nextChange(t, changes)
+	if first.ID != "a" {
+		t.Errorf("first change is %q, want \"a\"", first.ID)
+	}
+
+	last, err := db.LastSeq(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last <= first.Seq {
+		t.Errorf("LastSeq = %d, want it after the first change %d", last, first.Seq)
+	}
+
+	// A consumer that restarts resumes after the last change it handled.
+	resumed, err := db.Collection("test").WatchSince(ctx, first.Seq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The Document has been written since it was created, so the change
+	// carries it's latest data.
+	if err := db.Collection("test").Document("b").Set(ctx, &doc{Name: "bee"}); err != nil {
+		t.Fatal(err)
+	}
+	var d doc
+	if change := nextChange(t, resumed); change.ID != "b" {
+		t.Errorf("resumed change is %q, want \"b\"", change.ID)
+	} else if err := change.DataTo(&d); err != nil || d.Name != "bee" {
+		t.Errorf("DataTo = %q, %v, want \"bee\"", d.Name, err)
+	}
+	if change := nextChange(t, resumed); change.ID != "c" {
+		t.Errorf("resumed change is %q, want \"c\"", change.ID)
+	}
+	if change := nextChange(t, resumed); change.ID != "b" || change.Kind != docdb.ChangeUpdated {
+		t.Errorf("resumed change is %s %q, want updated \"b\"", change.Kind, change.ID)
+	}
+
+	// Writes from another connection are picked up by polling.
+	other, err := docdb.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	if err := other.Collection("test").Document("d").Create(ctx, &doc{Name: "d"}); err != nil {
+		t.Fatal(err)
+	}
+	if change := nextChange(t, resumed); change.ID != "d" {
+		t.Errorf("change from other connection is %q, want \"d\"", change.ID)
+	}
+
+	// Watching a Collection that doesn't exist yet waits for it's first write.
+	empty, err := db.Collection("empty").Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Collection("empty").Document("e").Create(ctx, &doc{Name: "e"}); err != nil {
+		t.Fatal(err)
+	}
+	if change := nextChange(t, empty); change.ID != "e" || change.DataTo(&d) != nil || d.Name != "e" {
+		t.Errorf("first change is %q with %q, want \"e\"", change.ID, d.Name)
+	}
+}
+
+func TestPruneChanges(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db := openTestDB(t)
+
+	for _, id := range []string{"a", "b", "c", "d"} {
+		if err := db.Collection("test").Document(id).Create(ctx, &doc{Name: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := db.PruneChanges(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	// Watching from the start only finds the changes that were kept.
+	changes, err := db.Collection("test").WatchSince(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if change := nextChange(t, changes); change.ID != "c" {
+		t.Errorf("first kept change is %q, want \"c\"", change.ID)
+	}
+	if change := nextChange(t, changes); change.ID != "d" {
+		t.Errorf("second kept change is %q, want \"d\"", change.ID)
+	}
+
+	// Sequence numbers carry on after pruning.
+	last, err := db.LastSeq(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PruneChanges(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Collection("test").Document("e").Create(ctx, &doc{Name: "e"}); err != nil {
+		t.Fatal(err)
+	}
+	if change := nextChange(t, changes); change.ID != "e" || change.Seq <= last {
+		t.Errorf("change after pruning is %q at %d, want \"e\" after %d", change.ID, change.Seq, last)
+	}
+}
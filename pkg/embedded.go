@@ -0,0 +1,433 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+
+	docdb "github.com/limeleaf-coop/knbn/pkg/db"
+	"github.com/limeleaf-coop/knbn/templs"
+)
+
+// searchKeypathRegexp matches the keypath of a search result on a board to
+// find the list and card it's in.
+var searchKeypathRegexp = regexp.MustCompile(`^\$\.Lists\[(\d+)\](?:\.Cards\[(\d+)\])?\.(\w+)$`)
+
+// EmbeddedStore keeps each board with all of it's lists and cards in a single
+// document in the boards collection. Every edit is a JSON Patch applied to the
+// whole board.
+type EmbeddedStore struct {
+	db *docdb.Database
+}
+
+func NewEmbeddedStore(db *docdb.Database) *EmbeddedStore {
+	return &EmbeddedStore{db: db}
+}
+
+func (s *EmbeddedStore) Init(ctx context.Context) error {
+	if err := s.db.Collection("boards").EnsureSearchIndex(ctx, "$.Lists[*].Title", "$.Lists[*].Cards[*].Title", "$.Lists[*].Cards[*].Desc"); err != nil {
+		return err
+	}
+	if err := ensureNormalizedIndexes(ctx, s.db); err != nil {
+		return err
+	}
+
+	// Move lists and cards saved by a NormalizedStore back into their
+	// boards.
+	return s.db.RunInTx(ctx, func(tx *docdb.Tx) error {
+		boards, err := boardsIn(ctx, tx.Collection("boards"))
+		if err != nil {
+			return err
+		}
+
+		for _, board := range boards {
+			lists, err := normalizedLists(ctx, tx, board.ID)
+			if err != nil {
+				return err
+			}
+			if len(lists) == 0 {
+				continue
+			}
+
+			board.Lists = lists
+			if err := tx.Collection("boards").Document(board.ID).Set(ctx, &board); err != nil {
+				return err
+			}
+			if err := deleteNormalized(ctx, tx, board.ID); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (s *EmbeddedStore) Board(ctx context.Context, boardId string) (templs.Board, error) {
+	var board templs.Board
+	doc := s.db.Collection("boards").Document(boardId)
+	if err := doc.Get(ctx, &board); err != nil {
+		return templs.Board{}, err
+	}
+
+	board.ID = boardId
+	board.Revision = doc.Revision
+
+	return board, nil
+}
+
+func (s *EmbeddedStore) Boards(ctx context.Context, workspaceId string) ([]templs.Board, error) {
+	return workspaceBoards(ctx, s.db, workspaceId)
+}
+
+func (s *EmbeddedStore) CreateBoard(ctx context.Context, workspaceId string, title string, ownerId string) (templs.Board, error) {
+	return s.create(ctx, templs.Board{WorkspaceID: workspaceId, Title: title, Lists: []templs.List{}}, ownerId)
+}
+
+func (s *EmbeddedStore) RenameBoard(ctx context.Context, boardId string, rev int64, title string) (templs.Board, error) {
+	return s.edit(ctx, boardId, rev, func(board templs.Board) (docdb.JSONPatch, error) {
+		return docdb.JSONPatch{
+			{Op: "replace", Path: "/Title", Value: title},
+		}, nil
+	})
+}
+
+func (s *EmbeddedStore) DuplicateBoard(ctx context.Context, boardId string, title string, withCards bool, ownerId string) (templs.Board, error) {
+	board, err := s.Board(ctx, boardId)
+	if err != nil {
+		return templs.Board{}, err
+	}
+
+	return s.create(ctx, templs.Board{WorkspaceID: board.WorkspaceID, Title: title, Labels: board.Labels, Lists: copyLists(board.Lists, withCards)}, ownerId)
+}
+
+func (s *EmbeddedStore) DeleteBoard(ctx context.Context, boardId string, rev int64) error {
+	return s.db.RunInTx(ctx, func(tx *docdb.Tx) error {
+		if err := tx.Collection("boards").Document(boardId).DeleteIfRevision(ctx, rev); err != nil {
+			return err
+		}
+
+		return removeMembers(ctx, tx, boardId)
+	})
+}
+
+// create saves board as a new document under a generated ID, along with it's
+// owner.
+func (s *EmbeddedStore) create(ctx context.Context, board templs.Board, ownerId string) (templs.Board, error) {
+	var doc *docdb.Document
+	err := s.db.RunInTx(ctx, func(tx *docdb.Tx) error {
+		doc = tx.Collection("boards").Document(docdb.NewID())
+		if err := doc.Create(ctx, &board); err != nil {
+			return err
+		}
+
+		return setMember(ctx, tx, doc.ID, ownerId, templs.RoleOwner)
+	})
+	if err != nil {
+		return templs.Board{}, err
+	}
+
+	board.ID = doc.ID
+	board.Revision = doc.Revision
+
+	return board, nil
+}
+
+// Search looks up the IDs of matching lists and cards in the board each
+// result carries, since results address them by position.
+func (s *EmbeddedStore) Search(ctx context.Context, boardIds []string, query string) ([]templs.SearchResult, error) {
+	found, err := s.db.Collection("boards").WhereID(docdb.OpIn, boardIds).Search(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]templs.SearchResult, 0, len(found))
+	for _, f := range found {
+		match := searchKeypathRegexp.FindStringSubmatch(f.Keypath)
+		if match == nil {
+			continue
+		}
+
+		var board templs.Board
+		if err := f.DataTo(&board); err != nil {
+			return nil, err
+		}
+
+		listIdx, _ := strconv.Atoi(match[1])
+		if listIdx >= len(board.Lists) {
+			continue
+		}
+
+		result := templs.SearchResult{
+			BoardID:    f.ID,
+			BoardTitle: board.Title,
+			ListID:     board.Lists[listIdx].ID,
+			Field:      match[3],
+			Snippet:    highlights(f.Snippet),
+		}
+		if match[2] != "" {
+			cardIdx, _ := strconv.Atoi(match[2])
+			if cardIdx >= len(board.Lists[listIdx].Cards) {
+				continue
+			}
+			result.CardID = board.Lists[listIdx].Cards[cardIdx].ID
+		}
+
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+// edit applies the patch fn makes for the board as it is now. Patches address
+// lists and cards by position, so they only apply if the board is still at
+// rev, which means the positions fn found are still right too.
+func (s *EmbeddedStore) edit(ctx context.Context, boardId string, rev int64, fn func(board templs.Board) (docdb.JSONPatch, error)) (templs.Board, error) {
+	board, err := s.Board(ctx, boardId)
+	if err != nil {
+		return templs.Board{}, err
+	}
+
+	patch, err := fn(board)
+	if err != nil {
+		return templs.Board{}, err
+	}
+
+	doc := s.db.Collection("boards").Document(boardId)
+	if err := doc.PatchIfRevision(ctx, patch, rev); err != nil {
+		return templs.Board{}, err
+	}
+
+	var next templs.Board
+	if err := doc.DataTo(&next); err != nil {
+		return templs.Board{}, err
+	}
+
+	next.ID = boardId
+	next.Revision = doc.Revision
+
+	return next, nil
+}
+
+func (s *EmbeddedStore) AddList(ctx context.Context, boardId string, rev int64, title string) (templs.Board, error) {
+	return s.edit(ctx, boardId, rev, func(board templs.Board) (docdb.JSONPatch, error) {
+		return docdb.JSONPatch{
+			{Op: "add", Path: "/Lists/-", Value: templs.List{ID: docdb.NewID(), Title: title, Cards: []templs.Card{}}},
+		}, nil
+	})
+}
+
+func (s *EmbeddedStore) RenameList(ctx context.Context, boardId string, rev int64, listId string, title string) (templs.Board, error) {
+	return s.edit(ctx, boardId, rev, func(board templs.Board) (docdb.JSONPatch, error) {
+		listIdx, err := findList(board, listId)
+		if err != nil {
+			return nil, err
+		}
+
+		return docdb.JSONPatch{
+			{Op: "replace", Path: fmt.Sprintf("/Lists/%d/Title", listIdx), Value: title},
+		}, nil
+	})
+}
+
+func (s *EmbeddedStore) MoveList(ctx context.Context, boardId string, rev int64, listId string, position int) (templs.Board, error) {
+	return s.edit(ctx, boardId, rev, func(board templs.Board) (docdb.JSONPatch, error) {
+		listIdx, err := findList(board, listId)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkPosition(position, len(board.Lists)-1); err != nil {
+			return nil, err
+		}
+
+		return docdb.JSONPatch{
+			{Op: "move", From: fmt.Sprintf("/Lists/%d", listIdx), Path: fmt.Sprintf("/Lists/%d", position)},
+		}, nil
+	})
+}
+
+func (s *EmbeddedStore) DeleteList(ctx context.Context, boardId string, rev int64, listId string, moveTo string) (templs.Board, error) {
+	return s.edit(ctx, boardId, rev, func(board templs.Board) (docdb.JSONPatch, error) {
+		listIdx, err := findList(board, listId)
+		if err != nil {
+			return nil, err
+		}
+
+		var patch docdb.JSONPatch
+
+		// Copy the cards over one by one before removing the list.
+		if moveTo != "" {
+			to, err := findList(board, moveTo)
+			if err != nil || to == listIdx {
+				return nil, fmt.Errorf("%w: invalid list to move cards to %q", errBadRequest, moveTo)
+			}
+
+			for idx := range board.Lists[listIdx].Cards {
+				patch = append(patch, docdb.PatchOp{
+					Op:   "copy",
+					From: fmt.Sprintf("/Lists/%d/Cards/%d", listIdx, idx),
+					Path: fmt.Sprintf("/Lists/%d/Cards/-", to),
+				})
+			}
+		}
+
+		return append(patch, docdb.PatchOp{Op: "remove", Path: fmt.Sprintf("/Lists/%d", listIdx)}), nil
+	})
+}
+
+func (s *EmbeddedStore) AddCard(ctx context.Context, boardId string, rev int64, listId string, title string) (templs.Board, error) {
+	return s.edit(ctx, boardId, rev, func(board templs.Board) (docdb.JSONPatch, error) {
+		listIdx, err := findList(board, listId)
+		if err != nil {
+			return nil, err
+		}
+
+		return docdb.JSONPatch{
+			{Op: "add", Path: fmt.Sprintf("/Lists/%d/Cards/-", listIdx), Value: templs.Card{ID: docdb.NewID(), Title: title}},
+		}, nil
+	})
+}
+
+func (s *EmbeddedStore) RenameCard(ctx context.Context, boardId string, rev int64, cardId string, title string) (templs.Board, error) {
+	return s.edit(ctx, boardId, rev, func(board templs.Board) (docdb.JSONPatch, error) {
+		listIdx, cardIdx, err := findCard(board, cardId)
+		if err != nil {
+			return nil, err
+		}
+
+		return docdb.JSONPatch{
+			{Op: "replace", Path: fmt.Sprintf("/Lists/%d/Cards/%d/Title", listIdx, cardIdx), Value: title},
+		}, nil
+	})
+}
+
+func (s *EmbeddedStore) SetCardDesc(ctx context.Context, boardId string, rev int64, cardId string, desc string) (templs.Board, error) {
+	return s.edit(ctx, boardId, rev, func(board templs.Board) (docdb.JSONPatch, error) {
+		listIdx, cardIdx, err := findCard(board, cardId)
+		if err != nil {
+			return nil, err
+		}
+
+		// "add" rather than "replace" so cards saved without a description
+		// can still get one.
+		return docdb.JSONPatch{
+			{Op: "add", Path: fmt.Sprintf("/Lists/%d/Cards/%d/Desc", listIdx, cardIdx), Value: desc},
+		}, nil
+	})
+}
+
+func (s *EmbeddedStore) MoveCard(ctx context.Context, boardId string, rev int64, cardId string, toListId string, position int) (templs.Board, error) {
+	return s.edit(ctx, boardId, rev, func(board templs.Board) (docdb.JSONPatch, error) {
+		fromList, fromCard, err := findCard(board, cardId)
+		if err != nil {
+			return nil, err
+		}
+		toList, err := findList(board, toListId)
+		if err != nil {
+			return nil, err
+		}
+
+		path := fmt.Sprintf("/Lists/%d/Cards/-", toList)
+		if position >= 0 {
+			others := len(board.Lists[toList].Cards)
+			if toList == fromList {
+				others--
+			}
+			if err := checkPosition(position, others); err != nil {
+				return nil, err
+			}
+
+			path = fmt.Sprintf("/Lists/%d/Cards/%d", toList, position)
+		}
+
+		return docdb.JSONPatch{
+			{Op: "move", From: fmt.Sprintf("/Lists/%d/Cards/%d", fromList, fromCard), Path: path},
+		}, nil
+	})
+}
+
+func (s *EmbeddedStore) DeleteCard(ctx context.Context, boardId string, rev int64, cardId string) (templs.Board, error) {
+	return s.edit(ctx, boardId, rev, func(board templs.Board) (docdb.JSONPatch, error) {
+		listIdx, cardIdx, err := findCard(board, cardId)
+		if err != nil {
+			return nil, err
+		}
+
+		return docdb.JSONPatch{
+			{Op: "remove", Path: fmt.Sprintf("/Lists/%d/Cards/%d", listIdx, cardIdx)},
+		}, nil
+	})
+}
+
+func (s *EmbeddedStore) SetCardLabels(ctx context.Context, boardId string, rev int64, cardId string, labelIds []string) (templs.Board, error) {
+	return s.edit(ctx, boardId, rev, func(board templs.Board) (docdb.JSONPatch, error) {
+		listIdx, cardIdx, err := findCard(board, cardId)
+		if err != nil {
+			return nil, err
+		}
+		ids, err := cardLabels(board, labelIds)
+		if err != nil {
+			return nil, err
+		}
+
+		// "add" replaces the labels of cards that already have some.
+		return docdb.JSONPatch{
+			{Op: "add", Path: fmt.Sprintf("/Lists/%d/Cards/%d/Labels", listIdx, cardIdx), Value: ids},
+		}, nil
+	})
+}
+
+func (s *EmbeddedStore) AddLabel(ctx context.Context, boardId string, rev int64, name string, color string) (templs.Board, error) {
+	return s.edit(ctx, boardId, rev, func(board templs.Board) (docdb.JSONPatch, error) {
+		label := templs.Label{ID: docdb.NewID(), Name: name, Color: color}
+
+		// Boards saved before there were labels don't have an array to
+		// append to.
+		if len(board.Labels) == 0 {
+			return docdb.JSONPatch{
+				{Op: "add", Path: "/Labels", Value: []templs.Label{label}},
+			}, nil
+		}
+
+		return docdb.JSONPatch{
+			{Op: "add", Path: "/Labels/-", Value: label},
+		}, nil
+	})
+}
+
+func (s *EmbeddedStore) UpdateLabel(ctx context.Context, boardId string, rev int64, labelId string, name string, color string) (templs.Board, error) {
+	return s.edit(ctx, boardId, rev, func(board templs.Board) (docdb.JSONPatch, error) {
+		labelIdx, err := findLabel(board, labelId)
+		if err != nil {
+			return nil, err
+		}
+
+		return docdb.JSONPatch{
+			{Op: "replace", Path: fmt.Sprintf("/Labels/%d", labelIdx), Value: templs.Label{ID: labelId, Name: name, Color: color}},
+		}, nil
+	})
+}
+
+func (s *EmbeddedStore) DeleteLabel(ctx context.Context, boardId string, rev int64, labelId string) (templs.Board, error) {
+	return s.edit(ctx, boardId, rev, func(board templs.Board) (docdb.JSONPatch, error) {
+		labelIdx, err := findLabel(board, labelId)
+		if err != nil {
+			return nil, err
+		}
+
+		var patch docdb.JSONPatch
+		for listIdx, list := range board.Lists {
+			for cardIdx, card := range list.Cards {
+				if ids, ok := withoutLabel(card, labelId); ok {
+					patch = append(patch, docdb.PatchOp{
+						Op:    "replace",
+						Path:  fmt.Sprintf("/Lists/%d/Cards/%d/Labels", listIdx, cardIdx),
+						Value: ids,
+					})
+				}
+			}
+		}
+
+		return append(patch, docdb.PatchOp{Op: "remove", Path: fmt.Sprintf("/Labels/%d", labelIdx)}), nil
+	})
+}
@@ -0,0 +1,202 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/a-h/templ"
+	docdb "github.com/limeleaf-coop/knbn/pkg/db"
+	"github.com/limeleaf-coop/knbn/templs"
+)
+
+const (
+	// keepAlive is how often an idle event stream sends a comment so proxies
+	// don't close it.
+	keepAlive = 30 * time.Second
+
+	// accessCheck is how often an idle event stream checks that it's account
+	// can still see the board, so it's closed soon after the account is
+	// signed out or taken off the board or it's workspace.
+	accessCheck = 10 * time.Second
+)
+
+// writeEvent writes the rendered component as a single Server-Sent Event.
+func writeEvent(w http.ResponseWriter, r *http.Request, event string, id int64, c templ.Component) error {
+	buf := bytes.NewBuffer(nil)
+	if err := c.Render(r.Context(), buf); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "event: %s\nid: %d\n", event, id)
+	for _, line := range strings.Split(buf.String(), "\n") {
+		fmt.Fprintf(w, "data: %s\n", line)
+	}
+	fmt.Fprint(w, "\n")
+
+	w.(http.Flusher).Flush()
+
+	return nil
+}
+
+// changedLists returns the indexes of lists that differ between two versions
+// of a board, or all if lists were added, removed or reordered, or labels
+// changed, and every list needs to be rendered again.
+func changedLists(before, after templs.Board) (changed []int, all bool) {
+	if len(before.Lists) != len(after.Lists) || !slices.Equal(before.Labels, after.Labels) {
+		return nil, true
+	}
+	for idx := range after.Lists {
+		if before.Lists[idx].ID != after.Lists[idx].ID {
+			return nil, true
+		}
+	}
+
+	for idx := range after.Lists {
+		b, _ := json.Marshal(before.Lists[idx])
+		a, _ := json.Marshal(after.Lists[idx])
+		if !bytes.Equal(a, b) {
+			changed = append(changed, idx)
+		}
+	}
+
+	return changed, false
+}
+
+// canView reports whether the session of a request wrapped by RequireAccount
+// is still signed in and it's account can still see the board.
+func canView(ctx context.Context, sessions *Sessions, members *Members, boardId string) (bool, error) {
+	session := CurrentSession(ctx)
+
+	if active, err := sessions.Active(ctx, session.ID); err != nil || !active {
+		return false, err
+	}
+
+	role, err := members.Role(ctx, boardId, session.AccountID)
+	if err != nil {
+		return false, err
+	}
+
+	return role.Can(templs.RoleViewer), nil
+}
+
+// BoardEventsHandler streams updates to a board. Every edit saves the board's
+// document, whichever BoardStore made it, so watching that is enough to know
+// when to load the board again. Access to the board is checked again before
+// every update and every accessCheck, and the stream ends once it's lost.
+func BoardEventsHandler(db *docdb.Database, boards BoardStore, sessions *Sessions, members *Members) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := w.(http.Flusher); !ok {
+			http.Error(w, "streaming not supported", http.StatusInternalServerError)
+			return
+		}
+
+		boardId := r.PathValue("boardId")
+		doc := db.Collection("boards").Document(boardId)
+
+		// Resume after the last event the browser saw when it reconnects,
+		// otherwise start watching before reading the board so no change
+		// made in between is missed. The first event carries the sequence
+		// the board was read at so a reconnect resumes from there rather
+		// than replaying the whole change log.
+		seq, err := db.LastSeq(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if lastId, parseErr := strconv.ParseInt(r.Header.Get("Last-Event-ID"), 10, 64); parseErr == nil {
+			seq = lastId
+		}
+		changes, err := doc.WatchSince(r.Context(), seq)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		board, err := boards.Board(r.Context(), boardId)
+		if err != nil {
+			if errors.Is(err, docdb.ErrNotFound) {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+
+		// The page may have been rendered from an older revision than the
+		// one just read.
+		if rev, _ := strconv.ParseInt(r.URL.Query().Get("rev"), 10, 64); rev != board.Revision {
+			if err := writeEvent(w, r, "board", seq, templs.BoardUpdate(board, nil, true)); err != nil {
+				return
+			}
+		}
+
+		ticker := time.NewTicker(keepAlive)
+		defer ticker.Stop()
+		checker := time.NewTicker(accessCheck)
+		defer checker.Stop()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-ticker.C:
+				fmt.Fprint(w, ": keep-alive\n\n")
+				w.(http.Flusher).Flush()
+			case <-checker.C:
+				if ok, err := canView(r.Context(), sessions, members, boardId); err != nil || !ok {
+					return
+				}
+			case change, ok := <-changes:
+				if !ok {
+					return
+				}
+
+				// A deleted board's members are deleted with it, so only
+				// the session is left to check.
+				if change.Kind == docdb.ChangeDeleted {
+					if active, err := sessions.Active(r.Context(), CurrentSession(r.Context()).ID); err != nil || !active {
+						return
+					}
+					writeEvent(w, r, "board", change.Seq, templs.BoardDeleted())
+					continue
+				}
+
+				if ok, err := canView(r.Context(), sessions, members, boardId); err != nil || !ok {
+					return
+				}
+
+				// Skip changes the board has already moved past
+				// since it was loaded.
+				if change.Revision <= board.Revision {
+					continue
+				}
+
+				next, err := boards.Board(r.Context(), boardId)
+				if err != nil {
+					return
+				}
+
+				changed, all := changedLists(board, next)
+				if err := writeEvent(w, r, "board", change.Seq, templs.BoardUpdate(next, changed, all)); err != nil {
+					return
+				}
+
+				board = next
+			}
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package pkg_test
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/limeleaf-coop/knbn/pkg"
+	"github.com/limeleaf-coop/knbn/templs"
+)
+
+// event is a single Server-Sent Event.
+type event struct {
+	name string
+	id   int64
+	data string
+}
+
+// openEvents opens the event stream of a board on server for the page showing
+// it at revision rev, as the session with cookie, resuming after the event
+// lastId if it isn't empty. The returned channel is closed when the stream
+// ends, and calling the returned func ends it.
+func openEvents(t *testing.T, server *httptest.Server, boardId string, rev int64, cookie *http.Cookie, lastId string) (<-chan event, func()) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	target := server.URL + "/boards/" + boardId + "/events?rev=" + strconv.FormatInt(rev, 10)
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Accept", "text/event-stream")
+	r.AddCookie(cookie)
+	if lastId != "" {
+		r.Header.Set("Last-Event-ID", lastId)
+	}
+
+	resp, err := server.Client().Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		t.Fatalf("got status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	events := make(chan event)
+	go func() {
+		defer close(events)
+		defer resp.Body.Close()
+
+		var e event
+		var data []string
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case line == "":
+				e.data = strings.Join(data, "\n")
+				events <- e
+				e, data = event{}, nil
+			case strings.HasPrefix(line, "event: "):
+				e.name = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "id: "):
+				e.id, _ = strconv.ParseInt(strings.TrimPrefix(line, "id: "), 10, 64)
+			case strings.HasPrefix(line, "data: "):
+				data = append(data, strings.TrimPrefix(line, "data: "))
+			}
+		}
+	}()
+
+	return events, cancel
+}
+
+// nextEvent returns the next event, skipping keep-alives.
+func nextEvent(t *testing.T, events <-chan event) event {
+	t.Helper()
+
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				t.Fatal("stream ended")
+			}
+			if e.name != "" {
+				return e
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for an event")
+		}
+	}
+}
+
+// checkEnded fails unless the stream ends without sending anything containing
+// notWant.
+func checkEnded(t *testing.T, events <-chan event, notWant string) {
+	t.Helper()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			if strings.Contains(e.data, notWant) {
+				t.Errorf("got %q after losing access", e.data)
+			}
+		case <-timeout:
+			t.Fatal("stream didn't end")
+		}
+	}
+}
+
+func TestBoardEvents(t *testing.T) {
+	ctx := context.Background()
+
+	db := openTestDB(t)
+	sessions := pkg.NewSessions(db)
+	workspaces := pkg.NewWorkspaces(db)
+	members := pkg.NewMembers(db)
+	boards := pkg.NewEmbeddedStore(db)
+	if err := boards.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	admin := createAccount(t, db, "admin@example.com")
+	bob := createAccount(t, db, "bob@example.com")
+	carol := createAccount(t, db, "carol@example.com")
+	workspace, err := workspaces.Create(ctx, admin.ID, "Acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, account := range []templs.Account{bob, carol} {
+		if err := workspaces.SetByEmail(ctx, workspace.ID, account.Email, templs.WorkspaceRoleMember); err != nil {
+			t.Fatal(err)
+		}
+	}
+	board, err := boards.CreateBoard(ctx, workspace.ID, "Roadmap", admin.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := members.Set(ctx, board.ID, bob.ID, templs.RoleViewer); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each stream signals ended once it's handler returns.
+	ended := make(chan struct{}, 10)
+	events := pkg.BoardEventsHandler(db, boards, sessions, members)
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /boards/{boardId}/events", sessions.RequireAccount(workspaces.Current(members.Require(templs.RoleViewer)(func(w http.ResponseWriter, r *http.Request) {
+		events(w, r)
+		ended <- struct{}{}
+	}))))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	// checkHandlerEnded fails unless a stream's handler has returned.
+	checkHandlerEnded := func(t *testing.T) {
+		t.Helper()
+
+		select {
+		case <-ended:
+		case <-time.After(5 * time.Second):
+			t.Fatal("handler didn't return")
+		}
+	}
+
+	adminCookie := signIn(t, db, sessions, admin.Email)
+	bobCookie := signIn(t, db, sessions, bob.Email)
+	carolCookie := signIn(t, db, sessions, carol.Email)
+
+	t.Run("updates", func(t *testing.T) {
+		stream, stop := openEvents(t, server, board.ID, board.Revision, bobCookie, "")
+
+		if board, err = boards.AddList(ctx, board.ID, board.Revision, "Todo"); err != nil {
+			t.Fatal(err)
+		}
+		e := nextEvent(t, stream)
+		if e.name != "board" || !strings.Contains(e.data, "Todo") {
+			t.Errorf("got %s %q, want the board with the new list", e.name, e.data)
+		}
+
+		// Closing the stream returns from the handler.
+		stop()
+		checkHandlerEnded(t)
+	})
+
+	t.Run("resume", func(t *testing.T) {
+		stream, stop := openEvents(t, server, board.ID, board.Revision, bobCookie, "")
+		if board, err = boards.AddList(ctx, board.ID, board.Revision, "Doing"); err != nil {
+			t.Fatal(err)
+		}
+		seen := nextEvent(t, stream)
+		seenRev := board.Revision
+		stop()
+		checkHandlerEnded(t)
+
+		// Changes made while the browser is away are sent when it
+		// reconnects, carrying the ID it reconnected with.
+		if board, err = boards.AddList(ctx, board.ID, board.Revision, "Done"); err != nil {
+			t.Fatal(err)
+		}
+		stream, stop = openEvents(t, server, board.ID, seenRev, bobCookie, strconv.FormatInt(seen.id, 10))
+		defer stop()
+
+		e := nextEvent(t, stream)
+		if e.id != seen.id || !strings.Contains(e.data, "Done") {
+			t.Errorf("got event %d %q, want %d with the list added while away", e.id, e.data, seen.id)
+		}
+
+		// Later changes carry later IDs.
+		if board, err = boards.AddList(ctx, board.ID, board.Revision, "Later"); err != nil {
+			t.Fatal(err)
+		}
+		if e := nextEvent(t, stream); e.id <= seen.id || !strings.Contains(e.data, "Later") {
+			t.Errorf("got event %d %q, want one after %d with the new list", e.id, e.data, seen.id)
+		}
+	})
+
+	t.Run("access lost", func(t *testing.T) {
+		stream, _ := openEvents(t, server, board.ID, board.Revision, bobCookie, "")
+		if err := members.Remove(ctx, board.ID, bob.ID); err != nil {
+			t.Fatal(err)
+		}
+
+		// Access is checked again before sending the next change.
+		if board, err = boards.AddList(ctx, board.ID, board.Revision, "Secret"); err != nil {
+			t.Fatal(err)
+		}
+		checkEnded(t, stream, "Secret")
+		checkHandlerEnded(t)
+	})
+
+	t.Run("signed out", func(t *testing.T) {
+		if err := members.Set(ctx, board.ID, carol.ID, templs.RoleEditor); err != nil {
+			t.Fatal(err)
+		}
+		stream, _ := openEvents(t, server, board.ID, board.Revision, carolCookie, "")
+		serveAs(sessions.RequireAccount(pkg.SignOutAllHandler(sessions)), carolCookie, false)
+
+		if board, err = boards.AddList(ctx, board.ID, board.Revision, "Private"); err != nil {
+			t.Fatal(err)
+		}
+		checkEnded(t, stream, "Private")
+		checkHandlerEnded(t)
+	})
+
+	t.Run("deleted", func(t *testing.T) {
+		stream, stop := openEvents(t, server, board.ID, board.Revision, adminCookie, "")
+		defer stop()
+
+		if err := boards.DeleteBoard(ctx, board.ID, board.Revision); err != nil {
+			t.Fatal(err)
+		}
+		if e := nextEvent(t, stream); !strings.Contains(e.data, "This board was deleted") {
+			t.Errorf("got %q, want the board deleted message", e.data)
+		}
+	})
+}
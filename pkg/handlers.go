@@ -1,144 +1,1128 @@
 package pkg
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
+	"regexp"
+	"slices"
 	"strconv"
-	"time"
+	"strings"
 
 	"github.com/a-h/templ"
 	docdb "github.com/limeleaf-coop/knbn/pkg/db"
 	"github.com/limeleaf-coop/knbn/templs"
 )
 
+var (
+	errBadRequest = errors.New("bad request")
+	errNotFound   = errors.New("not found")
+)
+
 func metaRefresh(w http.ResponseWriter, url string) {
 	w.Header().Add("Content-Type", "text/html")
 	fmt.Fprintf(w, "<meta http-equiv=\"refresh\" content=\"0; url=%s\">", url)
 }
 
-func IndexHandler(w http.ResponseWriter, r *http.Request) {
-	_, err := r.Cookie("knbn")
+// redirect sends the browser to url, with HX-Redirect for requests made by
+// htmx since it would swap a meta refresh into the page instead.
+func redirect(w http.ResponseWriter, r *http.Request, url string) {
+	if r.Header.Get("HX-Request") != "" {
+		w.Header().Set("HX-Redirect", url)
+		return
+	}
+
+	metaRefresh(w, url)
+}
+
+// formIndex parses the form value name as a position in a list, or returns
+// -1 if it's empty.
+func formIndex(r *http.Request, name string) (int, error) {
+	if r.FormValue(name) == "" {
+		return -1, nil
+	}
+
+	idx, err := strconv.ParseUint(r.FormValue(name), 10, 0)
+	if err != nil {
+		return 0, fmt.Errorf("%w: invalid %s %q", errBadRequest, name, r.FormValue(name))
+	}
+
+	return int(idx), nil
+}
+
+// formRevision parses the revision of the board the page was showing from the
+// "rev" form value. Edits only apply if nobody else saved the board since.
+func formRevision(r *http.Request) (int64, error) {
+	rev, err := strconv.ParseInt(r.FormValue("rev"), 10, 64)
 	if err != nil {
-		templ.Handler(templs.IndexPage()).ServeHTTP(w, r)
+		return 0, fmt.Errorf("%w: invalid revision %q", errBadRequest, r.FormValue("rev"))
+	}
+
+	return rev, nil
+}
+
+// boardError writes the response for an error from a BoardStore. A conflict
+// swaps in a message asking to reload the board instead of losing the edit
+// silently.
+func boardError(w http.ResponseWriter, r *http.Request, boardId string, err error) {
+	switch {
+	case errors.Is(err, docdb.ErrConflict):
+		w.Header().Set("HX-Retarget", "#board-conflict")
+		w.Header().Set("HX-Reswap", "innerHTML")
+		templ.Handler(templs.BoardConflict(boardId), templ.WithStatus(http.StatusConflict)).ServeHTTP(w, r)
+	case errors.Is(err, docdb.ErrNotFound), errors.Is(err, docdb.ErrPatchFailed), errors.Is(err, errNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, errBadRequest):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// renderBoardFragment writes the fragment that replaces the edited element
+// followed by the board's new revision swapped in out of band.
+func renderBoardFragment(w http.ResponseWriter, r *http.Request, board templs.Board, fragment templ.Component) {
+	w.Header().Set("Content-Type", "text/html")
+
+	if err := fragment.Render(r.Context(), w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	templs.BoardRevision(board.Revision, true).Render(r.Context(), w)
+}
+
+// renderBoardUpdate writes the fragment that replaces the edited element
+// followed by a BoardUpdate, for edits that change how the board looks
+// elsewhere on the page too.
+func renderBoardUpdate(w http.ResponseWriter, r *http.Request, board templs.Board, fragment templ.Component, changed []int, all bool) {
+	w.Header().Set("Content-Type", "text/html")
+
+	if err := fragment.Render(r.Context(), w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	metaRefresh(w, "/boards")
+	templs.BoardUpdate(board, changed, all).Render(r.Context(), w)
 }
 
-func SignInHandler(db *docdb.Database) func(http.ResponseWriter, *http.Request) {
+func IndexHandler(sessions *Sessions) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		r.ParseForm()
+		if _, err := sessions.Get(w, r); err != nil {
+			templ.Handler(templs.IndexPage()).ServeHTTP(w, r)
+			return
+		}
+
+		metaRefresh(w, "/boards")
+	}
+}
+
+func AccountHandler(w http.ResponseWriter, r *http.Request) {
+	t := templs.AccountPage(CurrentNav(r.Context()))
+	templ.Handler(t).ServeHTTP(w, r)
+}
+
+// visibleBoards returns the boards in the current workspace that the current
+// account can see, which is all of them for the workspace's admins.
+func visibleBoards(r *http.Request, boards BoardStore, members *Members) ([]templs.Board, error) {
+	nav := CurrentNav(r.Context())
+	if nav.Workspace.ID == "" {
+		return nil, nil
+	}
+
+	all, err := boards.Boards(r.Context(), nav.Workspace.ID)
+	if err != nil || nav.Workspace.Role == templs.WorkspaceRoleAdmin {
+		return all, err
+	}
 
-		email := r.Form.Get("email")
-		results, err := db.Collection("accounts").Query(r.Context(), "$.Email", docdb.OpEqual, email)
+	roles, err := members.Boards(r.Context(), nav.Account.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return slices.DeleteFunc(all, func(board templs.Board) bool {
+		return roles[board.ID] == ""
+	}), nil
+}
+
+// BoardsHandler lists the boards in the current workspace the current account
+// can see.
+func BoardsHandler(boards BoardStore, members *Members) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		all, err := visibleBoards(r, boards, members)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		if len(results) <= 0 {
-			metaRefresh(w, "/")
+		t := templs.BoardsPage(CurrentNav(r.Context()), all)
+		templ.Handler(t).ServeHTTP(w, r)
+	}
+}
+
+// CreateBoardHandler creates a board in the current workspace owned by the
+// current account.
+func CreateBoardHandler(boards BoardStore) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		title := strings.TrimSpace(r.FormValue("Title"))
+		if title == "" {
+			http.Error(w, "board title is required", http.StatusBadRequest)
+			return
+		}
+
+		workspaceId := CurrentNav(r.Context()).Workspace.ID
+		if workspaceId == "" {
+			http.Error(w, "create a workspace for the board first", http.StatusBadRequest)
 			return
 		}
 
-		cookie := http.Cookie{
-			Name:    "knbn",
-			Value:   email,
-			Expires: time.Now().Add(30 * time.Minute),
+		board, err := boards.CreateBoard(r.Context(), workspaceId, title, CurrentAccount(r.Context()).ID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
-		http.SetCookie(w, &cookie)
 
-		metaRefresh(w, "/boards")
-		return
+		redirect(w, r, "/boards/"+board.ID)
+	}
+}
+
+func BoardHandler(boards BoardStore) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		boardId := r.PathValue("boardId")
+
+		board, err := boards.Board(r.Context(), boardId)
+		if err != nil {
+			boardError(w, r, boardId, err)
+			return
+		}
+
+		t := templs.BoardPage(board, CurrentRole(r.Context()), "")
+		templ.Handler(t).ServeHTTP(w, r)
 	}
 }
 
-func BoardsHandler(db *docdb.Database) func(http.ResponseWriter, *http.Request) {
+func BoardTitleHandler(boards BoardStore) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		_, err := r.Cookie("knbn")
+		boardId := r.PathValue("boardId")
+
+		board, err := boards.Board(r.Context(), boardId)
 		if err != nil {
-			metaRefresh(w, "/")
+			boardError(w, r, boardId, err)
 			return
 		}
 
-		docs, err := db.Collection("boards").QueryAll(r.Context())
+		t := templs.BoardTitle(boardId, board.Title)
+		templ.Handler(t).ServeHTTP(w, r)
+	}
+}
+
+func EditBoardTitleHandler(boards BoardStore) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		boardId := r.PathValue("boardId")
+
+		board, err := boards.Board(r.Context(), boardId)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			boardError(w, r, boardId, err)
 			return
 		}
 
-		boards := make([]templs.Board, len(docs))
-		for idx, doc := range docs {
-			var board templs.Board
-			if err := doc.DataTo(&board); err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
+		t := templs.EditBoardTitle(boardId, board.Title)
+		templ.Handler(t).ServeHTTP(w, r)
+	}
+}
+
+func UpdateBoardTitleHandler(boards BoardStore) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		boardId := r.PathValue("boardId")
+
+		rev, err := formRevision(r)
+		if err != nil {
+			boardError(w, r, boardId, err)
+			return
+		}
+
+		title := strings.TrimSpace(r.FormValue("Title"))
+		if title == "" {
+			boardError(w, r, boardId, fmt.Errorf("%w: board title is required", errBadRequest))
+			return
+		}
 
-			board.ID = doc.ID
-			boards[idx] = board
+		board, err := boards.RenameBoard(r.Context(), boardId, rev, title)
+		if err != nil {
+			boardError(w, r, boardId, err)
+			return
+		}
+
+		renderBoardFragment(w, r, board, templs.BoardTitle(boardId, board.Title))
+	}
+}
+
+func ConfirmDuplicateBoardHandler(boards BoardStore) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		boardId := r.PathValue("boardId")
+
+		board, err := boards.Board(r.Context(), boardId)
+		if err != nil {
+			boardError(w, r, boardId, err)
+			return
 		}
 
-		t := templs.BoardsPage(boards)
+		t := templs.DuplicateBoard(board)
 		templ.Handler(t).ServeHTTP(w, r)
 	}
 }
 
-func BoardHandler(db *docdb.Database) func(http.ResponseWriter, *http.Request) {
+// DuplicateBoardHandler copies a board and opens the copy, which is owned by
+// the current account. It doesn't need the board's revision since the board
+// itself is left as it is.
+func DuplicateBoardHandler(boards BoardStore) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		_, err := r.Cookie("knbn")
+		boardId := r.PathValue("boardId")
+
+		title := strings.TrimSpace(r.FormValue("Title"))
+		if title == "" {
+			boardError(w, r, boardId, fmt.Errorf("%w: board title is required", errBadRequest))
+			return
+		}
+
+		board, err := boards.DuplicateBoard(r.Context(), boardId, title, r.FormValue("Cards") == "true", CurrentAccount(r.Context()).ID)
 		if err != nil {
-			metaRefresh(w, "/")
+			boardError(w, r, boardId, err)
 			return
 		}
 
-		boardId := r.PathValue("id")
+		redirect(w, r, "/boards/"+board.ID)
+	}
+}
+
+func ConfirmDeleteBoardHandler(boards BoardStore) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		boardId := r.PathValue("boardId")
 
-		var board templs.Board
-		err = db.Collection("boards").Document(boardId).Get(r.Context(), &board)
+		board, err := boards.Board(r.Context(), boardId)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			boardError(w, r, boardId, err)
+			return
+		}
+
+		t := templs.DeleteBoard(board)
+		templ.Handler(t).ServeHTTP(w, r)
+	}
+}
+
+func DeleteBoardHandler(boards BoardStore) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		boardId := r.PathValue("boardId")
+
+		rev, err := formRevision(r)
+		if err != nil {
+			boardError(w, r, boardId, err)
+			return
+		}
+
+		if err := boards.DeleteBoard(r.Context(), boardId, rev); err != nil {
+			boardError(w, r, boardId, err)
+			return
+		}
+
+		redirect(w, r, "/boards")
+	}
+}
+
+// getTitle loads the title of the card or list in the request's path.
+func getTitle(r *http.Request, boards BoardStore, boardId string) (string, error) {
+	if cardId := r.PathValue("cardId"); cardId != "" {
+		card, err := getCard(r, boards, boardId, cardId)
+		return card.Title, err
+	}
+
+	board, err := boards.Board(r.Context(), boardId)
+	if err != nil {
+		return "", err
+	}
+
+	listIdx, err := findList(board, r.PathValue("listId"))
+	if err != nil {
+		return "", err
+	}
+
+	return board.Lists[listIdx].Title, nil
+}
+
+func TitleHandler(boards BoardStore) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		boardId := r.PathValue("boardId")
+
+		title, err := getTitle(r, boards, boardId)
+		if err != nil {
+			boardError(w, r, boardId, err)
+			return
+		}
+
+		if cardId := r.PathValue("cardId"); cardId != "" {
+			t := templs.CardTitle(boardId, cardId, title)
+			templ.Handler(t).ServeHTTP(w, r)
 			return
 		}
 
-		board.ID = boardId
-		t := templs.BoardPage(board)
+		t := templs.ListTitle(boardId, r.PathValue("listId"), title)
 		templ.Handler(t).ServeHTTP(w, r)
 	}
 }
 
-func TitleHandler(db *docdb.Database) func(http.ResponseWriter, *http.Request) {
+func EditTitleHandler(boards BoardStore) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		boardId := r.PathValue("boardId")
-		listIdx, _ := strconv.ParseInt(r.PathValue("listIdx"), 10, 64)
-		title := r.URL.Query().Get("title")
 
-		if r.PathValue("cardIdx") != "" {
-			cardIdx, _ := strconv.ParseInt(r.PathValue("cardIdx"), 10, 64)
-			t := templs.CardTitle(boardId, int(listIdx), int(cardIdx), title)
+		title, err := getTitle(r, boards, boardId)
+		if err != nil {
+			boardError(w, r, boardId, err)
+			return
+		}
+
+		if cardId := r.PathValue("cardId"); cardId != "" {
+			t := templs.EditCardTitle(boardId, cardId, title)
 			templ.Handler(t).ServeHTTP(w, r)
+			return
+		}
+
+		t := templs.EditListTitle(boardId, r.PathValue("listId"), title)
+		templ.Handler(t).ServeHTTP(w, r)
+	}
+}
+
+func UpdateTitleHandler(boards BoardStore) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		boardId := r.PathValue("boardId")
+
+		rev, err := formRevision(r)
+		if err != nil {
+			boardError(w, r, boardId, err)
+			return
+		}
+
+		title := strings.TrimSpace(r.FormValue("Title"))
+		if title == "" {
+			boardError(w, r, boardId, fmt.Errorf("%w: title is required", errBadRequest))
+			return
+		}
+
+		if cardId := r.PathValue("cardId"); cardId != "" {
+			board, err := boards.RenameCard(r.Context(), boardId, rev, cardId, title)
+			if err != nil {
+				boardError(w, r, boardId, err)
+				return
+			}
+
+			renderBoardFragment(w, r, board, templs.CardTitle(boardId, cardId, title))
+			return
+		}
+
+		listId := r.PathValue("listId")
+		board, err := boards.RenameList(r.Context(), boardId, rev, listId, title)
+		if err != nil {
+			boardError(w, r, boardId, err)
+			return
+		}
+
+		renderBoardFragment(w, r, board, templs.ListTitle(boardId, listId, title))
+	}
+}
+
+func ListHandler(boards BoardStore) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		boardId := r.PathValue("boardId")
+
+		board, err := boards.Board(r.Context(), boardId)
+		if err != nil {
+			boardError(w, r, boardId, err)
+			return
+		}
+		listIdx, err := findList(board, r.PathValue("listId"))
+		if err != nil {
+			boardError(w, r, boardId, err)
+			return
 		}
 
-		t := templs.ListTitle(boardId, int(listIdx), title)
+		t := templs.ListContent(board, listIdx)
 		templ.Handler(t).ServeHTTP(w, r)
 	}
 }
 
-func EditTitleHandler(db *docdb.Database) func(http.ResponseWriter, *http.Request) {
+func CreateListHandler(boards BoardStore) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		boardId := r.PathValue("boardId")
+
+		rev, err := formRevision(r)
+		if err != nil {
+			boardError(w, r, boardId, err)
+			return
+		}
+
+		title := strings.TrimSpace(r.FormValue("Title"))
+		if title == "" {
+			boardError(w, r, boardId, fmt.Errorf("%w: list title is required", errBadRequest))
+			return
+		}
+
+		board, err := boards.AddList(r.Context(), boardId, rev, title)
+		if err != nil {
+			boardError(w, r, boardId, err)
+			return
+		}
+
+		renderBoardFragment(w, r, board, templs.Lists(board))
+	}
+}
+
+// MoveHandler moves a list, or a card when Card is given, to Position on the
+// board or in the list ToList. The arrows on lists and cards and dropping a
+// dragged list or card all post here, and the lists whose positions changed
+// are swapped back in out of band.
+func MoveHandler(boards BoardStore) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		boardId := r.PathValue("boardId")
-		listIdx, _ := strconv.ParseInt(r.PathValue("listIdx"), 10, 64)
-		title := r.URL.Query().Get("title")
 
-		if r.PathValue("cardIdx") != "" {
-			cardIdx, _ := strconv.ParseInt(r.PathValue("cardIdx"), 10, 64)
-			t := templs.EditCardTitle(boardId, int(listIdx), int(cardIdx), title)
+		rev, err := formRevision(r)
+		if err != nil {
+			boardError(w, r, boardId, err)
+			return
+		}
+		position, err := formIndex(r, "Position")
+		if err != nil {
+			boardError(w, r, boardId, err)
+			return
+		}
+
+		cardId := r.FormValue("Card")
+		if cardId == "" {
+			if position < 0 {
+				boardError(w, r, boardId, fmt.Errorf("%w: Position is required to move a list", errBadRequest))
+				return
+			}
+
+			board, err := boards.MoveList(r.Context(), boardId, rev, r.FormValue("List"), position)
+			if err != nil {
+				boardError(w, r, boardId, err)
+				return
+			}
+
+			t := templs.BoardUpdate(board, nil, true)
 			templ.Handler(t).ServeHTTP(w, r)
 			return
 		}
 
-		t := templs.EditListTitle(boardId, int(listIdx), title)
+		board, err := boards.Board(r.Context(), boardId)
+		if err != nil {
+			boardError(w, r, boardId, err)
+			return
+		}
+		fromList, _, err := findCard(board, cardId)
+		if err != nil {
+			boardError(w, r, boardId, err)
+			return
+		}
+		fromListId := board.Lists[fromList].ID
+		toListId := r.FormValue("ToList")
+
+		board, err = boards.MoveCard(r.Context(), boardId, rev, cardId, toListId, position)
+		if err != nil {
+			boardError(w, r, boardId, err)
+			return
+		}
+
+		var changed []int
+		for idx, list := range board.Lists {
+			if list.ID == fromListId || list.ID == toListId {
+				changed = append(changed, idx)
+			}
+		}
+
+		t := templs.BoardUpdate(board, changed, false)
 		templ.Handler(t).ServeHTTP(w, r)
 	}
 }
+
+func ConfirmDeleteListHandler(boards BoardStore) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		boardId := r.PathValue("boardId")
+
+		board, err := boards.Board(r.Context(), boardId)
+		if err != nil {
+			boardError(w, r, boardId, err)
+			return
+		}
+		listIdx, err := findList(board, r.PathValue("listId"))
+		if err != nil {
+			boardError(w, r, boardId, err)
+			return
+		}
+
+		t := templs.DeleteList(board, listIdx)
+		templ.Handler(t).ServeHTTP(w, r)
+	}
+}
+
+func DeleteListHandler(boards BoardStore) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		boardId := r.PathValue("boardId")
+
+		rev, err := formRevision(r)
+		if err != nil {
+			boardError(w, r, boardId, err)
+			return
+		}
+
+		board, err := boards.DeleteList(r.Context(), boardId, rev, r.PathValue("listId"), r.FormValue("MoveTo"))
+		if err != nil {
+			boardError(w, r, boardId, err)
+			return
+		}
+
+		renderBoardFragment(w, r, board, templs.Lists(board))
+	}
+}
+
+func CreateCardHandler(boards BoardStore) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		boardId := r.PathValue("boardId")
+		listId := r.PathValue("listId")
+
+		rev, err := formRevision(r)
+		if err != nil {
+			boardError(w, r, boardId, err)
+			return
+		}
+
+		title := strings.TrimSpace(r.FormValue("Title"))
+		if title == "" {
+			boardError(w, r, boardId, fmt.Errorf("%w: card title is required", errBadRequest))
+			return
+		}
+
+		board, err := boards.AddCard(r.Context(), boardId, rev, listId, title)
+		if err != nil {
+			boardError(w, r, boardId, err)
+			return
+		}
+		listIdx, err := findList(board, listId)
+		if err != nil {
+			boardError(w, r, boardId, err)
+			return
+		}
+
+		renderBoardFragment(w, r, board, templs.ListContent(board, listIdx))
+	}
+}
+
+func DeleteCardHandler(boards BoardStore) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		boardId := r.PathValue("boardId")
+		cardId := r.PathValue("cardId")
+
+		rev, err := formRevision(r)
+		if err != nil {
+			boardError(w, r, boardId, err)
+			return
+		}
+
+		board, err := boards.Board(r.Context(), boardId)
+		if err != nil {
+			boardError(w, r, boardId, err)
+			return
+		}
+		listIdx, _, err := findCard(board, cardId)
+		if err != nil {
+			boardError(w, r, boardId, err)
+			return
+		}
+		listId := board.Lists[listIdx].ID
+
+		board, err = boards.DeleteCard(r.Context(), boardId, rev, cardId)
+		if err != nil {
+			boardError(w, r, boardId, err)
+			return
+		}
+		listIdx, err = findList(board, listId)
+		if err != nil {
+			boardError(w, r, boardId, err)
+			return
+		}
+
+		renderBoardFragment(w, r, board, templs.ListContent(board, listIdx))
+	}
+}
+
+// getCard loads the card with the ID cardId on a board.
+func getCard(r *http.Request, boards BoardStore, boardId string, cardId string) (templs.Card, error) {
+	board, err := boards.Board(r.Context(), boardId)
+	if err != nil {
+		return templs.Card{}, err
+	}
+
+	listIdx, cardIdx, err := findCard(board, cardId)
+	if err != nil {
+		return templs.Card{}, err
+	}
+
+	return board.Lists[listIdx].Cards[cardIdx], nil
+}
+
+// CardHandler shows a card in the detail panel. Requests from htmx only get
+// the panel, anything else gets the whole board with the panel open, so the
+// URL works as a permalink to the card.
+func CardHandler(boards BoardStore) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		boardId := r.PathValue("boardId")
+		cardId := r.PathValue("cardId")
+
+		board, err := boards.Board(r.Context(), boardId)
+		if err != nil {
+			boardError(w, r, boardId, err)
+			return
+		}
+
+		listIdx, cardIdx, err := findCard(board, cardId)
+		if err != nil {
+			boardError(w, r, boardId, err)
+			return
+		}
+
+		t := templs.BoardPage(board, CurrentRole(r.Context()), cardId)
+		if r.Header.Get("HX-Request") != "" {
+			t = templs.CardDetail(board, listIdx, cardIdx)
+		}
+		templ.Handler(t).ServeHTTP(w, r)
+	}
+}
+
+func DescHandler(boards BoardStore) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		boardId := r.PathValue("boardId")
+		cardId := r.PathValue("cardId")
+
+		card, err := getCard(r, boards, boardId, cardId)
+		if err != nil {
+			boardError(w, r, boardId, err)
+			return
+		}
+
+		t := templs.CardDesc(boardId, cardId, card.Desc)
+		templ.Handler(t).ServeHTTP(w, r)
+	}
+}
+
+func EditDescHandler(boards BoardStore) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		boardId := r.PathValue("boardId")
+		cardId := r.PathValue("cardId")
+
+		card, err := getCard(r, boards, boardId, cardId)
+		if err != nil {
+			boardError(w, r, boardId, err)
+			return
+		}
+
+		t := templs.EditCardDesc(boardId, cardId, card.Desc)
+		templ.Handler(t).ServeHTTP(w, r)
+	}
+}
+
+func UpdateDescHandler(boards BoardStore) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		boardId := r.PathValue("boardId")
+		cardId := r.PathValue("cardId")
+		desc := r.FormValue("Desc")
+
+		rev, err := formRevision(r)
+		if err != nil {
+			boardError(w, r, boardId, err)
+			return
+		}
+
+		board, err := boards.SetCardDesc(r.Context(), boardId, rev, cardId, desc)
+		if err != nil {
+			boardError(w, r, boardId, err)
+			return
+		}
+
+		renderBoardFragment(w, r, board, templs.CardDesc(boardId, cardId, desc))
+	}
+}
+
+// UpdateCardLabelsHandler saves which labels are on a card, from every
+// "Label" form value, and swaps the card's list back in with it's new chips.
+func UpdateCardLabelsHandler(boards BoardStore) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		boardId := r.PathValue("boardId")
+		cardId := r.PathValue("cardId")
+
+		rev, err := formRevision(r)
+		if err != nil {
+			boardError(w, r, boardId, err)
+			return
+		}
+
+		board, err := boards.SetCardLabels(r.Context(), boardId, rev, cardId, r.Form["Label"])
+		if err != nil {
+			boardError(w, r, boardId, err)
+			return
+		}
+		listIdx, cardIdx, err := findCard(board, cardId)
+		if err != nil {
+			boardError(w, r, boardId, err)
+			return
+		}
+
+		renderBoardUpdate(w, r, board, templs.CardLabels(board, board.Lists[listIdx].Cards[cardIdx]), []int{listIdx}, false)
+	}
+}
+
+// labelColorRegexp matches the hex colors color inputs send.
+var labelColorRegexp = regexp.MustCompile(`^#[0-9a-f]{6}$`)
+
+// formLabel parses the name and color of a label from the "Name" and "Color"
+// form values.
+func formLabel(r *http.Request) (string, string, error) {
+	name := strings.TrimSpace(r.FormValue("Name"))
+	if name == "" {
+		return "", "", fmt.Errorf("%w: label name is required", errBadRequest)
+	}
+
+	color := strings.ToLower(r.FormValue("Color"))
+	if !labelColorRegexp.MatchString(color) {
+		return "", "", fmt.Errorf("%w: invalid label color %q", errBadRequest, r.FormValue("Color"))
+	}
+
+	return name, color, nil
+}
+
+func LabelsHandler(boards BoardStore) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		boardId := r.PathValue("boardId")
+
+		board, err := boards.Board(r.Context(), boardId)
+		if err != nil {
+			boardError(w, r, boardId, err)
+			return
+		}
+
+		t := templs.Labels(board)
+		templ.Handler(t).ServeHTTP(w, r)
+	}
+}
+
+// AddLabelHandler, UpdateLabelHandler and DeleteLabelHandler swap every list
+// back in along with the label filter, since any card might show the label.
+func AddLabelHandler(boards BoardStore) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		boardId := r.PathValue("boardId")
+
+		rev, err := formRevision(r)
+		if err != nil {
+			boardError(w, r, boardId, err)
+			return
+		}
+		name, color, err := formLabel(r)
+		if err != nil {
+			boardError(w, r, boardId, err)
+			return
+		}
+
+		board, err := boards.AddLabel(r.Context(), boardId, rev, name, color)
+		if err != nil {
+			boardError(w, r, boardId, err)
+			return
+		}
+
+		renderBoardUpdate(w, r, board, templs.Labels(board), nil, true)
+	}
+}
+
+func UpdateLabelHandler(boards BoardStore) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		boardId := r.PathValue("boardId")
+
+		rev, err := formRevision(r)
+		if err != nil {
+			boardError(w, r, boardId, err)
+			return
+		}
+		name, color, err := formLabel(r)
+		if err != nil {
+			boardError(w, r, boardId, err)
+			return
+		}
+
+		board, err := boards.UpdateLabel(r.Context(), boardId, rev, r.PathValue("labelId"), name, color)
+		if err != nil {
+			boardError(w, r, boardId, err)
+			return
+		}
+
+		renderBoardUpdate(w, r, board, templs.Labels(board), nil, true)
+	}
+}
+
+func DeleteLabelHandler(boards BoardStore) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		boardId := r.PathValue("boardId")
+
+		rev, err := formRevision(r)
+		if err != nil {
+			boardError(w, r, boardId, err)
+			return
+		}
+
+		board, err := boards.DeleteLabel(r.Context(), boardId, rev, r.PathValue("labelId"))
+		if err != nil {
+			boardError(w, r, boardId, err)
+			return
+		}
+
+		renderBoardUpdate(w, r, board, templs.Labels(board), nil, true)
+	}
+}
+
+// SearchHandler searches one board, or every board in the current workspace
+// the current account can see.
+func SearchHandler(boards BoardStore, members *Members) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Search on a board is only routed for it's members, and search on
+		// every board is limited to the ones the account can see in the
+		// current workspace.
+		boardIds := []string{r.PathValue("boardId")}
+		if boardIds[0] == "" {
+			visible, err := visibleBoards(r, boards, members)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			boardIds = make([]string, len(visible))
+			for idx, board := range visible {
+				boardIds[idx] = board.ID
+			}
+		}
+
+		query := r.URL.Query().Get("q")
+		results, err := boards.Search(r.Context(), boardIds, query)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		t := templs.SearchResults(query, results)
+		templ.Handler(t).ServeHTTP(w, r)
+	}
+}
+
+func MembersHandler(members *Members, invitations *Invitations) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		renderMembers(w, r, members, invitations, "")
+	}
+}
+
+// AddMemberHandler adds the account with the email to the board, or changes
+// it's role if it's already a member. Emails without an account in the
+// board's workspace are sent an invitation instead.
+func AddMemberHandler(members *Members, invitations *Invitations) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		boardId := r.PathValue("boardId")
+		email := strings.TrimSpace(r.FormValue("Email"))
+		role := templs.Role(r.FormValue("Role"))
+
+		err := members.SetByEmail(r.Context(), boardId, email, role)
+		if errors.Is(err, errInviteNeeded) {
+			err = invitations.InviteToBoard(r.Context(), boardId, email, role, CurrentAccount(r.Context()))
+		}
+		if err != nil && !errors.Is(err, errBadRequest) && !errors.Is(err, errForbidden) {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		renderMembers(w, r, members, invitations, memberMessage(err))
+	}
+}
+
+func RemoveMemberHandler(members *Members, invitations *Invitations) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := members.Remove(r.Context(), r.PathValue("boardId"), r.PathValue("accountId"))
+		if err != nil && !errors.Is(err, errBadRequest) {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		renderMembers(w, r, members, invitations, memberMessage(err))
+	}
+}
+
+func RevokeInvitationHandler(members *Members, invitations *Invitations) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := invitations.Revoke(r.Context(), r.PathValue("invitationId"), "", r.PathValue("boardId"))
+		if err != nil && !errors.Is(err, errNotFound) {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		renderMembers(w, r, members, invitations, memberMessage(err))
+	}
+}
+
+// memberMessage explains why changing a board's or workspace's members failed,
+// without the error's prefix.
+func memberMessage(err error) string {
+	if err == nil {
+		return ""
+	}
+
+	_, msg, _ := strings.Cut(err.Error(), ": ")
+	return msg
+}
+
+// renderMembers writes the members panel of the board in the request's path,
+// with it's pending invitations for owners.
+func renderMembers(w http.ResponseWriter, r *http.Request, members *Members, invitations *Invitations, message string) {
+	boardId := r.PathValue("boardId")
+	manage := CurrentRole(r.Context()).Can(templs.RoleOwner)
+
+	list, err := members.List(r.Context(), boardId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var pending []templs.Invitation
+	if manage {
+		if pending, err = invitations.Pending(r.Context(), "", boardId); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	t := templs.Members(boardId, list, pending, manage, message)
+	templ.Handler(t).ServeHTTP(w, r)
+}
+
+// CreateWorkspaceHandler creates a workspace with the current account as it's
+// admin and switches to it.
+func CreateWorkspaceHandler(workspaces *Workspaces, sessions *Sessions) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimSpace(r.FormValue("Name"))
+		if name == "" {
+			http.Error(w, "workspace name is required", http.StatusBadRequest)
+			return
+		}
+
+		workspace, err := workspaces.Create(r.Context(), CurrentAccount(r.Context()).ID, name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := sessions.SetWorkspace(r.Context(), CurrentSession(r.Context()).ID, workspace.ID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		redirect(w, r, "/boards")
+	}
+}
+
+// SwitchWorkspaceHandler switches the current session to another workspace
+// the current account is in.
+func SwitchWorkspaceHandler(sessions *Sessions) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		workspaceId := r.FormValue("WorkspaceID")
+		if _, ok := findWorkspace(CurrentNav(r.Context()), workspaceId); !ok {
+			http.Error(w, fmt.Sprintf("%v: workspace %q", errNotFound, workspaceId), http.StatusNotFound)
+			return
+		}
+
+		if err := sessions.SetWorkspace(r.Context(), CurrentSession(r.Context()).ID, workspaceId); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		redirect(w, r, "/boards")
+	}
+}
+
+func WorkspaceHandler(workspaces *Workspaces, invitations *Invitations) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		renderWorkspaceMembers(w, r, workspaces, invitations, "", true)
+	}
+}
+
+// AddWorkspaceMemberHandler puts the account with the email in the workspace,
+// or changes it's role if it's already in it. Emails without an account are
+// sent an invitation instead.
+func AddWorkspaceMemberHandler(workspaces *Workspaces, invitations *Invitations) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		workspaceId := r.PathValue("workspaceId")
+		email := strings.TrimSpace(r.FormValue("Email"))
+		role := templs.WorkspaceRole(r.FormValue("Role"))
+
+		err := workspaces.SetByEmail(r.Context(), workspaceId, email, role)
+		if errors.Is(err, errInviteNeeded) {
+			err = invitations.InviteToWorkspace(r.Context(), workspaceId, email, role, CurrentAccount(r.Context()))
+		}
+		if err != nil && !errors.Is(err, errBadRequest) {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		renderWorkspaceMembers(w, r, workspaces, invitations, memberMessage(err), false)
+	}
+}
+
+func RemoveWorkspaceMemberHandler(workspaces *Workspaces, invitations *Invitations) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := workspaces.Remove(r.Context(), r.PathValue("workspaceId"), r.PathValue("accountId"))
+		if err != nil && !errors.Is(err, errBadRequest) {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		renderWorkspaceMembers(w, r, workspaces, invitations, memberMessage(err), false)
+	}
+}
+
+func RevokeWorkspaceInvitationHandler(workspaces *Workspaces, invitations *Invitations) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := invitations.Revoke(r.Context(), r.PathValue("invitationId"), r.PathValue("workspaceId"), "")
+		if err != nil && !errors.Is(err, errNotFound) {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		renderWorkspaceMembers(w, r, workspaces, invitations, memberMessage(err), false)
+	}
+}
+
+// renderWorkspaceMembers writes the members of the workspace in the request's
+// path, with it's pending invitations for admins, as a whole page or just the
+// panel of them.
+func renderWorkspaceMembers(w http.ResponseWriter, r *http.Request, workspaces *Workspaces, invitations *Invitations, message string, page bool) {
+	nav := CurrentNav(r.Context())
+	workspace, _ := findWorkspace(nav, r.PathValue("workspaceId"))
+
+	members, err := workspaces.Members(r.Context(), workspace.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var pending []templs.Invitation
+	if workspace.Role == templs.WorkspaceRoleAdmin {
+		if pending, err = invitations.Pending(r.Context(), workspace.ID, ""); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	t := templs.WorkspaceMembers(workspace, members, pending, message)
+	if page {
+		t = templs.WorkspacePage(nav, workspace, members, pending)
+	}
+	templ.Handler(t).ServeHTTP(w, r)
+}
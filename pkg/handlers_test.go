@@ -0,0 +1,629 @@
+package pkg_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/limeleaf-coop/knbn/pkg"
+	docdb "github.com/limeleaf-coop/knbn/pkg/db"
+	"github.com/limeleaf-coop/knbn/templs"
+)
+
+// eachStore runs test with each BoardStore, each on a database of it's own.
+func eachStore(t *testing.T, test func(t *testing.T, db *docdb.Database, boards pkg.BoardStore)) {
+	stores := []struct {
+		name string
+		new  func(db *docdb.Database) pkg.BoardStore
+	}{
+		{"embedded", func(db *docdb.Database) pkg.BoardStore { return pkg.NewEmbeddedStore(db) }},
+		{"normalized", func(db *docdb.Database) pkg.BoardStore { return pkg.NewNormalizedStore(db) }},
+	}
+
+	for _, store := range stores {
+		t.Run(store.name, func(t *testing.T) {
+			db := openTestDB(t)
+			boards := store.new(db)
+			if err := boards.Init(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+
+			test(t, db, boards)
+		})
+	}
+}
+
+// boardMux routes requests to the handlers that edit boards like main does,
+// without the middleware checking who is signed in.
+func boardMux(boards pkg.BoardStore) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("PUT /boards/{boardId}/title", pkg.UpdateBoardTitleHandler(boards))
+	mux.HandleFunc("DELETE /boards/{boardId}", pkg.DeleteBoardHandler(boards))
+	mux.HandleFunc("POST /boards/{boardId}/labels", pkg.AddLabelHandler(boards))
+	mux.HandleFunc("PUT /boards/{boardId}/labels/{labelId}", pkg.UpdateLabelHandler(boards))
+	mux.HandleFunc("DELETE /boards/{boardId}/labels/{labelId}", pkg.DeleteLabelHandler(boards))
+	mux.HandleFunc("POST /boards/{boardId}/move", pkg.MoveHandler(boards))
+	mux.HandleFunc("POST /boards/{boardId}/lists", pkg.CreateListHandler(boards))
+	mux.HandleFunc("DELETE /boards/{boardId}/lists/{listId}", pkg.DeleteListHandler(boards))
+	mux.HandleFunc("PUT /boards/{boardId}/lists/{listId}/title", pkg.UpdateTitleHandler(boards))
+	mux.HandleFunc("POST /boards/{boardId}/lists/{listId}/cards", pkg.CreateCardHandler(boards))
+	mux.HandleFunc("DELETE /boards/{boardId}/cards/{cardId}", pkg.DeleteCardHandler(boards))
+	mux.HandleFunc("PUT /boards/{boardId}/cards/{cardId}/desc", pkg.UpdateDescHandler(boards))
+	mux.HandleFunc("PUT /boards/{boardId}/cards/{cardId}/labels", pkg.UpdateCardLabelsHandler(boards))
+	mux.HandleFunc("PUT /boards/{boardId}/cards/{cardId}/title", pkg.UpdateTitleHandler(boards))
+
+	return mux
+}
+
+// request sends an htmx request with the form to handler. Like htmx, the form
+// goes in the query string of DELETE requests.
+func request(handler http.Handler, method string, target string, form url.Values) *httptest.ResponseRecorder {
+	body := form.Encode()
+	if method == http.MethodDelete {
+		target, body = target+"?"+body, ""
+	}
+
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("HX-Request", "true")
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	return w
+}
+
+// rev returns the form value holding the board's revision.
+func rev(board templs.Board) string {
+	return strconv.FormatInt(board.Revision, 10)
+}
+
+// seedBoard creates a board with a list for each of lists, which are a title
+// followed by the titles of the list's cards like "Todo: a b".
+func seedBoard(t *testing.T, boards pkg.BoardStore, lists ...string) templs.Board {
+	t.Helper()
+
+	ctx := context.Background()
+
+	board, err := boards.CreateBoard(ctx, "workspace", "Roadmap", "owner")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for listIdx, list := range lists {
+		title, cards, _ := strings.Cut(list, ":")
+		if board, err = boards.AddList(ctx, board.ID, board.Revision, title); err != nil {
+			t.Fatal(err)
+		}
+		for _, card := range strings.Fields(cards) {
+			if board, err = boards.AddCard(ctx, board.ID, board.Revision, board.Lists[listIdx].ID, card); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	return board
+}
+
+// layout describes the board's lists in the form seedBoard takes.
+func layout(board templs.Board) []string {
+	lists := make([]string, 0, len(board.Lists))
+	for _, list := range board.Lists {
+		cards := make([]string, 0, len(list.Cards))
+		for _, card := range list.Cards {
+			cards = append(cards, card.Title)
+		}
+		lists = append(lists, strings.TrimSpace(list.Title+": "+strings.Join(cards, " ")))
+	}
+
+	return lists
+}
+
+// checkBoard fails unless the saved board with the ID boardId is laid out as
+// want, and returns it.
+func checkBoard(t *testing.T, boards pkg.BoardStore, boardId string, want ...string) templs.Board {
+	t.Helper()
+
+	board, err := boards.Board(context.Background(), boardId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := layout(board); !reflect.DeepEqual(got, want) {
+		t.Errorf("board is %q, want %q", got, want)
+	}
+
+	return board
+}
+
+// checkStatus fails unless w has the status code want.
+func checkStatus(t *testing.T, w *httptest.ResponseRecorder, want int) {
+	t.Helper()
+
+	if w.Code != want {
+		t.Errorf("got status %d %q, want %d", w.Code, w.Body.String(), want)
+	}
+}
+
+// checkConflict fails unless w asks to reload the board.
+func checkConflict(t *testing.T, w *httptest.ResponseRecorder) {
+	t.Helper()
+
+	checkStatus(t, w, http.StatusConflict)
+	if target := w.Header().Get("HX-Retarget"); target != "#board-conflict" {
+		t.Errorf("conflict retargets %q, want \"#board-conflict\"", target)
+	}
+}
+
+// stale returns the form value holding the revision before the board's.
+func stale(board templs.Board) string {
+	return strconv.FormatInt(board.Revision-1, 10)
+}
+
+// badEdit is a request that must be rejected with the status want.
+type badEdit struct {
+	name   string
+	method string
+	target string
+	form   url.Values
+	want   int
+}
+
+// checkRejected sends each edit and fails unless it gets it's status and
+// leaves the board as it was.
+func checkRejected(t *testing.T, handler http.Handler, boards pkg.BoardStore, board templs.Board, edits []badEdit) {
+	t.Helper()
+
+	for _, edit := range edits {
+		t.Run(edit.name, func(t *testing.T) {
+			w := request(handler, edit.method, edit.target, edit.form)
+			if edit.want == http.StatusConflict {
+				checkConflict(t, w)
+			} else {
+				checkStatus(t, w, edit.want)
+			}
+		})
+	}
+
+	if got := checkBoard(t, boards, board.ID, layout(board)...); got.Revision != board.Revision {
+		t.Errorf("board is at revision %d, want %d", got.Revision, board.Revision)
+	}
+}
+
+// checkBody fails unless w's body contains want.
+func checkBody(t *testing.T, w *httptest.ResponseRecorder, want string) {
+	t.Helper()
+
+	if !strings.Contains(w.Body.String(), want) {
+		t.Errorf("got %q, want it to contain %q", w.Body.String(), want)
+	}
+}
+
+func TestCards(t *testing.T) {
+	eachStore(t, func(t *testing.T, db *docdb.Database, boards pkg.BoardStore) {
+		mux := boardMux(boards)
+
+		board := seedBoard(t, boards, "Todo: a", "Done:")
+		base := "/boards/" + board.ID
+		todo, a := board.Lists[0].ID, board.Lists[0].Cards[0].ID
+
+		w := request(mux, http.MethodPost, base+"/lists/"+todo+"/cards", url.Values{"rev": {rev(board)}, "Title": {" b "}})
+		checkStatus(t, w, http.StatusOK)
+		checkBody(t, w, ">b<")
+		board = checkBoard(t, boards, board.ID, "Todo: a b", "Done:")
+		b := board.Lists[0].Cards[1].ID
+
+		w = request(mux, http.MethodPut, base+"/cards/"+b+"/title", url.Values{"rev": {rev(board)}, "Title": {"bee"}})
+		checkStatus(t, w, http.StatusOK)
+		checkBody(t, w, "bee")
+		board = checkBoard(t, boards, board.ID, "Todo: a bee", "Done:")
+
+		w = request(mux, http.MethodPut, base+"/cards/"+b+"/desc", url.Values{"rev": {rev(board)}, "Desc": {"Due **soon**"}})
+		checkStatus(t, w, http.StatusOK)
+		checkBody(t, w, "<strong>soon</strong>")
+		board = checkBoard(t, boards, board.ID, "Todo: a bee", "Done:")
+		if desc := board.Lists[0].Cards[1].Desc; desc != "Due **soon**" {
+			t.Errorf("description is %q, want \"Due **soon**\"", desc)
+		}
+
+		w = request(mux, http.MethodDelete, base+"/cards/"+a, url.Values{"rev": {rev(board)}})
+		checkStatus(t, w, http.StatusOK)
+		board = checkBoard(t, boards, board.ID, "Todo: bee", "Done:")
+
+		// Every response swaps in the board's new revision.
+		checkBody(t, w, `value="`+rev(board)+`"`)
+
+		checkRejected(t, mux, boards, board, []badEdit{
+			{"create without a title", http.MethodPost, base + "/lists/" + todo + "/cards", url.Values{"rev": {rev(board)}, "Title": {" "}}, http.StatusBadRequest},
+			{"create without a revision", http.MethodPost, base + "/lists/" + todo + "/cards", url.Values{"Title": {"c"}}, http.StatusBadRequest},
+			{"create in an unknown list", http.MethodPost, base + "/lists/nope/cards", url.Values{"rev": {rev(board)}, "Title": {"c"}}, http.StatusNotFound},
+			{"create on a stale board", http.MethodPost, base + "/lists/" + todo + "/cards", url.Values{"rev": {stale(board)}, "Title": {"c"}}, http.StatusConflict},
+			{"rename without a title", http.MethodPut, base + "/cards/" + b + "/title", url.Values{"rev": {rev(board)}, "Title": {""}}, http.StatusBadRequest},
+			{"rename with a bad revision", http.MethodPut, base + "/cards/" + b + "/title", url.Values{"rev": {"latest"}, "Title": {"c"}}, http.StatusBadRequest},
+			{"rename an unknown card", http.MethodPut, base + "/cards/nope/title", url.Values{"rev": {rev(board)}, "Title": {"c"}}, http.StatusNotFound},
+			{"rename on a stale board", http.MethodPut, base + "/cards/" + b + "/title", url.Values{"rev": {stale(board)}, "Title": {"c"}}, http.StatusConflict},
+			{"describe without a revision", http.MethodPut, base + "/cards/" + b + "/desc", url.Values{"Desc": {"c"}}, http.StatusBadRequest},
+			{"describe an unknown card", http.MethodPut, base + "/cards/nope/desc", url.Values{"rev": {rev(board)}, "Desc": {"c"}}, http.StatusNotFound},
+			{"describe on a stale board", http.MethodPut, base + "/cards/" + b + "/desc", url.Values{"rev": {stale(board)}, "Desc": {"c"}}, http.StatusConflict},
+			{"delete without a revision", http.MethodDelete, base + "/cards/" + b, nil, http.StatusBadRequest},
+			{"delete an unknown card", http.MethodDelete, base + "/cards/nope", url.Values{"rev": {rev(board)}}, http.StatusNotFound},
+			{"delete on a stale board", http.MethodDelete, base + "/cards/" + b, url.Values{"rev": {stale(board)}}, http.StatusConflict},
+		})
+	})
+}
+
+func TestLists(t *testing.T) {
+	eachStore(t, func(t *testing.T, db *docdb.Database, boards pkg.BoardStore) {
+		mux := boardMux(boards)
+
+		board := seedBoard(t, boards, "Todo: a b", "Done: c")
+		base := "/boards/" + board.ID
+		todo, done := board.Lists[0].ID, board.Lists[1].ID
+
+		w := request(mux, http.MethodPost, base+"/lists", url.Values{"rev": {rev(board)}, "Title": {" Doing "}})
+		checkStatus(t, w, http.StatusOK)
+		checkBody(t, w, "Doing")
+		board = checkBoard(t, boards, board.ID, "Todo: a b", "Done: c", "Doing:")
+		doing := board.Lists[2].ID
+
+		w = request(mux, http.MethodPut, base+"/lists/"+doing+"/title", url.Values{"rev": {rev(board)}, "Title": {"In progress"}})
+		checkStatus(t, w, http.StatusOK)
+		checkBody(t, w, "In progress")
+		board = checkBoard(t, boards, board.ID, "Todo: a b", "Done: c", "In progress:")
+
+		// The arrows move a list one place left or right.
+		w = request(mux, http.MethodPost, base+"/move", url.Values{"rev": {rev(board)}, "List": {doing}, "Position": {"1"}})
+		checkStatus(t, w, http.StatusOK)
+		board = checkBoard(t, boards, board.ID, "Todo: a b", "In progress:", "Done: c")
+
+		// Deleting a list can move it's cards to another list first.
+		w = request(mux, http.MethodDelete, base+"/lists/"+todo, url.Values{"rev": {rev(board)}, "MoveTo": {doing}})
+		checkStatus(t, w, http.StatusOK)
+		board = checkBoard(t, boards, board.ID, "In progress: a b", "Done: c")
+
+		w = request(mux, http.MethodDelete, base+"/lists/"+done, url.Values{"rev": {rev(board)}})
+		checkStatus(t, w, http.StatusOK)
+		board = checkBoard(t, boards, board.ID, "In progress: a b")
+		checkBody(t, w, `value="`+rev(board)+`"`)
+
+		checkRejected(t, mux, boards, board, []badEdit{
+			{"create without a title", http.MethodPost, base + "/lists", url.Values{"rev": {rev(board)}, "Title": {" "}}, http.StatusBadRequest},
+			{"create without a revision", http.MethodPost, base + "/lists", url.Values{"Title": {"Later"}}, http.StatusBadRequest},
+			{"create on a stale board", http.MethodPost, base + "/lists", url.Values{"rev": {stale(board)}, "Title": {"Later"}}, http.StatusConflict},
+			{"rename without a title", http.MethodPut, base + "/lists/" + doing + "/title", url.Values{"rev": {rev(board)}}, http.StatusBadRequest},
+			{"rename an unknown list", http.MethodPut, base + "/lists/nope/title", url.Values{"rev": {rev(board)}, "Title": {"Later"}}, http.StatusNotFound},
+			{"rename on a stale board", http.MethodPut, base + "/lists/" + doing + "/title", url.Values{"rev": {stale(board)}, "Title": {"Later"}}, http.StatusConflict},
+			{"move past the end", http.MethodPost, base + "/move", url.Values{"rev": {rev(board)}, "List": {doing}, "Position": {"1"}}, http.StatusBadRequest},
+			{"delete without a revision", http.MethodDelete, base + "/lists/" + doing, nil, http.StatusBadRequest},
+			{"delete an unknown list", http.MethodDelete, base + "/lists/nope", url.Values{"rev": {rev(board)}}, http.StatusNotFound},
+			{"delete moving cards to an unknown list", http.MethodDelete, base + "/lists/" + doing, url.Values{"rev": {rev(board)}, "MoveTo": {"nope"}}, http.StatusBadRequest},
+			{"delete moving cards to itself", http.MethodDelete, base + "/lists/" + doing, url.Values{"rev": {rev(board)}, "MoveTo": {doing}}, http.StatusBadRequest},
+			{"delete on a stale board", http.MethodDelete, base + "/lists/" + doing, url.Values{"rev": {stale(board)}}, http.StatusConflict},
+		})
+	})
+}
+
+func TestMoveCardArrows(t *testing.T) {
+	eachStore(t, func(t *testing.T, db *docdb.Database, boards pkg.BoardStore) {
+		mux := boardMux(boards)
+
+		board := seedBoard(t, boards, "Todo: a b", "Doing: c", "Done: d")
+		target := "/boards/" + board.ID + "/move"
+		todo, doing, done := board.Lists[0].ID, board.Lists[1].ID, board.Lists[2].ID
+		a, c := board.Lists[0].Cards[0].ID, board.Lists[1].Cards[0].ID
+
+		// checkSwapped fails unless w swaps in exactly the lists with the
+		// IDs want.
+		checkSwapped := func(t *testing.T, w *httptest.ResponseRecorder, want ...string) {
+			t.Helper()
+
+			checkStatus(t, w, http.StatusOK)
+			for _, listId := range []string{todo, doing, done} {
+				swapped := strings.Contains(w.Body.String(), `hx-swap-oob="innerHTML:#list-`+listId+`"`)
+				if swapped != slices.Contains(want, listId) {
+					t.Errorf("list %s swapped is %t, want %t", listId, swapped, !swapped)
+				}
+			}
+		}
+
+		// The right and left arrows move a card to the end of the list next
+		// to it's own.
+		w := request(mux, http.MethodPost, target, url.Values{"rev": {rev(board)}, "Card": {a}, "ToList": {doing}})
+		checkSwapped(t, w, todo, doing)
+		board = checkBoard(t, boards, board.ID, "Todo: b", "Doing: c a", "Done: d")
+
+		w = request(mux, http.MethodPost, target, url.Values{"rev": {rev(board)}, "Card": {c}, "ToList": {todo}})
+		checkSwapped(t, w, todo, doing)
+		board = checkBoard(t, boards, board.ID, "Todo: b c", "Doing: a", "Done: d")
+
+		// The up and down arrows move a card one place within it's list.
+		w = request(mux, http.MethodPost, target, url.Values{"rev": {rev(board)}, "Card": {c}, "ToList": {todo}, "Position": {"0"}})
+		checkSwapped(t, w, todo)
+		board = checkBoard(t, boards, board.ID, "Todo: c b", "Doing: a", "Done: d")
+
+		w = request(mux, http.MethodPost, target, url.Values{"rev": {rev(board)}, "Card": {c}, "ToList": {todo}, "Position": {"1"}})
+		checkSwapped(t, w, todo)
+		board = checkBoard(t, boards, board.ID, "Todo: b c", "Doing: a", "Done: d")
+
+		checkRejected(t, mux, boards, board, []badEdit{
+			{"down from the bottom", http.MethodPost, target, url.Values{"rev": {rev(board)}, "Card": {c}, "ToList": {todo}, "Position": {"2"}}, http.StatusBadRequest},
+			{"without a revision", http.MethodPost, target, url.Values{"Card": {c}, "ToList": {doing}}, http.StatusBadRequest},
+			{"to an unknown list", http.MethodPost, target, url.Values{"rev": {rev(board)}, "Card": {c}, "ToList": {"nope"}}, http.StatusNotFound},
+			{"on a stale board", http.MethodPost, target, url.Values{"rev": {stale(board)}, "Card": {c}, "ToList": {doing}}, http.StatusConflict},
+		})
+	})
+}
+
+func TestBoards(t *testing.T) {
+	eachStore(t, func(t *testing.T, db *docdb.Database, boards pkg.BoardStore) {
+		ctx := context.Background()
+
+		sessions := pkg.NewSessions(db)
+		workspaces := pkg.NewWorkspaces(db)
+		members := pkg.NewMembers(db)
+
+		alice := createAccount(t, db, "alice@example.com")
+		workspace, err := workspaces.Create(ctx, alice.ID, "Acme")
+		if err != nil {
+			t.Fatal(err)
+		}
+		createAccount(t, db, "bob@example.com")
+
+		// as routes requests like boardMux, plus the handlers that need to
+		// know who is signed in, sending the session cookie.
+		as := func(cookie *http.Cookie) http.Handler {
+			mux := boardMux(boards)
+			auth := func(h http.HandlerFunc) http.HandlerFunc { return sessions.RequireAccount(workspaces.Current(h)) }
+			mux.HandleFunc("POST /boards", auth(pkg.CreateBoardHandler(boards)))
+			mux.HandleFunc("POST /boards/{boardId}/duplicate", auth(pkg.DuplicateBoardHandler(boards)))
+
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				r.AddCookie(cookie)
+				mux.ServeHTTP(w, r)
+			})
+		}
+		mux := as(signIn(t, db, sessions, alice.Email))
+
+		// created returns the board a response redirected to.
+		created := func(t *testing.T, w *httptest.ResponseRecorder) templs.Board {
+			t.Helper()
+
+			checkStatus(t, w, http.StatusOK)
+			boardId, ok := strings.CutPrefix(w.Header().Get("HX-Redirect"), "/boards/")
+			if !ok {
+				t.Fatalf("redirected to %q, want a board", w.Header().Get("HX-Redirect"))
+			}
+
+			board, err := boards.Board(ctx, boardId)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			return board
+		}
+
+		board := created(t, request(mux, http.MethodPost, "/boards", url.Values{"Title": {" Roadmap "}}))
+		if board.Title != "Roadmap" || board.WorkspaceID != workspace.ID {
+			t.Errorf("created %q in workspace %q, want \"Roadmap\" in %q", board.Title, board.WorkspaceID, workspace.ID)
+		}
+		if role, err := members.Role(ctx, board.ID, alice.ID); err != nil || role != templs.RoleOwner {
+			t.Errorf("creator's role is %q, %v, want %q", role, err, templs.RoleOwner)
+		}
+
+		for _, title := range []string{"Todo", "Done"} {
+			if board, err = boards.AddList(ctx, board.ID, board.Revision, title); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if board, err = boards.AddCard(ctx, board.ID, board.Revision, board.Lists[0].ID, "a"); err != nil {
+			t.Fatal(err)
+		}
+		base := "/boards/" + board.ID
+
+		w := request(mux, http.MethodPut, base+"/title", url.Values{"rev": {rev(board)}, "Title": {"Plans"}})
+		checkStatus(t, w, http.StatusOK)
+		checkBody(t, w, "Plans")
+		if board, err = boards.Board(ctx, board.ID); err != nil || board.Title != "Plans" {
+			t.Errorf("board is called %q, %v, want \"Plans\"", board.Title, err)
+		}
+
+		// Copies get new IDs, and only get cards when asked for.
+		copied := created(t, request(mux, http.MethodPost, base+"/duplicate", url.Values{"Title": {"Copy"}, "Cards": {"true"}}))
+		checkBoard(t, boards, copied.ID, "Todo: a", "Done:")
+		if copied.Title != "Copy" || copied.ID == board.ID || copied.Lists[0].ID == board.Lists[0].ID || copied.Lists[0].Cards[0].ID == board.Lists[0].Cards[0].ID {
+			t.Errorf("copy %+v shares IDs with %+v", copied, board)
+		}
+		empty := created(t, request(mux, http.MethodPost, base+"/duplicate", url.Values{"Title": {"Empty"}}))
+		checkBoard(t, boards, empty.ID, "Todo:", "Done:")
+
+		w = request(mux, http.MethodDelete, "/boards/"+copied.ID, url.Values{"rev": {rev(copied)}})
+		checkStatus(t, w, http.StatusOK)
+		if redirect := w.Header().Get("HX-Redirect"); redirect != "/boards" {
+			t.Errorf("deleting redirected to %q, want \"/boards\"", redirect)
+		}
+		if _, err := boards.Board(ctx, copied.ID); !errors.Is(err, docdb.ErrNotFound) {
+			t.Errorf("deleted board got %v, want %v", err, docdb.ErrNotFound)
+		}
+
+		// Accounts outside every workspace have nowhere to create a board.
+		w = request(as(signIn(t, db, sessions, "bob@example.com")), http.MethodPost, "/boards", url.Values{"Title": {"Mine"}})
+		checkStatus(t, w, http.StatusBadRequest)
+
+		checkRejected(t, mux, boards, board, []badEdit{
+			{"create without a title", http.MethodPost, "/boards", url.Values{"Title": {" "}}, http.StatusBadRequest},
+			{"rename without a title", http.MethodPut, base + "/title", url.Values{"rev": {rev(board)}, "Title": {""}}, http.StatusBadRequest},
+			{"rename without a revision", http.MethodPut, base + "/title", url.Values{"Title": {"Later"}}, http.StatusBadRequest},
+			{"rename on a stale board", http.MethodPut, base + "/title", url.Values{"rev": {stale(board)}, "Title": {"Later"}}, http.StatusConflict},
+			{"rename an unknown board", http.MethodPut, "/boards/nope/title", url.Values{"rev": {"1"}, "Title": {"Later"}}, http.StatusNotFound},
+			{"duplicate without a title", http.MethodPost, base + "/duplicate", url.Values{"Title": {""}}, http.StatusBadRequest},
+			{"duplicate an unknown board", http.MethodPost, "/boards/nope/duplicate", url.Values{"Title": {"Copy"}}, http.StatusNotFound},
+			{"delete without a revision", http.MethodDelete, base, nil, http.StatusBadRequest},
+			{"delete on a stale board", http.MethodDelete, base, url.Values{"rev": {stale(board)}}, http.StatusConflict},
+		})
+	})
+}
+
+func TestLabels(t *testing.T) {
+	eachStore(t, func(t *testing.T, db *docdb.Database, boards pkg.BoardStore) {
+		mux := boardMux(boards)
+
+		board := seedBoard(t, boards, "Todo: a b")
+		base := "/boards/" + board.ID
+		a, b := board.Lists[0].Cards[0].ID, board.Lists[0].Cards[1].ID
+
+		// checkLabels fails unless the board's labels are named and colored
+		// like want.
+		checkLabels := func(t *testing.T, board templs.Board, want ...string) {
+			t.Helper()
+
+			got := make([]string, 0, len(board.Labels))
+			for _, label := range board.Labels {
+				got = append(got, label.Name+" "+label.Color)
+			}
+			if !slices.Equal(got, want) {
+				t.Errorf("labels are %q, want %q", got, want)
+			}
+		}
+
+		// Colors are saved the way color inputs send them.
+		w := request(mux, http.MethodPost, base+"/labels", url.Values{"rev": {rev(board)}, "Name": {" Bug "}, "Color": {"#D73A4A"}})
+		checkStatus(t, w, http.StatusOK)
+		checkBody(t, w, "Bug")
+		board = checkBoard(t, boards, board.ID, "Todo: a b")
+		checkLabels(t, board, "Bug #d73a4a")
+
+		w = request(mux, http.MethodPost, base+"/labels", url.Values{"rev": {rev(board)}, "Name": {"Client"}, "Color": {"#0075ca"}})
+		checkStatus(t, w, http.StatusOK)
+		board = checkBoard(t, boards, board.ID, "Todo: a b")
+		checkLabels(t, board, "Bug #d73a4a", "Client #0075ca")
+		bug, client := board.Labels[0].ID, board.Labels[1].ID
+
+		w = request(mux, http.MethodPut, base+"/labels/"+bug, url.Values{"rev": {rev(board)}, "Name": {"Defect"}, "Color": {"#b60205"}})
+		checkStatus(t, w, http.StatusOK)
+		checkBody(t, w, "Defect")
+		board = checkBoard(t, boards, board.ID, "Todo: a b")
+		checkLabels(t, board, "Defect #b60205", "Client #0075ca")
+
+		// Cards keep their labels in the order the board lists them.
+		for _, cardId := range []string{a, b} {
+			w = request(mux, http.MethodPut, base+"/cards/"+cardId+"/labels", url.Values{"rev": {rev(board)}, "Label": {client, bug}})
+			checkStatus(t, w, http.StatusOK)
+			checkBody(t, w, "Defect")
+			board = checkBoard(t, boards, board.ID, "Todo: a b")
+		}
+		for _, card := range board.Lists[0].Cards {
+			if !slices.Equal(card.Labels, []string{bug, client}) {
+				t.Errorf("card %s has labels %q, want %q", card.Title, card.Labels, []string{bug, client})
+			}
+		}
+
+		// Deleting a label takes it off every card.
+		w = request(mux, http.MethodDelete, base+"/labels/"+bug, url.Values{"rev": {rev(board)}})
+		checkStatus(t, w, http.StatusOK)
+		board = checkBoard(t, boards, board.ID, "Todo: a b")
+		checkBody(t, w, `value="`+rev(board)+`"`)
+		checkLabels(t, board, "Client #0075ca")
+		for _, card := range board.Lists[0].Cards {
+			if !slices.Equal(card.Labels, []string{client}) {
+				t.Errorf("card %s has labels %q, want only %s", card.Title, card.Labels, client)
+			}
+		}
+
+		checkRejected(t, mux, boards, board, []badEdit{
+			{"add without a name", http.MethodPost, base + "/labels", url.Values{"rev": {rev(board)}, "Name": {" "}, "Color": {"#000000"}}, http.StatusBadRequest},
+			{"add a named color", http.MethodPost, base + "/labels", url.Values{"rev": {rev(board)}, "Name": {"Urgent"}, "Color": {"red"}}, http.StatusBadRequest},
+			{"add a short color", http.MethodPost, base + "/labels", url.Values{"rev": {rev(board)}, "Name": {"Urgent"}, "Color": {"#fff"}}, http.StatusBadRequest},
+			{"add a color that isn't hex", http.MethodPost, base + "/labels", url.Values{"rev": {rev(board)}, "Name": {"Urgent"}, "Color": {"#gggggg"}}, http.StatusBadRequest},
+			{"add without a revision", http.MethodPost, base + "/labels", url.Values{"Name": {"Urgent"}, "Color": {"#000000"}}, http.StatusBadRequest},
+			{"add on a stale board", http.MethodPost, base + "/labels", url.Values{"rev": {stale(board)}, "Name": {"Urgent"}, "Color": {"#000000"}}, http.StatusConflict},
+			{"update without a color", http.MethodPut, base + "/labels/" + client, url.Values{"rev": {rev(board)}, "Name": {"Client"}}, http.StatusBadRequest},
+			{"update an unknown label", http.MethodPut, base + "/labels/nope", url.Values{"rev": {rev(board)}, "Name": {"Client"}, "Color": {"#000000"}}, http.StatusNotFound},
+			{"update on a stale board", http.MethodPut, base + "/labels/" + client, url.Values{"rev": {stale(board)}, "Name": {"Client"}, "Color": {"#000000"}}, http.StatusConflict},
+			{"delete an unknown label", http.MethodDelete, base + "/labels/nope", url.Values{"rev": {rev(board)}}, http.StatusNotFound},
+			{"delete on a stale board", http.MethodDelete, base + "/labels/" + client, url.Values{"rev": {stale(board)}}, http.StatusConflict},
+			{"label a card with an unknown label", http.MethodPut, base + "/cards/" + a + "/labels", url.Values{"rev": {rev(board)}, "Label": {"nope"}}, http.StatusBadRequest},
+			{"label an unknown card", http.MethodPut, base + "/cards/nope/labels", url.Values{"rev": {rev(board)}, "Label": {client}}, http.StatusNotFound},
+			{"label a card on a stale board", http.MethodPut, base + "/cards/" + a + "/labels", url.Values{"rev": {stale(board)}}, http.StatusConflict},
+		})
+		board = checkBoard(t, boards, board.ID, "Todo: a b")
+		checkLabels(t, board, "Client #0075ca")
+	})
+}
+
+func TestMove(t *testing.T) {
+	eachStore(t, func(t *testing.T, db *docdb.Database, boards pkg.BoardStore) {
+		ctx := context.Background()
+		mux := boardMux(boards)
+
+		board := seedBoard(t, boards, "Todo: a b c", "Doing: d", "Done:")
+		target := "/boards/" + board.ID + "/move"
+		todo, doing, done := board.Lists[0].ID, board.Lists[1].ID, board.Lists[2].ID
+		a, b := board.Lists[0].Cards[0].ID, board.Lists[0].Cards[1].ID
+
+		w := request(mux, http.MethodPost, target, url.Values{"rev": {rev(board)}, "List": {todo}, "Position": {"2"}})
+		checkStatus(t, w, http.StatusOK)
+		board = checkBoard(t, boards, board.ID, "Doing: d", "Done:", "Todo: a b c")
+
+		// Moving a card out of a list closes the gap it leaves, so cards
+		// added after still go on the end.
+		w = request(mux, http.MethodPost, target, url.Values{"rev": {rev(board)}, "Card": {a}, "ToList": {doing}, "Position": {"0"}})
+		checkStatus(t, w, http.StatusOK)
+		board = checkBoard(t, boards, board.ID, "Doing: a d", "Done:", "Todo: b c")
+
+		board, err := boards.AddCard(ctx, board.ID, board.Revision, todo, "e")
+		if err != nil {
+			t.Fatal(err)
+		}
+		board = checkBoard(t, boards, board.ID, "Doing: a d", "Done:", "Todo: b c e")
+
+		// Cards move within their list, or to the end of a list without a
+		// position.
+		w = request(mux, http.MethodPost, target, url.Values{"rev": {rev(board)}, "Card": {b}, "ToList": {todo}, "Position": {"2"}})
+		checkStatus(t, w, http.StatusOK)
+		board = checkBoard(t, boards, board.ID, "Doing: a d", "Done:", "Todo: c e b")
+
+		w = request(mux, http.MethodPost, target, url.Values{"rev": {rev(board)}, "Card": {b}, "ToList": {done}})
+		checkStatus(t, w, http.StatusOK)
+		board = checkBoard(t, boards, board.ID, "Doing: a d", "Done: b", "Todo: c e")
+
+		bad := []struct {
+			name string
+			form url.Values
+			want int
+		}{
+			{"list past the end", url.Values{"List": {todo}, "Position": {"3"}}, http.StatusBadRequest},
+			{"list without a position", url.Values{"List": {todo}}, http.StatusBadRequest},
+			{"negative position", url.Values{"List": {todo}, "Position": {"-1"}}, http.StatusBadRequest},
+			{"position that isn't a number", url.Values{"List": {todo}, "Position": {"first"}}, http.StatusBadRequest},
+			{"card past the end", url.Values{"Card": {a}, "ToList": {done}, "Position": {"2"}}, http.StatusBadRequest},
+			{"card past the end of it's list", url.Values{"Card": {a}, "ToList": {doing}, "Position": {"2"}}, http.StatusBadRequest},
+			{"unknown list", url.Values{"List": {"nope"}, "Position": {"0"}}, http.StatusNotFound},
+			{"unknown card", url.Values{"Card": {"nope"}, "ToList": {done}}, http.StatusNotFound},
+			{"card to unknown list", url.Values{"Card": {a}, "ToList": {"nope"}}, http.StatusNotFound},
+		}
+		for _, tt := range bad {
+			t.Run(tt.name, func(t *testing.T) {
+				tt.form.Set("rev", rev(board))
+				checkStatus(t, request(mux, http.MethodPost, target, tt.form), tt.want)
+			})
+		}
+
+		w = request(mux, http.MethodPost, target, url.Values{"List": {todo}, "Position": {"0"}})
+		checkStatus(t, w, http.StatusBadRequest)
+
+		stale := strconv.FormatInt(board.Revision-1, 10)
+		checkConflict(t, request(mux, http.MethodPost, target, url.Values{"rev": {stale}, "List": {todo}, "Position": {"0"}}))
+		checkConflict(t, request(mux, http.MethodPost, target, url.Values{"rev": {stale}, "Card": {a}, "ToList": {done}}))
+
+		// Nothing that failed changed the board.
+		if got := checkBoard(t, boards, board.ID, "Doing: a d", "Done: b", "Todo: c e"); got.Revision != board.Revision {
+			t.Errorf("board is at revision %d, want %d", got.Revision, board.Revision)
+		}
+	})
+}
@@ -0,0 +1,392 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/a-h/templ"
+	docdb "github.com/limeleaf-coop/knbn/pkg/db"
+	"github.com/limeleaf-coop/knbn/templs"
+)
+
+// invitationExpiry is how long an invitation link works for.
+const invitationExpiry = 7 * 24 * time.Hour
+
+const invitationBody = `Hi,
+
+%s invited you to %s on knbn. Follow this link to accept:
+
+%s
+
+The invitation expires in %d days. If you weren't expecting it you can ignore
+this email.
+`
+
+// errInviteNeeded is returned when an account can't be added to a workspace
+// or board by email because there is no account for the email, or it isn't in
+// the workspace, so it has to be invited instead.
+var errInviteNeeded = errors.New("invitation needed")
+
+// invitationDoc is saved in the invitations collection under the hash of the
+// token sent in the invitation link, like sign in tokens. Invitations to a
+// board put whoever accepts them in it's workspace too.
+type invitationDoc struct {
+	Email         string
+	WorkspaceID   string
+	WorkspaceRole templs.WorkspaceRole
+	BoardID       string
+	BoardRole     templs.Role
+	InvitedBy     string
+
+	// Expires is a Unix time so expired invitations can be queried for.
+	Expires int64
+}
+
+// Invitations emails links that put whoever follows them in a workspace, or on
+// a board, creating an account for them if they don't have one yet.
+type Invitations struct {
+	db      *docdb.Database
+	baseURL string
+}
+
+func NewInvitations(db *docdb.Database, baseURL string) *Invitations {
+	return &Invitations{db: db, baseURL: baseURL}
+}
+
+// InviteToWorkspace emails an invitation to join the workspace with role.
+func (i *Invitations) InviteToWorkspace(ctx context.Context, workspaceId string, email string, role templs.WorkspaceRole, inviter templs.Account) error {
+	if !slices.Contains(templs.WorkspaceRoles, role) {
+		return fmt.Errorf("%w: invalid role %q", errBadRequest, role)
+	}
+
+	return i.invite(ctx, invitationDoc{Email: email, WorkspaceID: workspaceId, WorkspaceRole: role, InvitedBy: inviter.ID}, inviter)
+}
+
+// InviteToBoard emails an invitation to join the board with role, and it's
+// workspace as a member. Since that brings someone new into the workspace
+// only the workspace's admins can invite to a board.
+func (i *Invitations) InviteToBoard(ctx context.Context, boardId string, email string, role templs.Role, inviter templs.Account) error {
+	if !slices.Contains(templs.Roles, role) {
+		return fmt.Errorf("%w: invalid role %q", errBadRequest, role)
+	}
+
+	return i.invite(ctx, invitationDoc{Email: email, WorkspaceRole: templs.WorkspaceRoleMember, BoardID: boardId, BoardRole: role, InvitedBy: inviter.ID}, inviter)
+}
+
+// invite saves invitation under a new token and queues the email with it's
+// link, replacing any invitation the email already has to the same workspace
+// or board.
+func (i *Invitations) invite(ctx context.Context, invitation invitationDoc, inviter templs.Account) error {
+	invitation.Email = normalizeEmail(invitation.Email)
+	if !strings.Contains(invitation.Email, "@") {
+		return fmt.Errorf("%w: %q isn't an email address", errBadRequest, invitation.Email)
+	}
+
+	return i.db.RunInTx(ctx, func(tx *docdb.Tx) error {
+		if invitation.BoardID != "" {
+			workspaceId, err := boardWorkspace(ctx, tx.Collection("boards"), invitation.BoardID)
+			if err != nil {
+				return err
+			}
+			invitation.WorkspaceID = workspaceId
+
+			switch role, err := workspaceRole(ctx, tx.Collection("workspace_members"), workspaceId, inviter.ID); {
+			case err != nil:
+				return err
+			case role != templs.WorkspaceRoleAdmin:
+				return fmt.Errorf("%w: only workspace admins can invite people from outside the workspace", errForbidden)
+			}
+		}
+
+		target, err := invitationTarget(ctx, tx, invitation)
+		if err != nil {
+			return err
+		}
+
+		invitations := tx.Collection("invitations")
+		if err := deleteExpired(ctx, invitations); err != nil {
+			return err
+		}
+
+		pending, err := invitations.Where("$.Email", docdb.OpEqual, invitation.Email).And("$.WorkspaceID", docdb.OpEqual, invitation.WorkspaceID).And("$.BoardID", docdb.OpEqual, invitation.BoardID).Documents(ctx)
+		if err != nil {
+			return err
+		}
+		for _, doc := range pending {
+			if err := doc.Delete(ctx); err != nil {
+				return err
+			}
+		}
+
+		token := newToken()
+		invitation.Expires = time.Now().Add(invitationExpiry).Unix()
+		if err := invitations.Document(hashToken(token)).Create(ctx, &invitation); err != nil {
+			return err
+		}
+
+		return queueMail(ctx, tx, Message{
+			To:      invitation.Email,
+			Subject: "You're invited to " + target,
+			Body:    fmt.Sprintf(invitationBody, inviter.Email, target, i.baseURL+"/invitations/"+token, int(invitationExpiry.Hours()/24)),
+		}, time.Unix(invitation.Expires, 0))
+	})
+}
+
+// invitationTarget describes what invitation is to, by name, for it's email.
+func invitationTarget(ctx context.Context, tx *docdb.Tx, invitation invitationDoc) (string, error) {
+	var workspace workspaceDoc
+	if err := tx.Collection("workspaces").Document(invitation.WorkspaceID).Get(ctx, &workspace); err != nil {
+		return "", err
+	}
+	if invitation.BoardID == "" {
+		return fmt.Sprintf("the %s workspace", workspace.Name), nil
+	}
+
+	var board templs.Board
+	if err := tx.Collection("boards").Document(invitation.BoardID).Get(ctx, &board); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("the %s board in the %s workspace", board.Title, workspace.Name), nil
+}
+
+// Pending returns the invitations to the board that haven't been accepted or
+// expired yet, or to the workspace itself if boardId is empty.
+func (i *Invitations) Pending(ctx context.Context, workspaceId string, boardId string) ([]templs.Invitation, error) {
+	query := i.db.Collection("invitations").Where("$.BoardID", docdb.OpEqual, boardId).And("$.Expires", docdb.OpGreaterThan, time.Now().Unix())
+	if workspaceId != "" {
+		query = query.And("$.WorkspaceID", docdb.OpEqual, workspaceId)
+	}
+
+	docs, err := query.OrderBy("$.Email", docdb.Asc).Documents(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	pending := make([]templs.Invitation, len(docs))
+	for idx, doc := range docs {
+		var invitation invitationDoc
+		if err := doc.DataTo(&invitation); err != nil {
+			return nil, err
+		}
+
+		pending[idx] = templs.Invitation{
+			ID:      doc.ID,
+			Email:   invitation.Email,
+			Role:    string(invitation.WorkspaceRole),
+			Expires: time.Unix(invitation.Expires, 0),
+		}
+		if invitation.BoardID != "" {
+			pending[idx].Role = string(invitation.BoardRole)
+		}
+	}
+
+	return pending, nil
+}
+
+// Revoke deletes the invitation with the ID invitationId, as long as it's to
+// the board, or to the workspace itself if boardId is empty, so the link in
+// it's email stops working.
+func (i *Invitations) Revoke(ctx context.Context, invitationId string, workspaceId string, boardId string) error {
+	return i.db.RunInTx(ctx, func(tx *docdb.Tx) error {
+		var invitation invitationDoc
+		doc := tx.Collection("invitations").Document(invitationId)
+		if err := doc.Get(ctx, &invitation); err != nil {
+			if errors.Is(err, docdb.ErrNotFound) {
+				return fmt.Errorf("%w: the invitation was already accepted or cancelled", errNotFound)
+			}
+			return err
+		}
+		if invitation.BoardID != boardId || (workspaceId != "" && invitation.WorkspaceID != workspaceId) {
+			return fmt.Errorf("%w: the invitation was already accepted or cancelled", errNotFound)
+		}
+
+		return doc.Delete(ctx)
+	})
+}
+
+// accept puts the account with the invitation's email in it's workspace, and
+// on it's board, within tx, creating the account first if there isn't one.
+// Accounts keep their role if it's already higher than the invitation's. It
+// returns the account's ID, or an empty ID if the board has since been
+// deleted, and whether the account was created.
+func accept(ctx context.Context, tx *docdb.Tx, invitation invitationDoc) (string, bool, error) {
+	if invitation.BoardID != "" {
+		if _, err := boardWorkspace(ctx, tx.Collection("boards"), invitation.BoardID); err != nil {
+			if errors.Is(err, docdb.ErrNotFound) {
+				return "", false, nil
+			}
+			return "", false, err
+		}
+	}
+
+	email := normalizeEmail(invitation.Email)
+
+	var accountId string
+	accounts, err := tx.Collection("accounts").Query(ctx, "$.Email", docdb.OpEqual, email)
+	if err != nil {
+		return "", false, err
+	}
+	created := len(accounts) == 0
+	if created {
+		accountId = docdb.NewID()
+		if err := tx.Collection("accounts").Document(accountId).Create(ctx, &templs.Account{Email: email}); err != nil {
+			return "", false, err
+		}
+	} else {
+		accountId = accounts[0].ID
+	}
+
+	role, err := workspaceRole(ctx, tx.Collection("workspace_members"), invitation.WorkspaceID, accountId)
+	if err != nil {
+		return "", false, err
+	}
+	if role != templs.WorkspaceRoleAdmin {
+		if err := setWorkspaceMember(ctx, tx, invitation.WorkspaceID, accountId, invitation.WorkspaceRole); err != nil {
+			return "", false, err
+		}
+	}
+
+	if invitation.BoardID == "" {
+		return accountId, created, nil
+	}
+
+	var member memberDoc
+	if err := tx.Collection("members").Document(memberID(invitation.BoardID, accountId)).Get(ctx, &member); err != nil && !errors.Is(err, docdb.ErrNotFound) {
+		return "", false, err
+	}
+	if !member.Role.Can(invitation.BoardRole) {
+		if err := setMember(ctx, tx, invitation.BoardID, accountId, invitation.BoardRole); err != nil {
+			return "", false, err
+		}
+	}
+
+	return accountId, created, nil
+}
+
+// InvitationHandler shows what the invitation in a link is to, so it's only
+// accepted when asked to and not by whatever opens links in email first.
+func InvitationHandler(db *docdb.Database) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var invitation templs.Invitation
+		err := db.RunInTx(r.Context(), func(tx *docdb.Tx) error {
+			var doc invitationDoc
+			if err := tx.Collection("invitations").Document(hashToken(r.PathValue("token"))).Get(r.Context(), &doc); err != nil {
+				return err
+			}
+			if time.Now().Unix() >= doc.Expires {
+				return docdb.ErrNotFound
+			}
+
+			var workspace workspaceDoc
+			if err := tx.Collection("workspaces").Document(doc.WorkspaceID).Get(r.Context(), &workspace); err != nil {
+				return err
+			}
+			invitation = templs.Invitation{Email: doc.Email, Role: string(doc.WorkspaceRole), Workspace: workspace.Name, Expires: time.Unix(doc.Expires, 0)}
+
+			if doc.BoardID != "" {
+				var board templs.Board
+				if err := tx.Collection("boards").Document(doc.BoardID).Get(r.Context(), &board); err != nil {
+					return err
+				}
+				invitation.Board = board.Title
+				invitation.Role = string(doc.BoardRole)
+			}
+
+			var inviter templs.Account
+			if err := tx.Collection("accounts").Document(doc.InvitedBy).Get(r.Context(), &inviter); err != nil && !errors.Is(err, docdb.ErrNotFound) {
+				return err
+			}
+			invitation.InvitedBy = inviter.Email
+
+			return nil
+		})
+		if errors.Is(err, docdb.ErrNotFound) {
+			t := templs.InvitationExpiredPage()
+			templ.Handler(t, templ.WithStatus(http.StatusNotFound)).ServeHTTP(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		t := templs.InvitationPage(r.PathValue("token"), invitation)
+		templ.Handler(t).ServeHTTP(w, r)
+	}
+}
+
+// AcceptInvitationHandler accepts the invitation in a link. Accounts created
+// by accepting it are signed in, since following the link proves the email is
+// theirs like a sign in link does. Accounts that already existed have to sign
+// in as usual, unless this browser already is, so an invitation can't be used
+// to get into someone's account. The invitation is deleted either way so it
+// can only be used once.
+func AcceptInvitationHandler(db *docdb.Database, sessions *Sessions) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var invitation invitationDoc
+		var accountId, sessionId string
+		var expires time.Time
+		err := db.RunInTx(r.Context(), func(tx *docdb.Tx) error {
+			accountId, sessionId = "", ""
+
+			doc := tx.Collection("invitations").Document(hashToken(r.PathValue("token")))
+			if err := doc.Get(r.Context(), &invitation); err != nil {
+				return err
+			}
+			if err := doc.Delete(r.Context()); err != nil {
+				return err
+			}
+
+			if time.Now().Unix() >= invitation.Expires {
+				return nil
+			}
+
+			var created bool
+			var err error
+			accountId, created, err = accept(r.Context(), tx, invitation)
+			if err != nil || !created {
+				return err
+			}
+
+			sessionId, expires, err = sessions.create(r.Context(), tx, accountId, invitation.WorkspaceID)
+			return err
+		})
+		if err != nil && !errors.Is(err, docdb.ErrNotFound) {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if accountId == "" {
+			t := templs.InvitationExpiredPage()
+			templ.Handler(t, templ.WithStatus(http.StatusNotFound)).ServeHTTP(w, r)
+			return
+		}
+
+		if sessionId != "" {
+			setCookie(w, sessionId, expires)
+		} else {
+			session, err := sessions.Get(w, r)
+			if err != nil || session.AccountID != accountId {
+				t := templs.InvitationAcceptedPage(normalizeEmail(invitation.Email))
+				templ.Handler(t).ServeHTTP(w, r)
+				return
+			}
+			if err := sessions.SetWorkspace(r.Context(), session.ID, invitation.WorkspaceID); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		if invitation.BoardID != "" {
+			metaRefresh(w, "/boards/"+invitation.BoardID)
+			return
+		}
+		metaRefresh(w, "/boards")
+	}
+}
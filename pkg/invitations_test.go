@@ -0,0 +1,176 @@
+package pkg_test
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/limeleaf-coop/knbn/pkg"
+	docdb "github.com/limeleaf-coop/knbn/pkg/db"
+	"github.com/limeleaf-coop/knbn/templs"
+)
+
+func TestAcceptInvitation(t *testing.T) {
+	ctx := context.Background()
+
+	db := openTestDB(t)
+	sessions := pkg.NewSessions(db)
+	workspaces := pkg.NewWorkspaces(db)
+	members := pkg.NewMembers(db)
+	invitations := pkg.NewInvitations(db, baseURL)
+	acceptInvitation := pkg.AcceptInvitationHandler(db, sessions)
+	boards := pkg.NewEmbeddedStore(db)
+	if err := boards.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	admin := createAccount(t, db, "admin@example.com")
+	workspace, err := workspaces.Create(ctx, admin.ID, "Acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	board, err := boards.CreateBoard(ctx, workspace.ID, "Roadmap", admin.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// accept follows the invitation mailed to the email, sending cookie if it
+	// isn't nil.
+	accept := func(t *testing.T, email string, cookie *http.Cookie) (string, *http.Cookie, string) {
+		t.Helper()
+
+		token := mailedToken(t, db, email, "/invitations/")
+		clearOutbox(t, db)
+
+		w := serve(acceptInvitation, http.MethodPost, "/invitations/"+token, nil, "token", token, cookie)
+		if w.Code != http.StatusOK {
+			t.Fatalf("accepting got status %d, want %d", w.Code, http.StatusOK)
+		}
+
+		return token, sessionCookie(w), w.Body.String()
+	}
+
+	// inWorkspace returns the role of the account with the email in the
+	// workspace.
+	inWorkspace := func(t *testing.T, email string) templs.WorkspaceRole {
+		t.Helper()
+
+		docs, err := db.Collection("accounts").Query(ctx, "$.Email", docdb.OpEqual, email)
+		if err != nil || len(docs) != 1 {
+			t.Fatalf("got %d accounts for %s, %v, want 1", len(docs), email, err)
+		}
+
+		in, err := workspaces.ForAccount(ctx, docs[0].ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, w := range in {
+			if w.ID == workspace.ID {
+				return w.Role
+			}
+		}
+
+		return ""
+	}
+
+	t.Run("new account", func(t *testing.T) {
+		if err := invitations.InviteToWorkspace(ctx, workspace.ID, "New@Example.com", templs.WorkspaceRoleMember, admin); err != nil {
+			t.Fatal(err)
+		}
+
+		token, cookie, _ := accept(t, "new@example.com", nil)
+		if cookie == nil || cookie.Value == "" {
+			t.Fatal("new account wasn't signed in")
+		}
+		if role := inWorkspace(t, "new@example.com"); role != templs.WorkspaceRoleMember {
+			t.Errorf("new account's role is %q, want %q", role, templs.WorkspaceRoleMember)
+		}
+
+		// The session works in the workspace the invitation was to.
+		handler := sessions.RequireAccount(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(pkg.CurrentSession(r.Context()).WorkspaceID))
+		})
+		if w := serveAs(handler, cookie, true); w.Body.String() != workspace.ID {
+			t.Errorf("session is working in %q, want %q", w.Body.String(), workspace.ID)
+		}
+
+		w := serve(acceptInvitation, http.MethodPost, "/invitations/"+token, nil, "token", token, nil)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("second use got status %d, want %d", w.Code, http.StatusNotFound)
+		}
+	})
+
+	t.Run("existing account", func(t *testing.T) {
+		bob := createAccount(t, db, "bob@example.com")
+		if err := invitations.InviteToBoard(ctx, board.ID, bob.Email, templs.RoleEditor, admin); err != nil {
+			t.Fatal(err)
+		}
+
+		_, cookie, body := accept(t, bob.Email, nil)
+		if cookie != nil {
+			t.Error("accepting signed in an existing account")
+		}
+		if !strings.Contains(body, bob.Email) {
+			t.Errorf("got %q, want the page asking %s to sign in", body, bob.Email)
+		}
+		if role := inWorkspace(t, bob.Email); role != templs.WorkspaceRoleMember {
+			t.Errorf("existing account's role is %q, want %q", role, templs.WorkspaceRoleMember)
+		}
+		if role, err := members.Role(ctx, board.ID, bob.ID); err != nil || role != templs.RoleEditor {
+			t.Errorf("existing account's board role is %q, %v, want %q", role, err, templs.RoleEditor)
+		}
+	})
+
+	t.Run("existing account signed in", func(t *testing.T) {
+		carol := createAccount(t, db, "carol@example.com")
+		own := signIn(t, db, sessions, carol.Email)
+		if err := invitations.InviteToBoard(ctx, board.ID, carol.Email, templs.RoleViewer, admin); err != nil {
+			t.Fatal(err)
+		}
+
+		_, cookie, body := accept(t, carol.Email, own)
+		if cookie != nil {
+			t.Error("accepting made a new session")
+		}
+		if !strings.Contains(body, "/boards/"+board.ID) {
+			t.Errorf("got %q, want a redirect to the board", body)
+		}
+		if role, err := members.Role(ctx, board.ID, carol.ID); err != nil || role != templs.RoleViewer {
+			t.Errorf("board role is %q, %v, want %q", role, err, templs.RoleViewer)
+		}
+	})
+
+	t.Run("existing account signed in as someone else", func(t *testing.T) {
+		dave := createAccount(t, db, "dave@example.com")
+		other := signIn(t, db, sessions, admin.Email)
+		if err := invitations.InviteToWorkspace(ctx, workspace.ID, dave.Email, templs.WorkspaceRoleAdmin, admin); err != nil {
+			t.Fatal(err)
+		}
+
+		_, cookie, body := accept(t, dave.Email, other)
+		if cookie != nil {
+			t.Error("accepting made a new session")
+		}
+		if !strings.Contains(body, dave.Email) {
+			t.Errorf("got %q, want the page asking %s to sign in", body, dave.Email)
+		}
+		if role := inWorkspace(t, dave.Email); role != templs.WorkspaceRoleAdmin {
+			t.Errorf("role is %q, want %q", role, templs.WorkspaceRoleAdmin)
+		}
+	})
+
+	t.Run("only admins invite to boards", func(t *testing.T) {
+		frank := createAccount(t, db, "frank@example.com")
+		if err := workspaces.SetByEmail(ctx, workspace.ID, frank.Email, templs.WorkspaceRoleMember); err != nil {
+			t.Fatal(err)
+		}
+		if err := members.Set(ctx, board.ID, frank.ID, templs.RoleOwner); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := invitations.InviteToBoard(ctx, board.ID, "erin@example.com", templs.RoleViewer, frank); err == nil {
+			t.Error("a board owner who isn't a workspace admin invited someone to the board")
+		}
+	})
+}
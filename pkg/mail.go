@@ -0,0 +1,132 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	docdb "github.com/limeleaf-coop/knbn/pkg/db"
+)
+
+// Message is a plain text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// format encodes the message with it's headers ready to be sent from the
+// address from. Headers can't contain line breaks so an address taken from a
+// form can't add headers of it's own.
+func (msg Message) format(from string) ([]byte, error) {
+	for _, header := range []string{from, msg.To, msg.Subject} {
+		if strings.ContainsAny(header, "\r\n") {
+			return nil, errors.New("email headers can not contain line breaks")
+		}
+	}
+
+	buf := bytes.NewBuffer(nil)
+	fmt.Fprintf(buf, "From: %s\r\n", from)
+	fmt.Fprintf(buf, "To: %s\r\n", msg.To)
+	fmt.Fprintf(buf, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprint(buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprint(buf, "Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	fmt.Fprint(buf, strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+
+	return buf.Bytes(), nil
+}
+
+// Mailer delivers email. Messages are queued in the outbox with queueMail
+// rather than sent directly, and Outbox delivers them through a Mailer.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// SMTPMailer sends email through an SMTP server.
+type SMTPMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+// NewSMTPMailer sends email from the address from through the SMTP server at
+// addr, authenticating with username and password unless username is empty.
+func NewSMTPMailer(addr string, from string, username string, password string) (*SMTPMailer, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &SMTPMailer{addr: addr, from: from}
+	if username != "" {
+		m.auth = smtp.PlainAuth("", username, password, host)
+	}
+
+	return m, nil
+}
+
+func (m *SMTPMailer) Send(ctx context.Context, msg Message) error {
+	data, err := msg.format(m.from)
+	if err != nil {
+		return err
+	}
+
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{msg.To}, data)
+}
+
+// FileMailer writes each email to a file in a directory instead of sending
+// it, for developing without an SMTP server.
+type FileMailer struct {
+	dir  string
+	from string
+}
+
+func NewFileMailer(dir string, from string) (*FileMailer, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	return &FileMailer{dir: dir, from: from}, nil
+}
+
+func (m *FileMailer) Send(ctx context.Context, msg Message) error {
+	data, err := msg.format(m.from)
+	if err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%s-%s.eml", time.Now().Format("20060102T150405"), docdb.NewID())
+	if err := os.WriteFile(filepath.Join(m.dir, name), data, 0o644); err != nil {
+		return err
+	}
+
+	slog.Info("wrote email", "to", msg.To, "subject", msg.Subject, "file", name)
+
+	return nil
+}
+
+// LogMailer logs who each email is to and it's subject instead of sending it,
+// for developing without an SMTP server. The body holds live sign in and
+// invitation links, so it's only logged as well if Body is true.
+type LogMailer struct {
+	Body bool
+}
+
+func (m LogMailer) Send(ctx context.Context, msg Message) error {
+	if m.Body {
+		slog.Info("email", "to", msg.To, "subject", msg.Subject, "body", msg.Body)
+		return nil
+	}
+
+	slog.Info("email", "to", msg.To, "subject", msg.Subject)
+	return nil
+}
@@ -0,0 +1,33 @@
+package pkg_test
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/limeleaf-coop/knbn/pkg"
+)
+
+func TestLogMailer(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+
+	msg := pkg.Message{To: "alice@example.com", Subject: "Sign in to knbn", Body: "https://knbn.test/sign-in/secret"}
+
+	for _, body := range []bool{false, true} {
+		var buf bytes.Buffer
+		slog.SetDefault(slog.New(slog.NewTextHandler(&buf, nil)))
+
+		if err := (pkg.LogMailer{Body: body}).Send(context.Background(), msg); err != nil {
+			t.Fatal(err)
+		}
+
+		if !strings.Contains(buf.String(), msg.To) {
+			t.Errorf("log %q doesn't say who the email is to", buf.String())
+		}
+		if logged := strings.Contains(buf.String(), "secret"); logged != body {
+			t.Errorf("with Body %v the link was logged = %v", body, logged)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	docdb "github.com/limeleaf-coop/knbn/pkg/db"
+	"github.com/limeleaf-coop/knbn/templs"
+)
+
+var errForbidden = errors.New("forbidden")
+
+// memberDoc is saved in the members collection under memberID, so an account
+// can only be a member of a board once.
+type memberDoc struct {
+	BoardID   string
+	AccountID string
+	Role      templs.Role
+}
+
+func memberID(boardId string, accountId string) string {
+	return boardId + "." + accountId
+}
+
+// Members keeps track of which accounts can see and edit which boards.
+type Members struct {
+	db *docdb.Database
+}
+
+func NewMembers(db *docdb.Database) *Members {
+	return &Members{db: db}
+}
+
+// Role returns the role of the account on the board, or an empty role if it
+// isn't a member. Only accounts in the board's workspace have a role on it,
+// and the workspace's admins own every board in it.
+func (m *Members) Role(ctx context.Context, boardId string, accountId string) (templs.Role, error) {
+	workspaceId, err := boardWorkspace(ctx, m.db.Collection("boards"), boardId)
+	if err != nil {
+		if errors.Is(err, docdb.ErrNotFound) {
+			return "", nil
+		}
+		return "", err
+	}
+
+	switch role, err := workspaceRole(ctx, m.db.Collection("workspace_members"), workspaceId, accountId); {
+	case err != nil:
+		return "", err
+	case role == "":
+		return "", nil
+	case role == templs.WorkspaceRoleAdmin:
+		return templs.RoleOwner, nil
+	}
+
+	var member memberDoc
+	if err := m.db.Collection("members").Document(memberID(boardId, accountId)).Get(ctx, &member); err != nil {
+		if errors.Is(err, docdb.ErrNotFound) {
+			return "", nil
+		}
+		return "", err
+	}
+
+	return member.Role, nil
+}
+
+// Boards returns the role of the account on every board it's a member of by
+// the board's ID.
+func (m *Members) Boards(ctx context.Context, accountId string) (map[string]templs.Role, error) {
+	docs, err := m.db.Collection("members").Query(ctx, "$.AccountID", docdb.OpEqual, accountId)
+	if err != nil {
+		return nil, err
+	}
+
+	roles := make(map[string]templs.Role, len(docs))
+	for _, doc := range docs {
+		var member memberDoc
+		if err := doc.DataTo(&member); err != nil {
+			return nil, err
+		}
+
+		roles[member.BoardID] = member.Role
+	}
+
+	return roles, nil
+}
+
+// List returns the members of a board ordered by email.
+func (m *Members) List(ctx context.Context, boardId string) ([]templs.Member, error) {
+	docs, err := m.db.Collection("members").Query(ctx, "$.BoardID", docdb.OpEqual, boardId)
+	if err != nil {
+		return nil, err
+	}
+
+	members := make([]templs.Member, 0, len(docs))
+	for _, doc := range docs {
+		var member memberDoc
+		if err := doc.DataTo(&member); err != nil {
+			return nil, err
+		}
+
+		var account templs.Account
+		if err := m.db.Collection("accounts").Document(member.AccountID).Get(ctx, &account); err != nil {
+			if errors.Is(err, docdb.ErrNotFound) {
+				continue
+			}
+			return nil, err
+		}
+		account.ID = member.AccountID
+
+		members = append(members, templs.Member{Account: account, Role: member.Role})
+	}
+
+	slices.SortFunc(members, func(a, b templs.Member) int {
+		return strings.Compare(a.Account.Email, b.Account.Email)
+	})
+
+	return members, nil
+}
+
+// Set makes the account a member of the board with role, or changes it's
+// role if it already is one.
+func (m *Members) Set(ctx context.Context, boardId string, accountId string, role templs.Role) error {
+	return m.db.RunInTx(ctx, func(tx *docdb.Tx) error {
+		return setMember(ctx, tx, boardId, accountId, role)
+	})
+}
+
+// SetByEmail is Set for the account with the email. It fails with
+// errInviteNeeded if there is no account for the email or it isn't in the
+// board's workspace.
+func (m *Members) SetByEmail(ctx context.Context, boardId string, email string, role templs.Role) error {
+	email = normalizeEmail(email)
+
+	return m.db.RunInTx(ctx, func(tx *docdb.Tx) error {
+		accounts, err := tx.Collection("accounts").Query(ctx, "$.Email", docdb.OpEqual, email)
+		if err != nil {
+			return err
+		}
+		if len(accounts) == 0 {
+			return fmt.Errorf("%w: there's no account for %s", errInviteNeeded, email)
+		}
+
+		workspaceId, err := boardWorkspace(ctx, tx.Collection("boards"), boardId)
+		if err != nil {
+			return err
+		}
+		switch role, err := workspaceRole(ctx, tx.Collection("workspace_members"), workspaceId, accounts[0].ID); {
+		case err != nil:
+			return err
+		case role == "":
+			return fmt.Errorf("%w: %s isn't in this board's workspace", errInviteNeeded, email)
+		}
+
+		return setMember(ctx, tx, boardId, accounts[0].ID, role)
+	})
+}
+
+// Remove takes the account off the board.
+func (m *Members) Remove(ctx context.Context, boardId string, accountId string) error {
+	return m.db.RunInTx(ctx, func(tx *docdb.Tx) error {
+		if err := keepOwner(ctx, tx, boardId, accountId); err != nil {
+			return err
+		}
+
+		return tx.Collection("members").Document(memberID(boardId, accountId)).Delete(ctx)
+	})
+}
+
+// removeMembers takes every member off a board that is being deleted within
+// tx.
+func removeMembers(ctx context.Context, tx *docdb.Tx, boardId string) error {
+	docs, err := tx.Collection("members").Query(ctx, "$.BoardID", docdb.OpEqual, boardId)
+	if err != nil {
+		return err
+	}
+
+	for _, doc := range docs {
+		if err := doc.Delete(ctx); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// setMember saves the account's role on the board within tx.
+func setMember(ctx context.Context, tx *docdb.Tx, boardId string, accountId string, role templs.Role) error {
+	if !slices.Contains(templs.Roles, role) {
+		return fmt.Errorf("%w: invalid role %q", errBadRequest, role)
+	}
+	if role != templs.RoleOwner {
+		if err := keepOwner(ctx, tx, boardId, accountId); err != nil {
+			return err
+		}
+	}
+
+	member := memberDoc{BoardID: boardId, AccountID: accountId, Role: role}
+	doc := tx.Collection("members").Document(memberID(boardId, accountId))
+
+	err := doc.Create(ctx, &member)
+	if errors.Is(err, docdb.ErrDuplicate) {
+		return doc.Set(ctx, &member)
+	}
+
+	return err
+}
+
+// keepOwner fails if the account is the last owner of the board, so boards
+// can't be left without anyone to manage them.
+func keepOwner(ctx context.Context, tx *docdb.Tx, boardId string, accountId string) error {
+	docs, err := tx.Collection("members").Where("$.BoardID", docdb.OpEqual, boardId).And("$.Role", docdb.OpEqual, string(templs.RoleOwner)).Documents(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(docs) == 1 && docs[0].ID == memberID(boardId, accountId) {
+		return fmt.Errorf("%w: a board needs at least one owner", errBadRequest)
+	}
+
+	return nil
+}
+
+// Require only calls next for members of the board in the request's path with
+// at least the role min, which it puts on the request's context for
+// CurrentRole. Boards the account isn't a member of are not found rather than
+// forbidden so nobody can find out which boards exist. It must be wrapped by
+// RequireAccount.
+func (m *Members) Require(min templs.Role) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			boardId := r.PathValue("boardId")
+
+			role, err := m.Role(r.Context(), boardId, CurrentAccount(r.Context()).ID)
+			switch {
+			case err != nil:
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			case role == "":
+				http.Error(w, fmt.Sprintf("%v: board %q", errNotFound, boardId), http.StatusNotFound)
+			case !role.Can(min):
+				http.Error(w, fmt.Sprintf("%v: %s can not do that", errForbidden, role), http.StatusForbidden)
+			default:
+				next(w, r.WithContext(context.WithValue(r.Context(), roleKey, role)))
+			}
+		}
+	}
+}
+
+// CurrentRole returns the role of the current account on the board of a
+// request wrapped by Require.
+func CurrentRole(ctx context.Context) templs.Role {
+	role, _ := ctx.Value(roleKey).(templs.Role)
+	return role
+}
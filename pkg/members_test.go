@@ -0,0 +1,151 @@
+package pkg_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/limeleaf-coop/knbn/pkg"
+	"github.com/limeleaf-coop/knbn/templs"
+)
+
+func TestRequire(t *testing.T) {
+	ctx := context.Background()
+
+	db := openTestDB(t)
+	sessions := pkg.NewSessions(db)
+	workspaces := pkg.NewWorkspaces(db)
+	members := pkg.NewMembers(db)
+	boards := pkg.NewEmbeddedStore(db)
+	if err := boards.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	admin := createAccount(t, db, "admin@example.com")
+	workspace, err := workspaces.Create(ctx, admin.ID, "Acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	emails := []string{"owner@example.com", "editor@example.com", "viewer@example.com", "member@example.com", "outsider@example.com"}
+	for _, email := range emails {
+		createAccount(t, db, email)
+	}
+	for _, email := range emails[:4] {
+		if err := workspaces.SetByEmail(ctx, workspace.ID, email, templs.WorkspaceRoleMember); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	board, err := boards.CreateBoard(ctx, workspace.ID, "Roadmap", admin.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for email, role := range map[string]templs.Role{"owner@example.com": templs.RoleOwner, "editor@example.com": templs.RoleEditor, "viewer@example.com": templs.RoleViewer} {
+		if err := members.SetByEmail(ctx, board.ID, email, role); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Outsiders can't be put on a board, even by email.
+	if err := members.SetByEmail(ctx, board.ID, "outsider@example.com", templs.RoleEditor); err == nil {
+		t.Error("put an account outside the workspace on a board")
+	}
+
+	handlers := make(map[templs.Role]http.HandlerFunc)
+	for _, min := range templs.Roles {
+		handlers[min] = sessions.RequireAccount(members.Require(min)(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(pkg.CurrentRole(r.Context())))
+		}))
+	}
+
+	tests := []struct {
+		email string
+		want  map[templs.Role]int
+	}{
+		{"admin@example.com", map[templs.Role]int{templs.RoleViewer: http.StatusOK, templs.RoleEditor: http.StatusOK, templs.RoleOwner: http.StatusOK}},
+		{"owner@example.com", map[templs.Role]int{templs.RoleViewer: http.StatusOK, templs.RoleEditor: http.StatusOK, templs.RoleOwner: http.StatusOK}},
+		{"editor@example.com", map[templs.Role]int{templs.RoleViewer: http.StatusOK, templs.RoleEditor: http.StatusOK, templs.RoleOwner: http.StatusForbidden}},
+		{"viewer@example.com", map[templs.Role]int{templs.RoleViewer: http.StatusOK, templs.RoleEditor: http.StatusForbidden, templs.RoleOwner: http.StatusForbidden}},
+		{"member@example.com", map[templs.Role]int{templs.RoleViewer: http.StatusNotFound, templs.RoleEditor: http.StatusNotFound, templs.RoleOwner: http.StatusNotFound}},
+		{"outsider@example.com", map[templs.Role]int{templs.RoleViewer: http.StatusNotFound, templs.RoleEditor: http.StatusNotFound, templs.RoleOwner: http.StatusNotFound}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.email, func(t *testing.T) {
+			cookie := signIn(t, db, sessions, tt.email)
+
+			for min, want := range tt.want {
+				w := serve(handlers[min], http.MethodGet, "/boards/"+board.ID, nil, "boardId", board.ID, cookie)
+				if w.Code != want {
+					t.Errorf("%s got status %d, want %d", min, w.Code, want)
+				}
+			}
+
+			w := serve(handlers[templs.RoleViewer], http.MethodGet, "/boards/missing", nil, "boardId", "missing", cookie)
+			if w.Code != http.StatusNotFound {
+				t.Errorf("missing board got status %d, want %d", w.Code, http.StatusNotFound)
+			}
+		})
+	}
+
+	// Admins own every board in their workspace without being members.
+	if role, err := members.Role(ctx, board.ID, admin.ID); err != nil || role != templs.RoleOwner {
+		t.Errorf("admin's role is %q, %v, want %q", role, err, templs.RoleOwner)
+	}
+}
+
+func TestKeepOwner(t *testing.T) {
+	ctx := context.Background()
+
+	db := openTestDB(t)
+	workspaces := pkg.NewWorkspaces(db)
+	members := pkg.NewMembers(db)
+	boards := pkg.NewEmbeddedStore(db)
+	if err := boards.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	admin := createAccount(t, db, "admin@example.com")
+	alice := createAccount(t, db, "alice@example.com")
+	bob := createAccount(t, db, "bob@example.com")
+
+	workspace, err := workspaces.Create(ctx, admin.ID, "Acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, email := range []string{alice.Email, bob.Email} {
+		if err := workspaces.SetByEmail(ctx, workspace.ID, email, templs.WorkspaceRoleMember); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	board, err := boards.CreateBoard(ctx, workspace.ID, "Roadmap", alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := members.Remove(ctx, board.ID, alice.ID); err == nil {
+		t.Error("removed the last owner")
+	}
+	if err := members.Set(ctx, board.ID, alice.ID, templs.RoleEditor); err == nil {
+		t.Error("demoted the last owner")
+	}
+	if role, _ := members.Role(ctx, board.ID, alice.ID); role != templs.RoleOwner {
+		t.Fatalf("last owner's role is %q, want %q", role, templs.RoleOwner)
+	}
+
+	// Once there's another owner the first can step down.
+	if err := members.Set(ctx, board.ID, bob.ID, templs.RoleOwner); err != nil {
+		t.Fatal(err)
+	}
+	if err := members.Set(ctx, board.ID, alice.ID, templs.RoleEditor); err != nil {
+		t.Errorf("couldn't demote an owner with another owner: %v", err)
+	}
+	if err := members.Remove(ctx, board.ID, bob.ID); err == nil {
+		t.Error("removed the new last owner")
+	}
+	if err := members.Remove(ctx, board.ID, alice.ID); err != nil {
+		t.Errorf("couldn't remove an editor: %v", err)
+	}
+}
@@ -0,0 +1,202 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+
+	docdb "github.com/limeleaf-coop/knbn/pkg/db"
+	"github.com/limeleaf-coop/knbn/templs"
+)
+
+// AssignIDs gives every list and card on every board an ID if it doesn't have
+// one yet. Boards saved before lists and cards had IDs, and seed data, only
+// have positions which change as soon as anything is moved.
+func AssignIDs(ctx context.Context, db *docdb.Database) error {
+	docs, err := db.Collection("boards").QueryAll(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, doc := range docs {
+		var board templs.Board
+		if err := doc.DataTo(&board); err != nil {
+			return err
+		}
+
+		assigned := false
+		for listIdx := range board.Lists {
+			list := &board.Lists[listIdx]
+			if list.ID == "" {
+				list.ID = docdb.NewID()
+				assigned = true
+			}
+
+			for cardIdx := range list.Cards {
+				if list.Cards[cardIdx].ID == "" {
+					list.Cards[cardIdx].ID = docdb.NewID()
+					assigned = true
+				}
+			}
+		}
+
+		if !assigned {
+			continue
+		}
+
+		if err := doc.SetIfRevision(ctx, &board, doc.Revision); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// NormalizeEmails saves the email of every account the way normalizeEmail
+// looks them up. Accounts whose email only differs by case from another
+// account's are left as they are, since they can't be merged automatically.
+func NormalizeEmails(ctx context.Context, db *docdb.Database) error {
+	docs, err := db.Collection("accounts").QueryAll(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, doc := range docs {
+		var account templs.Account
+		if err := doc.DataTo(&account); err != nil {
+			return err
+		}
+		email := normalizeEmail(account.Email)
+		if email == account.Email {
+			continue
+		}
+
+		patch, err := json.Marshal(map[string]any{"Email": email})
+		if err != nil {
+			return err
+		}
+		err = doc.Patch(ctx, docdb.MergePatch(patch))
+		if errors.Is(err, docdb.ErrDuplicate) {
+			slog.Warn("another account has the same email", "account", doc.ID, "email", email)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// AssignWorkspaces puts boards that aren't in a workspace, which every board
+// was before there were workspaces, in a new workspace called name. Every
+// account that is a member of one of them is put in it too, as an admin if it
+// owns one. Boards without any members, which every account could see and
+// edit before boards had members, are first given to every account that isn't
+// in a workspace yet as owners, so they never go to accounts from other
+// workspaces. Owning those boards doesn't make an account an admin of the
+// workspace, since every account owns them.
+func AssignWorkspaces(ctx context.Context, db *docdb.Database, name string) error {
+	return db.RunInTx(ctx, func(tx *docdb.Tx) error {
+		boards, err := tx.Collection("boards").QueryAll(ctx)
+		if err != nil {
+			return err
+		}
+
+		workspaceId := ""
+		var owners []string
+		roles := make(map[string]templs.WorkspaceRole)
+		for _, board := range boards {
+			var current struct {
+				WorkspaceID string
+			}
+			if err := board.DataTo(&current); err != nil {
+				return err
+			}
+			if current.WorkspaceID != "" {
+				continue
+			}
+
+			if workspaceId == "" {
+				// Look for accounts outside of every workspace before
+				// making the new one.
+				if owners, err = accountsWithoutWorkspace(ctx, tx); err != nil {
+					return err
+				}
+
+				workspaceId = docdb.NewID()
+				if err := tx.Collection("workspaces").Document(workspaceId).Create(ctx, &workspaceDoc{Name: name}); err != nil {
+					return err
+				}
+			}
+
+			patch, err := json.Marshal(map[string]any{"WorkspaceID": workspaceId})
+			if err != nil {
+				return err
+			}
+			if err := board.Patch(ctx, docdb.MergePatch(patch)); err != nil {
+				return err
+			}
+
+			members, err := tx.Collection("members").Query(ctx, "$.BoardID", docdb.OpEqual, board.ID)
+			if err != nil {
+				return err
+			}
+			if len(members) == 0 {
+				for _, accountId := range owners {
+					if err := setMember(ctx, tx, board.ID, accountId, templs.RoleOwner); err != nil {
+						return err
+					}
+					if roles[accountId] == "" {
+						roles[accountId] = templs.WorkspaceRoleMember
+					}
+				}
+			}
+
+			for _, doc := range members {
+				var member memberDoc
+				if err := doc.DataTo(&member); err != nil {
+					return err
+				}
+
+				if member.Role == templs.RoleOwner {
+					roles[member.AccountID] = templs.WorkspaceRoleAdmin
+				} else if roles[member.AccountID] == "" {
+					roles[member.AccountID] = templs.WorkspaceRoleMember
+				}
+			}
+		}
+
+		for accountId, role := range roles {
+			if err := setWorkspaceMember(ctx, tx, workspaceId, accountId, role); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// accountsWithoutWorkspace returns the IDs of every account that isn't a
+// member of any workspace, like every account made before there were
+// workspaces.
+func accountsWithoutWorkspace(ctx context.Context, tx *docdb.Tx) ([]string, error) {
+	accounts, err := tx.Collection("accounts").QueryAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(accounts))
+	for _, account := range accounts {
+		docs, err := tx.Collection("workspace_members").Query(ctx, "$.AccountID", docdb.OpEqual, account.ID)
+		if err != nil {
+			return nil, err
+		}
+		if len(docs) == 0 {
+			ids = append(ids, account.ID)
+		}
+	}
+
+	return ids, nil
+}
@@ -0,0 +1,148 @@
+package pkg_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/limeleaf-coop/knbn/pkg"
+	"github.com/limeleaf-coop/knbn/templs"
+)
+
+func TestAssignIDs(t *testing.T) {
+	ctx := context.Background()
+
+	db := openTestDB(t)
+
+	// Like seed data, only one card already has an ID.
+	seeded := templs.Board{ID: "ops", Title: "Ops", Lists: []templs.List{
+		{Title: "Todo", Cards: []templs.Card{{Title: "a"}, {ID: "kept", Title: "b"}}},
+		{Title: "Done", Cards: []templs.Card{{Title: "c"}}},
+	}}
+	if err := db.Collection("boards").Document("ops").Create(ctx, &seeded); err != nil {
+		t.Fatal(err)
+	}
+
+	// assign runs AssignIDs and returns the IDs of the lists and cards in
+	// order along with the board's revision.
+	assign := func(t *testing.T) ([]string, int64) {
+		t.Helper()
+
+		if err := pkg.AssignIDs(ctx, db); err != nil {
+			t.Fatal(err)
+		}
+
+		var board templs.Board
+		doc := db.Collection("boards").Document("ops")
+		if err := doc.Get(ctx, &board); err != nil {
+			t.Fatal(err)
+		}
+
+		var ids []string
+		for _, list := range board.Lists {
+			ids = append(ids, list.ID)
+			for _, card := range list.Cards {
+				ids = append(ids, card.ID)
+			}
+		}
+
+		return ids, doc.Revision
+	}
+
+	first, rev := assign(t)
+
+	seen := make(map[string]bool)
+	for _, id := range first {
+		if id == "" || seen[id] {
+			t.Errorf("IDs %q aren't all set and unique", first)
+			break
+		}
+		seen[id] = true
+	}
+	if len(first) != 5 || first[2] != "kept" {
+		t.Errorf("got IDs %q, want 5 keeping \"kept\"", first)
+	}
+
+	// Running again, like every startup does, leaves the board alone.
+	second, secondRev := assign(t)
+	if !reflect.DeepEqual(second, first) || secondRev != rev {
+		t.Errorf("second run changed IDs %q at revision %d to %q at %d", first, rev, second, secondRev)
+	}
+}
+
+func TestAssignWorkspaces(t *testing.T) {
+	ctx := context.Background()
+
+	db := openTestDB(t)
+	workspaces := pkg.NewWorkspaces(db)
+	members := pkg.NewMembers(db)
+
+	alice := createAccount(t, db, "alice@example.com")
+	bob := createAccount(t, db, "bob@example.com")
+	carol := createAccount(t, db, "carol@example.com")
+	dave := createAccount(t, db, "dave@example.com")
+
+	// Dave is already in a workspace of his own.
+	if _, err := workspaces.Create(ctx, dave.ID, "Dave's"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Boards saved before there were workspaces, one before there were
+	// members.
+	for _, id := range []string{"owned", "shared"} {
+		if err := db.Collection("boards").Document(id).Create(ctx, &templs.Board{ID: id, Title: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := members.Set(ctx, "owned", alice.ID, templs.RoleOwner); err != nil {
+		t.Fatal(err)
+	}
+	if err := members.Set(ctx, "owned", bob.ID, templs.RoleViewer); err != nil {
+		t.Fatal(err)
+	}
+
+	for range 2 {
+		if err := pkg.AssignWorkspaces(ctx, db, "Boards"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// roles holds the role of each account in the Boards workspace.
+	roles := make(map[string]templs.WorkspaceRole)
+	for _, account := range []templs.Account{alice, bob, carol, dave} {
+		in, err := workspaces.ForAccount(ctx, account.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, workspace := range in {
+			if workspace.Name == "Boards" {
+				roles[account.Email] = workspace.Role
+			}
+		}
+	}
+
+	want := map[string]templs.WorkspaceRole{
+		alice.Email: templs.WorkspaceRoleAdmin,
+		bob.Email:   templs.WorkspaceRoleMember,
+		carol.Email: templs.WorkspaceRoleMember,
+	}
+	if len(roles) != len(want) {
+		t.Errorf("got workspace roles %v, want %v", roles, want)
+	}
+	for email, role := range want {
+		if roles[email] != role {
+			t.Errorf("%s's workspace role is %q, want %q", email, roles[email], role)
+		}
+	}
+
+	// The board without members goes to every account that wasn't in a
+	// workspace.
+	for _, account := range []templs.Account{alice, bob, carol} {
+		if role, err := members.Role(ctx, "shared", account.ID); err != nil || role != templs.RoleOwner {
+			t.Errorf("%s's role on the shared board is %q, %v, want %q", account.Email, role, err, templs.RoleOwner)
+		}
+	}
+	if role, _ := members.Role(ctx, "shared", dave.ID); role != "" {
+		t.Errorf("account from another workspace got role %q on the shared board", role)
+	}
+}
@@ -0,0 +1,662 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	docdb "github.com/limeleaf-coop/knbn/pkg/db"
+	"github.com/limeleaf-coop/knbn/templs"
+)
+
+// boardDoc is a board saved by NormalizedStore in the boards collection. It's
+// labels are saved with it since every card on the board refers to them.
+type boardDoc struct {
+	WorkspaceID string
+	Title       string
+	Labels      []templs.Label
+}
+
+// listDoc is a list saved by NormalizedStore in the lists collection.
+type listDoc struct {
+	BoardID  string
+	Position int
+	Title    string
+}
+
+// cardDoc is a card saved by NormalizedStore in the cards collection.
+type cardDoc struct {
+	BoardID  string
+	ListID   string
+	Position int
+	Title    string
+	Desc     string
+	Labels   []string
+}
+
+// NormalizedStore keeps each list and card in a document of it's own which
+// references it's board, so an edit only rewrites what changed. Boards are
+// assembled from two indexed queries. The board's document still holds it's
+// title and it's revision, which every edit increments so pages showing the
+// board know it changed.
+type NormalizedStore struct {
+	db *docdb.Database
+}
+
+func NewNormalizedStore(db *docdb.Database) *NormalizedStore {
+	return &NormalizedStore{db: db}
+}
+
+// ensureNormalizedIndexes indexes lists and cards by their board.
+func ensureNormalizedIndexes(ctx context.Context, db *docdb.Database) error {
+	for _, collection := range []string{"lists", "cards"} {
+		if err := db.Collection(collection).EnsureIndex(ctx, "$.BoardID", docdb.IndexOptions{}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// normalizedLists assembles the lists of a board, in order, from the lists
+// and cards collections.
+func normalizedLists(ctx context.Context, tx *docdb.Tx, boardId string) ([]templs.List, error) {
+	listDocs, err := tx.Collection("lists").Where("$.BoardID", docdb.OpEqual, boardId).OrderBy("$.Position", docdb.Asc).Documents(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cardDocs, err := tx.Collection("cards").Where("$.BoardID", docdb.OpEqual, boardId).OrderBy("$.Position", docdb.Asc).Documents(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	lists := make([]templs.List, len(listDocs))
+	positions := make(map[string]int, len(listDocs))
+	for idx, doc := range listDocs {
+		var list listDoc
+		if err := doc.DataTo(&list); err != nil {
+			return nil, err
+		}
+
+		lists[idx] = templs.List{ID: doc.ID, Title: list.Title, Cards: []templs.Card{}}
+		positions[doc.ID] = idx
+	}
+
+	for _, doc := range cardDocs {
+		var card cardDoc
+		if err := doc.DataTo(&card); err != nil {
+			return nil, err
+		}
+
+		idx, ok := positions[card.ListID]
+		if !ok {
+			continue
+		}
+		lists[idx].Cards = append(lists[idx].Cards, templs.Card{ID: doc.ID, Title: card.Title, Desc: card.Desc, Labels: card.Labels})
+	}
+
+	return lists, nil
+}
+
+// deleteNormalized deletes every list and card document of a board.
+func deleteNormalized(ctx context.Context, tx *docdb.Tx, boardId string) error {
+	for _, collection := range []string{"lists", "cards"} {
+		docs, err := tx.Collection(collection).Query(ctx, "$.BoardID", docdb.OpEqual, boardId)
+		if err != nil {
+			return err
+		}
+
+		for _, doc := range docs {
+			if err := doc.Delete(ctx); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// createNormalized saves every list and card of board as a document of it's
+// own.
+func createNormalized(ctx context.Context, tx *docdb.Tx, board templs.Board) error {
+	for listIdx, list := range board.Lists {
+		doc := listDoc{BoardID: board.ID, Position: listIdx, Title: list.Title}
+		if err := tx.Collection("lists").Document(list.ID).Create(ctx, &doc); err != nil {
+			return err
+		}
+
+		for cardIdx, card := range list.Cards {
+			doc := cardDoc{BoardID: board.ID, ListID: list.ID, Position: cardIdx, Title: card.Title, Desc: card.Desc, Labels: card.Labels}
+			if err := tx.Collection("cards").Document(card.ID).Create(ctx, &doc); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// setFields merges fields into a list or card document.
+func setFields(ctx context.Context, doc *docdb.Document, fields map[string]any) error {
+	patch, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+
+	return doc.Patch(ctx, docdb.MergePatch(patch))
+}
+
+// cardIdsWithout returns the IDs of the cards in list in order, leaving out
+// the card with the ID cardId.
+func cardIdsWithout(list templs.List, cardId string) []string {
+	ids := make([]string, 0, len(list.Cards))
+	for _, card := range list.Cards {
+		if card.ID != cardId {
+			ids = append(ids, card.ID)
+		}
+	}
+
+	return ids
+}
+
+// renumber saves the position of each document in ids as it's index.
+func renumber(ctx context.Context, collection *docdb.Collection, ids []string) error {
+	for idx, id := range ids {
+		if err := setFields(ctx, collection.Document(id), map[string]any{"Position": idx}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *NormalizedStore) Init(ctx context.Context) error {
+	if err := ensureNormalizedIndexes(ctx, s.db); err != nil {
+		return err
+	}
+	if err := s.db.Collection("lists").EnsureSearchIndex(ctx, "$.Title"); err != nil {
+		return err
+	}
+	if err := s.db.Collection("cards").EnsureSearchIndex(ctx, "$.Title", "$.Desc"); err != nil {
+		return err
+	}
+	if err := s.db.Collection("boards").EnsureSearchIndex(ctx); err != nil {
+		return err
+	}
+
+	// Move the lists and cards of boards saved by an EmbeddedStore into
+	// documents of their own.
+	return s.db.RunInTx(ctx, func(tx *docdb.Tx) error {
+		boards, err := boardsIn(ctx, tx.Collection("boards"))
+		if err != nil {
+			return err
+		}
+
+		for _, board := range boards {
+			if len(board.Lists) == 0 {
+				continue
+			}
+
+			if err := createNormalized(ctx, tx, board); err != nil {
+				return err
+			}
+			if err := tx.Collection("boards").Document(board.ID).Patch(ctx, docdb.MergePatch(`{"Lists": null}`)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// board assembles a board within tx.
+func (s *NormalizedStore) board(ctx context.Context, tx *docdb.Tx, boardId string) (templs.Board, error) {
+	var board templs.Board
+	doc := tx.Collection("boards").Document(boardId)
+	if err := doc.Get(ctx, &board); err != nil {
+		return templs.Board{}, err
+	}
+
+	lists, err := normalizedLists(ctx, tx, boardId)
+	if err != nil {
+		return templs.Board{}, err
+	}
+
+	board.ID = boardId
+	board.Revision = doc.Revision
+	board.Lists = lists
+
+	return board, nil
+}
+
+// Board reads the board and it's lists and cards in one transaction so they
+// are all from the same revision.
+func (s *NormalizedStore) Board(ctx context.Context, boardId string) (templs.Board, error) {
+	var board templs.Board
+	err := s.db.RunInTx(ctx, func(tx *docdb.Tx) error {
+		var err error
+		board, err = s.board(ctx, tx, boardId)
+		return err
+	})
+
+	return board, err
+}
+
+func (s *NormalizedStore) Boards(ctx context.Context, workspaceId string) ([]templs.Board, error) {
+	return workspaceBoards(ctx, s.db, workspaceId)
+}
+
+func (s *NormalizedStore) CreateBoard(ctx context.Context, workspaceId string, title string, ownerId string) (templs.Board, error) {
+	return s.create(ctx, templs.Board{WorkspaceID: workspaceId, Title: title}, ownerId)
+}
+
+// RenameBoard saves the title in the same patch that increments the board's
+// revision.
+func (s *NormalizedStore) RenameBoard(ctx context.Context, boardId string, rev int64, title string) (templs.Board, error) {
+	patch, err := json.Marshal(map[string]any{"Title": title})
+	if err != nil {
+		return templs.Board{}, err
+	}
+
+	var board templs.Board
+	err = s.db.RunInTx(ctx, func(tx *docdb.Tx) error {
+		if err := tx.Collection("boards").Document(boardId).PatchIfRevision(ctx, docdb.MergePatch(patch), rev); err != nil {
+			return err
+		}
+
+		board, err = s.board(ctx, tx, boardId)
+		return err
+	})
+
+	return board, err
+}
+
+func (s *NormalizedStore) DuplicateBoard(ctx context.Context, boardId string, title string, withCards bool, ownerId string) (templs.Board, error) {
+	board, err := s.Board(ctx, boardId)
+	if err != nil {
+		return templs.Board{}, err
+	}
+
+	return s.create(ctx, templs.Board{WorkspaceID: board.WorkspaceID, Title: title, Labels: board.Labels, Lists: copyLists(board.Lists, withCards)}, ownerId)
+}
+
+func (s *NormalizedStore) DeleteBoard(ctx context.Context, boardId string, rev int64) error {
+	return s.db.RunInTx(ctx, func(tx *docdb.Tx) error {
+		if err := tx.Collection("boards").Document(boardId).DeleteIfRevision(ctx, rev); err != nil {
+			return err
+		}
+
+		if err := deleteNormalized(ctx, tx, boardId); err != nil {
+			return err
+		}
+
+		return removeMembers(ctx, tx, boardId)
+	})
+}
+
+// create saves board and it's lists and cards under a generated ID, along
+// with it's owner.
+func (s *NormalizedStore) create(ctx context.Context, board templs.Board, ownerId string) (templs.Board, error) {
+	board.ID = docdb.NewID()
+
+	var created templs.Board
+	err := s.db.RunInTx(ctx, func(tx *docdb.Tx) error {
+		if err := tx.Collection("boards").Document(board.ID).Create(ctx, &boardDoc{WorkspaceID: board.WorkspaceID, Title: board.Title, Labels: board.Labels}); err != nil {
+			return err
+		}
+		if err := createNormalized(ctx, tx, board); err != nil {
+			return err
+		}
+		if err := setMember(ctx, tx, board.ID, ownerId, templs.RoleOwner); err != nil {
+			return err
+		}
+
+		var err error
+		created, err = s.board(ctx, tx, board.ID)
+		return err
+	})
+
+	return created, err
+}
+
+// Search looks in lists and cards, filtered to the boards by the search query
+// itself, and decodes each list or card from it's result instead of loading
+// it again.
+func (s *NormalizedStore) Search(ctx context.Context, boardIds []string, query string) ([]templs.SearchResult, error) {
+	type hit struct {
+		collection string
+		docdb.SearchResult
+	}
+
+	var hits []hit
+	for _, collection := range []string{"lists", "cards"} {
+		found, err := s.db.Collection(collection).Where("$.BoardID", docdb.OpIn, boardIds).Search(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range found {
+			hits = append(hits, hit{collection, f})
+		}
+	}
+	slices.SortStableFunc(hits, func(a, b hit) int {
+		switch {
+		case a.Rank < b.Rank:
+			return -1
+		case a.Rank > b.Rank:
+			return 1
+		}
+		return 0
+	})
+
+	titles := make(map[string]string)
+	results := make([]templs.SearchResult, 0, len(hits))
+	for _, h := range hits {
+		// Lists decode as cards without a ListID.
+		var card cardDoc
+		if err := h.DataTo(&card); err != nil {
+			return nil, err
+		}
+
+		if _, ok := titles[card.BoardID]; !ok {
+			var board templs.Board
+			if err := s.db.Collection("boards").Document(card.BoardID).Get(ctx, &board); err != nil {
+				return nil, err
+			}
+			titles[card.BoardID] = board.Title
+		}
+
+		result := templs.SearchResult{
+			BoardID:    card.BoardID,
+			BoardTitle: titles[card.BoardID],
+			ListID:     h.ID,
+			Field:      strings.TrimPrefix(h.Keypath, "$."),
+			Snippet:    highlights(h.Snippet),
+		}
+		if h.collection == "cards" {
+			result.ListID = card.ListID
+			result.CardID = h.ID
+		}
+
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+// edit increments the board's revision, as long as it's still rev, and calls
+// fn to change it's lists and cards in the same transaction.
+func (s *NormalizedStore) edit(ctx context.Context, boardId string, rev int64, fn func(tx *docdb.Tx, board templs.Board) error) (templs.Board, error) {
+	var next templs.Board
+	err := s.db.RunInTx(ctx, func(tx *docdb.Tx) error {
+		if err := tx.Collection("boards").Document(boardId).PatchIfRevision(ctx, docdb.MergePatch(`{}`), rev); err != nil {
+			return err
+		}
+
+		board, err := s.board(ctx, tx, boardId)
+		if err != nil {
+			return err
+		}
+		if err := fn(tx, board); err != nil {
+			return err
+		}
+
+		next, err = s.board(ctx, tx, boardId)
+		return err
+	})
+
+	return next, err
+}
+
+func (s *NormalizedStore) AddList(ctx context.Context, boardId string, rev int64, title string) (templs.Board, error) {
+	return s.edit(ctx, boardId, rev, func(tx *docdb.Tx, board templs.Board) error {
+		doc := listDoc{BoardID: boardId, Position: len(board.Lists), Title: title}
+		return tx.Collection("lists").Document(docdb.NewID()).Create(ctx, &doc)
+	})
+}
+
+func (s *NormalizedStore) RenameList(ctx context.Context, boardId string, rev int64, listId string, title string) (templs.Board, error) {
+	return s.edit(ctx, boardId, rev, func(tx *docdb.Tx, board templs.Board) error {
+		if _, err := findList(board, listId); err != nil {
+			return err
+		}
+
+		return setFields(ctx, tx.Collection("lists").Document(listId), map[string]any{"Title": title})
+	})
+}
+
+func (s *NormalizedStore) MoveList(ctx context.Context, boardId string, rev int64, listId string, position int) (templs.Board, error) {
+	return s.edit(ctx, boardId, rev, func(tx *docdb.Tx, board templs.Board) error {
+		listIdx, err := findList(board, listId)
+		if err != nil {
+			return err
+		}
+		if err := checkPosition(position, len(board.Lists)-1); err != nil {
+			return err
+		}
+
+		ids := make([]string, 0, len(board.Lists))
+		for _, list := range board.Lists {
+			ids = append(ids, list.ID)
+		}
+		ids = slices.Delete(ids, listIdx, listIdx+1)
+		ids = slices.Insert(ids, position, listId)
+
+		return renumber(ctx, tx.Collection("lists"), ids)
+	})
+}
+
+func (s *NormalizedStore) DeleteList(ctx context.Context, boardId string, rev int64, listId string, moveTo string) (templs.Board, error) {
+	return s.edit(ctx, boardId, rev, func(tx *docdb.Tx, board templs.Board) error {
+		listIdx, err := findList(board, listId)
+		if err != nil {
+			return err
+		}
+
+		cards := tx.Collection("cards")
+		if moveTo != "" {
+			to, err := findList(board, moveTo)
+			if err != nil || to == listIdx {
+				return fmt.Errorf("%w: invalid list to move cards to %q", errBadRequest, moveTo)
+			}
+
+			end := len(board.Lists[to].Cards)
+			for idx, card := range board.Lists[listIdx].Cards {
+				if err := setFields(ctx, cards.Document(card.ID), map[string]any{"ListID": moveTo, "Position": end + idx}); err != nil {
+					return err
+				}
+			}
+		} else {
+			for _, card := range board.Lists[listIdx].Cards {
+				if err := cards.Document(card.ID).Delete(ctx); err != nil {
+					return err
+				}
+			}
+		}
+
+		lists := tx.Collection("lists")
+		if err := lists.Document(listId).Delete(ctx); err != nil {
+			return err
+		}
+
+		// Close the gap so lists added later still go on the end.
+		ids := make([]string, 0, len(board.Lists))
+		for _, list := range board.Lists {
+			if list.ID != listId {
+				ids = append(ids, list.ID)
+			}
+		}
+
+		return renumber(ctx, lists, ids)
+	})
+}
+
+func (s *NormalizedStore) AddCard(ctx context.Context, boardId string, rev int64, listId string, title string) (templs.Board, error) {
+	return s.edit(ctx, boardId, rev, func(tx *docdb.Tx, board templs.Board) error {
+		listIdx, err := findList(board, listId)
+		if err != nil {
+			return err
+		}
+
+		doc := cardDoc{BoardID: boardId, ListID: listId, Position: len(board.Lists[listIdx].Cards), Title: title}
+		return tx.Collection("cards").Document(docdb.NewID()).Create(ctx, &doc)
+	})
+}
+
+func (s *NormalizedStore) RenameCard(ctx context.Context, boardId string, rev int64, cardId string, title string) (templs.Board, error) {
+	return s.edit(ctx, boardId, rev, func(tx *docdb.Tx, board templs.Board) error {
+		if _, _, err := findCard(board, cardId); err != nil {
+			return err
+		}
+
+		return setFields(ctx, tx.Collection("cards").Document(cardId), map[string]any{"Title": title})
+	})
+}
+
+func (s *NormalizedStore) SetCardDesc(ctx context.Context, boardId string, rev int64, cardId string, desc string) (templs.Board, error) {
+	return s.edit(ctx, boardId, rev, func(tx *docdb.Tx, board templs.Board) error {
+		if _, _, err := findCard(board, cardId); err != nil {
+			return err
+		}
+
+		return setFields(ctx, tx.Collection("cards").Document(cardId), map[string]any{"Desc": desc})
+	})
+}
+
+func (s *NormalizedStore) MoveCard(ctx context.Context, boardId string, rev int64, cardId string, toListId string, position int) (templs.Board, error) {
+	return s.edit(ctx, boardId, rev, func(tx *docdb.Tx, board templs.Board) error {
+		fromList, _, err := findCard(board, cardId)
+		if err != nil {
+			return err
+		}
+		toList, err := findList(board, toListId)
+		if err != nil {
+			return err
+		}
+
+		ids := cardIdsWithout(board.Lists[toList], cardId)
+		if position < 0 {
+			position = len(ids)
+		}
+		if err := checkPosition(position, len(ids)); err != nil {
+			return err
+		}
+		ids = slices.Insert(ids, position, cardId)
+
+		cards := tx.Collection("cards")
+		if err := setFields(ctx, cards.Document(cardId), map[string]any{"ListID": toListId}); err != nil {
+			return err
+		}
+
+		// Close the gap the card leaves in the list it came from.
+		if fromList != toList {
+			if err := renumber(ctx, cards, cardIdsWithout(board.Lists[fromList], cardId)); err != nil {
+				return err
+			}
+		}
+
+		return renumber(ctx, cards, ids)
+	})
+}
+
+func (s *NormalizedStore) DeleteCard(ctx context.Context, boardId string, rev int64, cardId string) (templs.Board, error) {
+	return s.edit(ctx, boardId, rev, func(tx *docdb.Tx, board templs.Board) error {
+		listIdx, _, err := findCard(board, cardId)
+		if err != nil {
+			return err
+		}
+
+		cards := tx.Collection("cards")
+		if err := cards.Document(cardId).Delete(ctx); err != nil {
+			return err
+		}
+
+		// Close the gap so cards added later still go on the end.
+		return renumber(ctx, cards, cardIdsWithout(board.Lists[listIdx], cardId))
+	})
+}
+
+func (s *NormalizedStore) SetCardLabels(ctx context.Context, boardId string, rev int64, cardId string, labelIds []string) (templs.Board, error) {
+	return s.edit(ctx, boardId, rev, func(tx *docdb.Tx, board templs.Board) error {
+		if _, _, err := findCard(board, cardId); err != nil {
+			return err
+		}
+		ids, err := cardLabels(board, labelIds)
+		if err != nil {
+			return err
+		}
+
+		return setFields(ctx, tx.Collection("cards").Document(cardId), map[string]any{"Labels": ids})
+	})
+}
+
+// editLabels saves the labels fn returns for the board in the same patch that
+// increments it's revision, like RenameBoard, and lets fn change cards in the
+// same transaction.
+func (s *NormalizedStore) editLabels(ctx context.Context, boardId string, rev int64, fn func(tx *docdb.Tx, board templs.Board) ([]templs.Label, error)) (templs.Board, error) {
+	var next templs.Board
+	err := s.db.RunInTx(ctx, func(tx *docdb.Tx) error {
+		board, err := s.board(ctx, tx, boardId)
+		if err != nil {
+			return err
+		}
+
+		labels, err := fn(tx, board)
+		if err != nil {
+			return err
+		}
+		patch, err := json.Marshal(map[string]any{"Labels": labels})
+		if err != nil {
+			return err
+		}
+		if err := tx.Collection("boards").Document(boardId).PatchIfRevision(ctx, docdb.MergePatch(patch), rev); err != nil {
+			return err
+		}
+
+		next, err = s.board(ctx, tx, boardId)
+		return err
+	})
+
+	return next, err
+}
+
+func (s *NormalizedStore) AddLabel(ctx context.Context, boardId string, rev int64, name string, color string) (templs.Board, error) {
+	return s.editLabels(ctx, boardId, rev, func(tx *docdb.Tx, board templs.Board) ([]templs.Label, error) {
+		return append(board.Labels, templs.Label{ID: docdb.NewID(), Name: name, Color: color}), nil
+	})
+}
+
+func (s *NormalizedStore) UpdateLabel(ctx context.Context, boardId string, rev int64, labelId string, name string, color string) (templs.Board, error) {
+	return s.editLabels(ctx, boardId, rev, func(tx *docdb.Tx, board templs.Board) ([]templs.Label, error) {
+		labelIdx, err := findLabel(board, labelId)
+		if err != nil {
+			return nil, err
+		}
+
+		board.Labels[labelIdx] = templs.Label{ID: labelId, Name: name, Color: color}
+		return board.Labels, nil
+	})
+}
+
+func (s *NormalizedStore) DeleteLabel(ctx context.Context, boardId string, rev int64, labelId string) (templs.Board, error) {
+	return s.editLabels(ctx, boardId, rev, func(tx *docdb.Tx, board templs.Board) ([]templs.Label, error) {
+		labelIdx, err := findLabel(board, labelId)
+		if err != nil {
+			return nil, err
+		}
+
+		cards := tx.Collection("cards")
+		for _, list := range board.Lists {
+			for _, card := range list.Cards {
+				if ids, ok := withoutLabel(card, labelId); ok {
+					if err := setFields(ctx, cards.Document(card.ID), map[string]any{"Labels": ids}); err != nil {
+						return nil, err
+					}
+				}
+			}
+		}
+
+		return slices.Delete(board.Labels, labelIdx, labelIdx+1), nil
+	})
+}
@@ -0,0 +1,121 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	docdb "github.com/limeleaf-coop/knbn/pkg/db"
+)
+
+const (
+	// outboxRetry is how often email that failed to send is tried again.
+	outboxRetry = time.Minute
+
+	// outboxAttempts is how many times sending an email is tried before
+	// giving up. Email given up on stays in the outbox with the last error.
+	outboxAttempts = 5
+)
+
+// outboxDoc is an email waiting in the outbox collection.
+type outboxDoc struct {
+	Message
+	Attempts int
+	Error    string
+
+	// Expires is when the link in the email stops working, as a Unix time,
+	// after which the email is deleted whether or not it was sent.
+	Expires int64
+}
+
+// queueMail saves msg to the outbox within tx, so it's only sent if
+// everything else tx saves is too. The email is deleted, even if it's given up
+// on, once the link in it expires.
+func queueMail(ctx context.Context, tx *docdb.Tx, msg Message, expires time.Time) error {
+	return tx.Collection("outbox").Document(docdb.NewID()).Create(ctx, &outboxDoc{Message: msg, Expires: expires.Unix()})
+}
+
+// Outbox sends email queued with queueMail through a Mailer.
+type Outbox struct {
+	db     *docdb.Database
+	mailer Mailer
+}
+
+func NewOutbox(db *docdb.Database, mailer Mailer) *Outbox {
+	return &Outbox{db: db, mailer: mailer}
+}
+
+// Run sends email as soon as it's queued, and tries email that failed again
+// every outboxRetry, until ctx is done.
+func (o *Outbox) Run(ctx context.Context) error {
+	changes, err := o.db.Collection("outbox").Watch(ctx)
+	if err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(outboxRetry)
+	defer ticker.Stop()
+
+	for {
+		if err := o.deliver(ctx); err != nil {
+			slog.Error("error delivering email", "error", err)
+		}
+
+		// Wait for new email only, since sending updates and deletes
+		// what's already in the outbox.
+		for queued := false; !queued; {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-ticker.C:
+				queued = true
+			case change, ok := <-changes:
+				if !ok {
+					return nil
+				}
+				queued = change.Kind == docdb.ChangeCreated
+			}
+		}
+	}
+}
+
+// deliver tries to send every email in the outbox that hasn't been given up
+// on. Sent email is deleted, along with any email whose link has expired.
+func (o *Outbox) deliver(ctx context.Context) error {
+	if err := deleteExpired(ctx, o.db.Collection("outbox")); err != nil {
+		return err
+	}
+
+	docs, err := o.db.Collection("outbox").Query(ctx, "$.Attempts", docdb.OpLessThan, outboxAttempts)
+	if err != nil {
+		return err
+	}
+
+	for _, doc := range docs {
+		var queued outboxDoc
+		if err := doc.DataTo(&queued); err != nil {
+			return err
+		}
+
+		sendErr := o.mailer.Send(ctx, queued.Message)
+		if sendErr == nil {
+			if err := doc.Delete(ctx); err != nil {
+				return err
+			}
+			continue
+		}
+
+		slog.Warn("error sending email", "to", queued.To, "attempts", queued.Attempts+1, "error", sendErr)
+
+		patch, err := json.Marshal(map[string]any{"Attempts": queued.Attempts + 1, "Error": sendErr.Error()})
+		if err != nil {
+			return err
+		}
+		if err := doc.Patch(ctx, docdb.MergePatch(patch)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
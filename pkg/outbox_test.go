@@ -0,0 +1,73 @@
+package pkg_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/limeleaf-coop/knbn/pkg"
+	docdb "github.com/limeleaf-coop/knbn/pkg/db"
+)
+
+// chanMailer sends each email to a channel.
+type chanMailer chan pkg.Message
+
+func (m chanMailer) Send(ctx context.Context, msg pkg.Message) error {
+	m <- msg
+	return nil
+}
+
+func TestOutbox(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db := openTestDB(t)
+
+	past := time.Now().Add(-time.Minute).Unix()
+	future := time.Now().Add(time.Hour).Unix()
+	queued := []struct {
+		id       string
+		to       string
+		attempts int
+		expires  int64
+	}{
+		{"expired", "gone@example.com", 0, past},
+		{"given-up-expired", "gone@example.com", 5, past},
+		{"given-up", "kept@example.com", 5, future},
+		{"queued", "alice@example.com", 0, future},
+	}
+	for _, q := range queued {
+		doc := map[string]any{"To": q.to, "Subject": "Sign in to knbn", "Body": "link", "Attempts": q.attempts, "Expires": q.expires}
+		if err := db.Collection("outbox").Document(q.id).Create(ctx, &doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mailer := make(chanMailer)
+	done := make(chan error)
+	go func() { done <- pkg.NewOutbox(db, mailer).Run(ctx) }()
+
+	select {
+	case msg := <-mailer:
+		if msg.To != "alice@example.com" {
+			t.Errorf("sent email to %s, want alice@example.com", msg.To)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for email")
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// Email is deleted once it's sent or it's link expires, and email given
+	// up on is kept until then.
+	for _, q := range queued {
+		err := db.Collection("outbox").Document(q.id).Get(context.Background(), &map[string]any{})
+		if kept := !errors.Is(err, docdb.ErrNotFound); kept != (q.id == "given-up") {
+			t.Errorf("%s kept = %v, %v", q.id, kept, err)
+		}
+	}
+}
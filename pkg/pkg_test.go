@@ -0,0 +1,215 @@
+package pkg_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/limeleaf-coop/knbn/pkg"
+	docdb "github.com/limeleaf-coop/knbn/pkg/db"
+	"github.com/limeleaf-coop/knbn/templs"
+)
+
+const baseURL = "https://knbn.test"
+
+// openTestDB opens an empty database with the indexes main creates.
+func openTestDB(t *testing.T) *docdb.Database {
+	t.Helper()
+
+	ctx := context.Background()
+
+	db, err := docdb.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	if err := db.Collection("accounts").EnsureIndex(ctx, "$.Email", docdb.IndexOptions{Unique: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	indexes := []struct {
+		collection string
+		keypath    string
+	}{
+		{"tokens", "$.Expires"},
+		{"outbox", "$.Attempts"},
+		{"outbox", "$.Expires"},
+		{"sessions", "$.AccountID"},
+		{"sessions", "$.Expires"},
+		{"members", "$.BoardID"},
+		{"members", "$.AccountID"},
+		{"workspace_members", "$.WorkspaceID"},
+		{"workspace_members", "$.AccountID"},
+		{"workspaces", "$.Name"},
+		{"invitations", "$.Email"},
+		{"invitations", "$.WorkspaceID"},
+		{"invitations", "$.BoardID"},
+		{"invitations", "$.Expires"},
+		{"boards", "$.WorkspaceID"},
+	}
+	for _, index := range indexes {
+		if err := db.Collection(index.collection).EnsureIndex(ctx, index.keypath, docdb.IndexOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return db
+}
+
+// createAccount saves an account with the email and returns it.
+func createAccount(t *testing.T, db *docdb.Database, email string) templs.Account {
+	t.Helper()
+
+	account := templs.Account{ID: docdb.NewID(), Email: email}
+	if err := db.Collection("accounts").Document(account.ID).Create(context.Background(), &account); err != nil {
+		t.Fatal(err)
+	}
+
+	return account
+}
+
+// mailedToken returns the token in the only link to path queued in the outbox
+// for the email.
+func mailedToken(t *testing.T, db *docdb.Database, email string, path string) string {
+	t.Helper()
+
+	docs, err := db.Collection("outbox").QueryAll(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	link := regexp.MustCompile(regexp.QuoteMeta(baseURL+path) + `(\S+)`)
+
+	var tokens []string
+	for _, doc := range docs {
+		var msg pkg.Message
+		if err := doc.DataTo(&msg); err != nil {
+			t.Fatal(err)
+		}
+		if match := link.FindStringSubmatch(msg.Body); msg.To == email && match != nil {
+			tokens = append(tokens, match[1])
+		}
+	}
+	if len(tokens) != 1 {
+		t.Fatalf("got %d links to %s for %s, want 1", len(tokens), path, email)
+	}
+
+	return tokens[0]
+}
+
+// expireAll moves the expiry of every document in the collection into the
+// past.
+func expireAll(t *testing.T, db *docdb.Database, collection string) {
+	t.Helper()
+
+	setExpires(t, db, collection, time.Now().Add(-time.Minute))
+}
+
+// setExpires changes the expiry of every document in the collection.
+func setExpires(t *testing.T, db *docdb.Database, collection string, expires time.Time) {
+	t.Helper()
+
+	ctx := context.Background()
+
+	docs, err := db.Collection(collection).QueryAll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, doc := range docs {
+		patch := docdb.JSONPatch{{Op: "replace", Path: "/Expires", Value: expires.Unix()}}
+		if err := doc.Patch(ctx, patch); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// serve calls handler with a request to target, setting the path value name
+// to value if name isn't empty, and sending cookie if it isn't nil.
+func serve(handler http.HandlerFunc, method string, target string, form url.Values, name string, value string, cookie *http.Cookie) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if name != "" {
+		r.SetPathValue(name, value)
+	}
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+
+	w := httptest.NewRecorder()
+	handler(w, r)
+
+	return w
+}
+
+// sessionCookie returns the session cookie set by a response, or nil if it
+// didn't set one.
+func sessionCookie(w *httptest.ResponseRecorder) *http.Cookie {
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == "knbn" {
+			return cookie
+		}
+	}
+
+	return nil
+}
+
+// signIn signs in with a link emailed to the account with the email and
+// returns the session cookie.
+func signIn(t *testing.T, db *docdb.Database, sessions *pkg.Sessions, email string) *http.Cookie {
+	t.Helper()
+
+	serve(pkg.SignInHandler(db, baseURL), http.MethodPost, "/sign-in", url.Values{"email": {email}}, "", "", nil)
+
+	token := mailedToken(t, db, email, "/sign-in/")
+	clearOutbox(t, db)
+
+	w := serve(pkg.SignInTokenHandler(db, sessions), http.MethodPost, "/sign-in/"+token, nil, "token", token, nil)
+	cookie := sessionCookie(w)
+	if cookie == nil || cookie.Value == "" {
+		t.Fatalf("signing in as %s didn't set a session cookie", email)
+	}
+
+	return cookie
+}
+
+// clearOutbox deletes every queued email, so the next link mailed to an
+// address is the only one.
+func clearOutbox(t *testing.T, db *docdb.Database) {
+	t.Helper()
+
+	ctx := context.Background()
+
+	docs, err := db.Collection("outbox").QueryAll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, doc := range docs {
+		if err := doc.Delete(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// serveAs calls handler with a GET request sending cookie, made by htmx if hx
+// is true.
+func serveAs(handler http.HandlerFunc, cookie *http.Cookie, hx bool) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(cookie)
+	if hx {
+		r.Header.Set("HX-Request", "true")
+	}
+
+	w := httptest.NewRecorder()
+	handler(w, r)
+
+	return w
+}
@@ -0,0 +1,285 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	docdb "github.com/limeleaf-coop/knbn/pkg/db"
+	"github.com/limeleaf-coop/knbn/templs"
+)
+
+const (
+	sessionCookie = "knbn"
+
+	// sessionExpiry is how long a session lasts without being used. Every
+	// use slides it's expiry forward again.
+	sessionExpiry = 14 * 24 * time.Hour
+
+	// sessionRefresh is how often a session in use has it's expiry slid
+	// forward, so not every request has to save it.
+	sessionRefresh = time.Hour
+)
+
+var errSignedOut = errors.New("not signed in")
+
+// sessionDoc is saved in the sessions collection under the hash of the
+// session's ID, like sign in tokens, so sessions can't be taken over by
+// reading the database.
+type sessionDoc struct {
+	AccountID   string
+	Expires     int64
+	WorkspaceID string
+}
+
+// Session is the signed in account making a request, and the workspace it
+// switched to last in this browser.
+type Session struct {
+	ID          string
+	AccountID   string
+	WorkspaceID string
+}
+
+// Sessions keeps track of who is signed in on which browser. The browser only
+// holds a random session ID in the "knbn" cookie.
+type Sessions struct {
+	db *docdb.Database
+}
+
+func NewSessions(db *docdb.Database) *Sessions {
+	return &Sessions{db: db}
+}
+
+// deleteExpired deletes documents from collection with an Expires time in the
+// past.
+func deleteExpired(ctx context.Context, collection *docdb.Collection) error {
+	docs, err := collection.Query(ctx, "$.Expires", docdb.OpLessThan, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+
+	for _, doc := range docs {
+		if err := doc.Delete(ctx); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// setCookie gives the browser the session ID until expires, or tells it to
+// forget the session if id is empty.
+func setCookie(w http.ResponseWriter, id string, expires time.Time) {
+	cookie := http.Cookie{
+		Name:     sessionCookie,
+		Value:    id,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if id == "" {
+		cookie.MaxAge = -1
+	}
+
+	http.SetCookie(w, &cookie)
+}
+
+// create saves a new session for the account within tx, working in the
+// workspace if it isn't empty, and returns it's ID for setCookie.
+func (s *Sessions) create(ctx context.Context, tx *docdb.Tx, accountId string, workspaceId string) (string, time.Time, error) {
+	if err := deleteExpired(ctx, tx.Collection("sessions")); err != nil {
+		return "", time.Time{}, err
+	}
+
+	id := newToken()
+	expires := time.Now().Add(sessionExpiry)
+	doc := sessionDoc{AccountID: accountId, Expires: expires.Unix(), WorkspaceID: workspaceId}
+	if err := tx.Collection("sessions").Document(hashToken(id)).Create(ctx, &doc); err != nil {
+		return "", time.Time{}, err
+	}
+
+	return id, expires, nil
+}
+
+// Get returns the session of the request, or errSignedOut if there isn't
+// one or it has expired. Sessions that haven't been refreshed in a while
+// have their expiry slid forward, along with the cookie's.
+func (s *Sessions) Get(w http.ResponseWriter, r *http.Request) (Session, error) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return Session{}, errSignedOut
+	}
+
+	var session sessionDoc
+	doc := s.db.Collection("sessions").Document(hashToken(cookie.Value))
+	if err := doc.Get(r.Context(), &session); err != nil {
+		if errors.Is(err, docdb.ErrNotFound) {
+			return Session{}, errSignedOut
+		}
+		return Session{}, err
+	}
+
+	now := time.Now()
+	if now.Unix() >= session.Expires {
+		return Session{}, errSignedOut
+	}
+
+	if expires := now.Add(sessionExpiry); expires.Unix()-session.Expires >= int64(sessionRefresh.Seconds()) {
+		patch := fmt.Sprintf(`{"Expires": %d}`, expires.Unix())
+		if err := doc.Patch(r.Context(), docdb.MergePatch(patch)); err != nil {
+			return Session{}, err
+		}
+		setCookie(w, cookie.Value, expires)
+	}
+
+	return Session{ID: doc.ID, AccountID: session.AccountID, WorkspaceID: session.WorkspaceID}, nil
+}
+
+// Active reports whether the session with the ID sessionId is still signed in,
+// without refreshing it, for requests like event streams that outlive the
+// check made when they started.
+func (s *Sessions) Active(ctx context.Context, sessionId string) (bool, error) {
+	var session sessionDoc
+	if err := s.db.Collection("sessions").Document(sessionId).Get(ctx, &session); err != nil {
+		if errors.Is(err, docdb.ErrNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return time.Now().Unix() < session.Expires, nil
+}
+
+// SetWorkspace switches the session with the ID sessionId to the workspace.
+func (s *Sessions) SetWorkspace(ctx context.Context, sessionId string, workspaceId string) error {
+	patch, err := json.Marshal(map[string]any{"WorkspaceID": workspaceId})
+	if err != nil {
+		return err
+	}
+
+	return s.db.Collection("sessions").Document(sessionId).Patch(ctx, docdb.MergePatch(patch))
+}
+
+// Delete signs out the browser making the request.
+func (s *Sessions) Delete(w http.ResponseWriter, r *http.Request) error {
+	setCookie(w, "", time.Time{})
+
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil
+	}
+
+	return s.db.Collection("sessions").Document(hashToken(cookie.Value)).Delete(r.Context())
+}
+
+// DeleteAll signs the account out of every browser it's signed in on.
+func (s *Sessions) DeleteAll(ctx context.Context, accountId string) error {
+	return s.db.RunInTx(ctx, func(tx *docdb.Tx) error {
+		docs, err := tx.Collection("sessions").Query(ctx, "$.AccountID", docdb.OpEqual, accountId)
+		if err != nil {
+			return err
+		}
+
+		for _, doc := range docs {
+			if err := doc.Delete(ctx); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func SignOutHandler(sessions *Sessions) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := sessions.Delete(w, r); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		redirect(w, r, "/")
+	}
+}
+
+// SignOutAllHandler signs out every browser the current account is signed in
+// on, including the one making the request.
+func SignOutAllHandler(sessions *Sessions) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := sessions.DeleteAll(r.Context(), CurrentAccount(r.Context()).ID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		setCookie(w, "", time.Time{})
+
+		redirect(w, r, "/")
+	}
+}
+
+type contextKey int
+
+const (
+	accountKey contextKey = iota
+	sessionKey
+	navKey
+	roleKey
+)
+
+// account loads the request's session and it's account.
+func (s *Sessions) account(w http.ResponseWriter, r *http.Request) (Session, templs.Account, error) {
+	session, err := s.Get(w, r)
+	if err != nil {
+		return Session{}, templs.Account{}, err
+	}
+
+	var account templs.Account
+	if err := s.db.Collection("accounts").Document(session.AccountID).Get(r.Context(), &account); err != nil {
+		if errors.Is(err, docdb.ErrNotFound) {
+			return Session{}, templs.Account{}, errSignedOut
+		}
+		return Session{}, templs.Account{}, err
+	}
+	account.ID = session.AccountID
+
+	return session, account, nil
+}
+
+// RequireAccount only calls next for requests from a signed in account, which
+// it puts on the request's context for CurrentAccount along with the session
+// for CurrentSession. Anyone else is sent to the sign in page, except requests
+// made by htmx and event streams which get a 401 since they can't show a page.
+// htmx still follows HX-Redirect.
+func (s *Sessions) RequireAccount(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, account, err := s.account(w, r)
+		switch {
+		case err == nil:
+			ctx := context.WithValue(r.Context(), accountKey, account)
+			next(w, r.WithContext(context.WithValue(ctx, sessionKey, session)))
+		case !errors.Is(err, errSignedOut):
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		case r.Header.Get("HX-Request") != "", r.Header.Get("Accept") == "text/event-stream":
+			w.Header().Set("HX-Redirect", "/")
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+		default:
+			metaRefresh(w, "/")
+		}
+	}
+}
+
+// CurrentAccount returns the signed in account making a request wrapped by
+// RequireAccount.
+func CurrentAccount(ctx context.Context) templs.Account {
+	account, _ := ctx.Value(accountKey).(templs.Account)
+	return account
+}
+
+// CurrentSession returns the session of a request wrapped by RequireAccount.
+func CurrentSession(ctx context.Context) Session {
+	session, _ := ctx.Value(sessionKey).(Session)
+	return session
+}
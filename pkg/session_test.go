@@ -0,0 +1,100 @@
+package pkg_test
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/limeleaf-coop/knbn/pkg"
+)
+
+// whoami writes the email of the signed in account.
+func whoami(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte(pkg.CurrentAccount(r.Context()).Email))
+}
+
+// requestAs makes an htmx request to a handler wrapped by RequireAccount,
+// so signed out requests get a 401 rather than a page.
+func requestAs(handler http.HandlerFunc, cookie *http.Cookie) (int, string) {
+	w := serveAs(handler, cookie, true)
+	return w.Code, w.Body.String()
+}
+
+func TestSessionExpiry(t *testing.T) {
+	ctx := context.Background()
+
+	db := openTestDB(t)
+	sessions := pkg.NewSessions(db)
+	handler := sessions.RequireAccount(whoami)
+
+	createAccount(t, db, "alice@example.com")
+	cookie := signIn(t, db, sessions, "alice@example.com")
+
+	if code, body := requestAs(handler, cookie); code != http.StatusOK || body != "alice@example.com" {
+		t.Fatalf("got %d %q, want %d \"alice@example.com\"", code, body, http.StatusOK)
+	}
+
+	// Sessions in use slide their expiry forward.
+	setExpires(t, db, "sessions", time.Now().Add(24*time.Hour))
+	w := serveAs(handler, cookie, true)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+	}
+	if refreshed := sessionCookie(w); refreshed == nil || !refreshed.Expires.After(time.Now().Add(7*24*time.Hour)) {
+		t.Error("session's cookie wasn't refreshed")
+	}
+
+	docs, err := db.Collection("sessions").QueryAll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var session struct {
+		Expires int64
+	}
+	if err := docs[0].DataTo(&session); err != nil {
+		t.Fatal(err)
+	}
+	if session.Expires <= time.Now().Add(7*24*time.Hour).Unix() {
+		t.Errorf("session expires at %d, want it slid forward", session.Expires)
+	}
+
+	expireAll(t, db, "sessions")
+	if code, _ := requestAs(handler, cookie); code != http.StatusUnauthorized {
+		t.Errorf("expired session got status %d, want %d", code, http.StatusUnauthorized)
+	}
+
+	// Signed out browsers are sent to the sign in page.
+	if w := serveAs(handler, cookie, false); !strings.Contains(w.Body.String(), `url=/"`) {
+		t.Errorf("expired session got %q, want a redirect to the sign in page", w.Body.String())
+	}
+}
+
+func TestSignOutAll(t *testing.T) {
+	db := openTestDB(t)
+	sessions := pkg.NewSessions(db)
+	handler := sessions.RequireAccount(whoami)
+
+	createAccount(t, db, "alice@example.com")
+	createAccount(t, db, "bob@example.com")
+
+	laptop := signIn(t, db, sessions, "alice@example.com")
+	phone := signIn(t, db, sessions, "alice@example.com")
+	bob := signIn(t, db, sessions, "bob@example.com")
+
+	w := serveAs(sessions.RequireAccount(pkg.SignOutAllHandler(sessions)), phone, false)
+	if cookie := sessionCookie(w); cookie == nil || cookie.MaxAge >= 0 {
+		t.Error("signing out didn't clear the cookie")
+	}
+
+	for name, cookie := range map[string]*http.Cookie{"laptop": laptop, "phone": phone} {
+		if code, _ := requestAs(handler, cookie); code != http.StatusUnauthorized {
+			t.Errorf("%s got status %d after signing out everywhere, want %d", name, code, http.StatusUnauthorized)
+		}
+	}
+
+	if code, body := requestAs(handler, bob); code != http.StatusOK || body != "bob@example.com" {
+		t.Errorf("other account got %d %q, want it still signed in", code, body)
+	}
+}
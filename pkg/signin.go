@@ -0,0 +1,183 @@
+package pkg
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/a-h/templ"
+	docdb "github.com/limeleaf-coop/knbn/pkg/db"
+	"github.com/limeleaf-coop/knbn/templs"
+)
+
+// signInExpiry is how long a sign in link works for.
+const signInExpiry = 15 * time.Minute
+
+const signInBody = `Hi,
+
+Follow this link to sign in to knbn:
+
+%s
+
+The link works once and expires in %d minutes. If you didn't ask to sign in you
+can ignore this email.
+`
+
+// signInToken is saved in the tokens collection under the hash of the token
+// sent in a sign in link, so the tokens can't be read back from the database.
+type signInToken struct {
+	AccountID string
+
+	// Expires is a Unix time so expired tokens can be queried for.
+	Expires int64
+}
+
+// normalizeEmail is how emails are saved and looked up, so the same address
+// typed with different case or spacing finds the same account.
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// newToken returns a random token to send in a link.
+func newToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// hashToken returns the ID a token is saved under.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// SignInHandler emails a sign in link to the account with the email entered.
+// The page looks the same whether or not there is an account so it can't be
+// used to find out who has one.
+func SignInHandler(db *docdb.Database, baseURL string) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		email := normalizeEmail(r.FormValue("email"))
+		if email == "" {
+			metaRefresh(w, "/")
+			return
+		}
+
+		err := db.RunInTx(r.Context(), func(tx *docdb.Tx) error {
+			accounts, err := tx.Collection("accounts").Query(r.Context(), "$.Email", docdb.OpEqual, email)
+			if err != nil {
+				return err
+			}
+			if len(accounts) == 0 {
+				return nil
+			}
+
+			if err := deleteExpired(r.Context(), tx.Collection("tokens")); err != nil {
+				return err
+			}
+
+			token := newToken()
+			expires := time.Now().Add(signInExpiry)
+			doc := signInToken{AccountID: accounts[0].ID, Expires: expires.Unix()}
+			if err := tx.Collection("tokens").Document(hashToken(token)).Create(r.Context(), &doc); err != nil {
+				return err
+			}
+
+			return queueMail(r.Context(), tx, Message{
+				To:      email,
+				Subject: "Sign in to knbn",
+				Body:    fmt.Sprintf(signInBody, baseURL+"/sign-in/"+token, int(signInExpiry.Minutes())),
+			}, expires)
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		t := templs.SignInSentPage(email)
+		templ.Handler(t).ServeHTTP(w, r)
+	}
+}
+
+// SignInLinkHandler asks to sign in with the token from a sign in link, so the
+// token is only used when asked to and not by whatever opens links in email
+// first, like invitations.
+func SignInLinkHandler(db *docdb.Database) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var account templs.Account
+		err := db.RunInTx(r.Context(), func(tx *docdb.Tx) error {
+			var token signInToken
+			if err := tx.Collection("tokens").Document(hashToken(r.PathValue("token"))).Get(r.Context(), &token); err != nil {
+				return err
+			}
+			if time.Now().Unix() >= token.Expires {
+				return docdb.ErrNotFound
+			}
+
+			return tx.Collection("accounts").Document(token.AccountID).Get(r.Context(), &account)
+		})
+		if errors.Is(err, docdb.ErrNotFound) {
+			t := templs.SignInExpiredPage()
+			templ.Handler(t, templ.WithStatus(http.StatusNotFound)).ServeHTTP(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		t := templs.SignInPage(r.PathValue("token"), account.Email)
+		templ.Handler(t).ServeHTTP(w, r)
+	}
+}
+
+// SignInTokenHandler signs in with the token from a sign in link once it's
+// posted from SignInLinkHandler's page. The token is deleted whether or not it
+// has expired so it can only be used once.
+func SignInTokenHandler(db *docdb.Database, sessions *Sessions) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var sessionId string
+		var expires time.Time
+		err := db.RunInTx(r.Context(), func(tx *docdb.Tx) error {
+			sessionId = ""
+
+			var token signInToken
+			doc := tx.Collection("tokens").Document(hashToken(r.PathValue("token")))
+			if err := doc.Get(r.Context(), &token); err != nil {
+				return err
+			}
+			if err := doc.Delete(r.Context()); err != nil {
+				return err
+			}
+
+			if time.Now().Unix() >= token.Expires {
+				return nil
+			}
+
+			var err error
+			sessionId, expires, err = sessions.create(r.Context(), tx, token.AccountID, "")
+			return err
+		})
+		if err != nil && !errors.Is(err, docdb.ErrNotFound) {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if sessionId == "" {
+			t := templs.SignInExpiredPage()
+			templ.Handler(t, templ.WithStatus(http.StatusNotFound)).ServeHTTP(w, r)
+			return
+		}
+
+		setCookie(w, sessionId, expires)
+		metaRefresh(w, "/boards")
+	}
+}
@@ -0,0 +1,99 @@
+package pkg_test
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/limeleaf-coop/knbn/pkg"
+)
+
+func TestSignInToken(t *testing.T) {
+	ctx := context.Background()
+
+	db := openTestDB(t)
+	sessions := pkg.NewSessions(db)
+	signInLink := pkg.SignInLinkHandler(db)
+	signInToken := pkg.SignInTokenHandler(db, sessions)
+
+	createAccount(t, db, "alice@example.com")
+	createAccount(t, db, "bob@example.com")
+
+	t.Run("single use", func(t *testing.T) {
+		serve(pkg.SignInHandler(db, baseURL), http.MethodPost, "/sign-in", url.Values{"email": {" Alice@Example.com "}}, "", "", nil)
+		token := mailedToken(t, db, "alice@example.com", "/sign-in/")
+		clearOutbox(t, db)
+
+		// Opening the link, as email scanners do, only asks to sign in.
+		for range 2 {
+			w := serve(signInLink, http.MethodGet, "/sign-in/"+token, nil, "token", token, nil)
+			if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "alice@example.com") {
+				t.Fatalf("opening the link got %d %q, want a page asking to sign in as alice@example.com", w.Code, w.Body.String())
+			}
+			if cookie := sessionCookie(w); cookie != nil {
+				t.Fatal("opening the link signed in")
+			}
+		}
+
+		w := serve(signInToken, http.MethodPost, "/sign-in/"+token, nil, "token", token, nil)
+		if cookie := sessionCookie(w); cookie == nil || cookie.Value == "" {
+			t.Fatal("first use didn't sign in")
+		}
+
+		if w := serve(signInLink, http.MethodGet, "/sign-in/"+token, nil, "token", token, nil); w.Code != http.StatusNotFound {
+			t.Errorf("opening a used link got status %d, want %d", w.Code, http.StatusNotFound)
+		}
+
+		w = serve(signInToken, http.MethodPost, "/sign-in/"+token, nil, "token", token, nil)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("second use got status %d, want %d", w.Code, http.StatusNotFound)
+		}
+		if cookie := sessionCookie(w); cookie != nil {
+			t.Error("second use signed in")
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		serve(pkg.SignInHandler(db, baseURL), http.MethodPost, "/sign-in", url.Values{"email": {"bob@example.com"}}, "", "", nil)
+		token := mailedToken(t, db, "bob@example.com", "/sign-in/")
+		clearOutbox(t, db)
+		expireAll(t, db, "tokens")
+
+		if w := serve(signInLink, http.MethodGet, "/sign-in/"+token, nil, "token", token, nil); w.Code != http.StatusNotFound {
+			t.Errorf("opening an expired link got status %d, want %d", w.Code, http.StatusNotFound)
+		}
+
+		w := serve(signInToken, http.MethodPost, "/sign-in/"+token, nil, "token", token, nil)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expired token got status %d, want %d", w.Code, http.StatusNotFound)
+		}
+		if cookie := sessionCookie(w); cookie != nil {
+			t.Error("expired token signed in")
+		}
+
+		tokens, err := db.Collection("tokens").QueryAll(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tokens) != 0 {
+			t.Errorf("%d tokens are left, want the expired one deleted", len(tokens))
+		}
+	})
+
+	t.Run("no account", func(t *testing.T) {
+		w := serve(pkg.SignInHandler(db, baseURL), http.MethodPost, "/sign-in", url.Values{"email": {"nobody@example.com"}}, "", "", nil)
+		if w.Code != http.StatusOK {
+			t.Errorf("got status %d, want %d", w.Code, http.StatusOK)
+		}
+
+		mail, err := db.Collection("outbox").QueryAll(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(mail) != 0 {
+			t.Errorf("%d emails were queued, want none", len(mail))
+		}
+	})
+}
@@ -0,0 +1,217 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	docdb "github.com/limeleaf-coop/knbn/pkg/db"
+	"github.com/limeleaf-coop/knbn/templs"
+)
+
+// BoardStore loads and edits boards. EmbeddedStore keeps every list and card
+// within the board's document, and NormalizedStore keeps them in documents of
+// their own.
+//
+// Edits take the revision of the board the page was showing and fail with
+// docdb.ErrConflict if the board was saved since, otherwise they return the
+// board as it is after the edit.
+type BoardStore interface {
+	// Init creates the indexes the store needs and moves boards saved in the
+	// other layout into this one.
+	Init(ctx context.Context) error
+
+	Board(ctx context.Context, boardId string) (templs.Board, error)
+
+	// Boards returns the boards in a workspace.
+	Boards(ctx context.Context, workspaceId string) ([]templs.Board, error)
+
+	// CreateBoard saves a new board in a workspace without any lists under a
+	// generated ID, owned by the account ownerId.
+	CreateBoard(ctx context.Context, workspaceId string, title string, ownerId string) (templs.Board, error)
+	RenameBoard(ctx context.Context, boardId string, rev int64, title string) (templs.Board, error)
+
+	// DuplicateBoard saves a copy of a board's lists, with their cards if
+	// withCards is true, as a new board called title in the same workspace
+	// owned by the account ownerId. The copies all get new IDs.
+	DuplicateBoard(ctx context.Context, boardId string, title string, withCards bool, ownerId string) (templs.Board, error)
+
+	// DeleteBoard deletes a board along with it's lists, cards and members.
+	DeleteBoard(ctx context.Context, boardId string, rev int64) error
+
+	// Search finds lists and cards matching query on the boards with the IDs
+	// boardIds.
+	Search(ctx context.Context, boardIds []string, query string) ([]templs.SearchResult, error)
+
+	AddList(ctx context.Context, boardId string, rev int64, title string) (templs.Board, error)
+	RenameList(ctx context.Context, boardId string, rev int64, listId string, title string) (templs.Board, error)
+	MoveList(ctx context.Context, boardId string, rev int64, listId string, position int) (templs.Board, error)
+
+	// DeleteList deletes a list along with it's cards, unless moveTo is the
+	// ID of another list to move them to first.
+	DeleteList(ctx context.Context, boardId string, rev int64, listId string, moveTo string) (templs.Board, error)
+
+	AddCard(ctx context.Context, boardId string, rev int64, listId string, title string) (templs.Board, error)
+	RenameCard(ctx context.Context, boardId string, rev int64, cardId string, title string) (templs.Board, error)
+	SetCardDesc(ctx context.Context, boardId string, rev int64, cardId string, desc string) (templs.Board, error)
+
+	// MoveCard moves a card to position in the list toListId, or to the end
+	// of the list if position is negative.
+	MoveCard(ctx context.Context, boardId string, rev int64, cardId string, toListId string, position int) (templs.Board, error)
+	DeleteCard(ctx context.Context, boardId string, rev int64, cardId string) (templs.Board, error)
+
+	// SetCardLabels replaces the labels on a card with the ones in labelIds,
+	// which must all be defined on the board.
+	SetCardLabels(ctx context.Context, boardId string, rev int64, cardId string, labelIds []string) (templs.Board, error)
+
+	// AddLabel defines a new label on a board under a generated ID.
+	AddLabel(ctx context.Context, boardId string, rev int64, name string, color string) (templs.Board, error)
+	UpdateLabel(ctx context.Context, boardId string, rev int64, labelId string, name string, color string) (templs.Board, error)
+
+	// DeleteLabel deletes a label from a board and takes it off every card
+	// it's on.
+	DeleteLabel(ctx context.Context, boardId string, rev int64, labelId string) (templs.Board, error)
+}
+
+// boardsIn returns every board saved in boards, which may be bound to a
+// transaction.
+func boardsIn(ctx context.Context, boards *docdb.Collection) ([]templs.Board, error) {
+	docs, err := boards.QueryAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeBoards(docs)
+}
+
+// workspaceBoards returns the boards in the workspace.
+func workspaceBoards(ctx context.Context, db *docdb.Database, workspaceId string) ([]templs.Board, error) {
+	docs, err := db.Collection("boards").Query(ctx, "$.WorkspaceID", docdb.OpEqual, workspaceId)
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeBoards(docs)
+}
+
+// decodeBoards decodes board documents along with their IDs and revisions.
+func decodeBoards(docs []*docdb.Document) ([]templs.Board, error) {
+	all := make([]templs.Board, len(docs))
+	for idx, doc := range docs {
+		if err := doc.DataTo(&all[idx]); err != nil {
+			return nil, err
+		}
+
+		all[idx].ID = doc.ID
+		all[idx].Revision = doc.Revision
+	}
+
+	return all, nil
+}
+
+// copyLists copies lists, and their cards if withCards is true, giving each
+// copy a new ID. Cards keep their labels since the copy of the board keeps the
+// same label definitions.
+func copyLists(lists []templs.List, withCards bool) []templs.List {
+	copies := make([]templs.List, len(lists))
+	for listIdx, list := range lists {
+		copies[listIdx] = templs.List{ID: docdb.NewID(), Title: list.Title, Cards: []templs.Card{}}
+		if !withCards {
+			continue
+		}
+
+		for _, card := range list.Cards {
+			copies[listIdx].Cards = append(copies[listIdx].Cards, templs.Card{ID: docdb.NewID(), Title: card.Title, Desc: card.Desc, Labels: slices.Clone(card.Labels)})
+		}
+	}
+
+	return copies
+}
+
+// findList returns the position of the list with the ID listId on board.
+func findList(board templs.Board, listId string) (int, error) {
+	for idx, list := range board.Lists {
+		if list.ID == listId {
+			return idx, nil
+		}
+	}
+
+	return 0, fmt.Errorf("%w: list %q", errNotFound, listId)
+}
+
+// findCard returns the position of the list holding the card with the ID
+// cardId on board, and the card's position in it.
+func findCard(board templs.Board, cardId string) (int, int, error) {
+	for listIdx, list := range board.Lists {
+		for cardIdx, card := range list.Cards {
+			if card.ID == cardId {
+				return listIdx, cardIdx, nil
+			}
+		}
+	}
+
+	return 0, 0, fmt.Errorf("%w: card %q", errNotFound, cardId)
+}
+
+// findLabel returns the position of the label with the ID labelId on board.
+func findLabel(board templs.Board, labelId string) (int, error) {
+	for idx, label := range board.Labels {
+		if label.ID == labelId {
+			return idx, nil
+		}
+	}
+
+	return 0, fmt.Errorf("%w: label %q", errNotFound, labelId)
+}
+
+// checkPosition returns errBadRequest unless position is where an item can be
+// moved to among the n others in it's new list, from 0 for the start to n for
+// the end.
+func checkPosition(position int, n int) error {
+	if position < 0 || position > n {
+		return fmt.Errorf("%w: position %d", errBadRequest, position)
+	}
+
+	return nil
+}
+
+// cardLabels checks that every label in labelIds is defined on board and
+// returns them in the order the board defines them, without duplicates.
+func cardLabels(board templs.Board, labelIds []string) ([]string, error) {
+	for _, labelId := range labelIds {
+		if _, err := findLabel(board, labelId); err != nil {
+			return nil, fmt.Errorf("%w: invalid label %q", errBadRequest, labelId)
+		}
+	}
+
+	ids := make([]string, 0, len(labelIds))
+	for _, label := range board.Labels {
+		if slices.Contains(labelIds, label.ID) {
+			ids = append(ids, label.ID)
+		}
+	}
+
+	return ids, nil
+}
+
+// withoutLabel returns the labels of a card without labelId, and whether the
+// card had it.
+func withoutLabel(card templs.Card, labelId string) ([]string, bool) {
+	if !slices.Contains(card.Labels, labelId) {
+		return card.Labels, false
+	}
+
+	return slices.DeleteFunc(slices.Clone(card.Labels), func(id string) bool {
+		return id == labelId
+	}), true
+}
+
+// highlights converts a search result's snippet for templs.SearchResults.
+func highlights(snippet []docdb.SnippetPart) []templs.Highlight {
+	parts := make([]templs.Highlight, len(snippet))
+	for idx, part := range snippet {
+		parts[idx] = templs.Highlight{Text: part.Text, Match: part.Match}
+	}
+
+	return parts
+}
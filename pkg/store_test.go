@@ -0,0 +1,148 @@
+package pkg_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/limeleaf-coop/knbn/pkg"
+	docdb "github.com/limeleaf-coop/knbn/pkg/db"
+	"github.com/limeleaf-coop/knbn/templs"
+)
+
+// withoutRevision returns board without it's revision, which every save
+// changes, so boards saved by different stores can be compared.
+func withoutRevision(board templs.Board) templs.Board {
+	board.Revision = 0
+	return board
+}
+
+func TestStoreMigration(t *testing.T) {
+	ctx := context.Background()
+
+	db := openTestDB(t)
+	workspaces := pkg.NewWorkspaces(db)
+
+	admin := createAccount(t, db, "admin@example.com")
+	workspace, err := workspaces.Create(ctx, admin.ID, "Acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	embedded := pkg.NewEmbeddedStore(db)
+	if err := embedded.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	board, err := embedded.CreateBoard(ctx, workspace.ID, "Roadmap", admin.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	board, err = embedded.AddLabel(ctx, board.ID, board.Revision, "Bug", "#d73a4a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, title := range []string{"Todo", "Done"} {
+		if board, err = embedded.AddList(ctx, board.ID, board.Revision, title); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, title := range []string{"Write tests", "Fix the bug"} {
+		if board, err = embedded.AddCard(ctx, board.ID, board.Revision, board.Lists[0].ID, title); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cardId := board.Lists[0].Cards[1].ID
+	if board, err = embedded.SetCardDesc(ctx, board.ID, board.Revision, cardId, "It **crashes** on start"); err != nil {
+		t.Fatal(err)
+	}
+	if board, err = embedded.SetCardLabels(ctx, board.ID, board.Revision, cardId, []string{board.Labels[0].ID}); err != nil {
+		t.Fatal(err)
+	}
+	if board, err = embedded.MoveCard(ctx, board.ID, board.Revision, cardId, board.Lists[1].ID, 0); err != nil {
+		t.Fatal(err)
+	}
+	empty, err := embedded.CreateBoard(ctx, workspace.ID, "Empty", admin.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		name  string
+		store pkg.BoardStore
+	}{
+		{"normalized", pkg.NewNormalizedStore(db)},
+		{"embedded", pkg.NewEmbeddedStore(db)},
+	}
+
+	for _, step := range steps {
+		t.Run(step.name, func(t *testing.T) {
+			if err := step.store.Init(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, want := range []templs.Board{board, empty} {
+				got, err := step.store.Board(ctx, want.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(withoutRevision(got), withoutRevision(want)) {
+					t.Errorf("got %+v, want %+v", got, want)
+				}
+			}
+
+			// Initializing again leaves boards as they are.
+			if err := step.store.Init(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if got, err := step.store.Board(ctx, board.ID); err != nil || !reflect.DeepEqual(withoutRevision(got), withoutRevision(board)) {
+				t.Errorf("after initializing again got %+v, %v, want %+v", got, err, board)
+			}
+
+			results, err := step.store.Search(ctx, []string{board.ID}, "crashes")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(results) != 1 || results[0].CardID != cardId || results[0].ListID != board.Lists[1].ID {
+				t.Errorf("search got %+v, want the card %s", results, cardId)
+			}
+		})
+	}
+
+	// Lists and cards are only kept in their own documents by a
+	// NormalizedStore.
+	for _, collection := range []string{"lists", "cards"} {
+		docs, err := db.Collection(collection).QueryAll(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(docs) != 0 {
+			t.Errorf("%d %s are left after moving back", len(docs), collection)
+		}
+	}
+}
+
+func TestDeleteThenAdd(t *testing.T) {
+	eachStore(t, func(t *testing.T, db *docdb.Database, boards pkg.BoardStore) {
+		ctx := context.Background()
+
+		board := seedBoard(t, boards, "Todo: a b c", "Doing:", "Done:")
+
+		// Lists and cards added after deleting others go on the end.
+		board, err := boards.DeleteCard(ctx, board.ID, board.Revision, board.Lists[0].Cards[0].ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if board, err = boards.AddCard(ctx, board.ID, board.Revision, board.Lists[0].ID, "d"); err != nil {
+			t.Fatal(err)
+		}
+		if board, err = boards.DeleteList(ctx, board.ID, board.Revision, board.Lists[1].ID, ""); err != nil {
+			t.Fatal(err)
+		}
+		if board, err = boards.AddList(ctx, board.ID, board.Revision, "Later"); err != nil {
+			t.Fatal(err)
+		}
+
+		checkBoard(t, boards, board.ID, "Todo: b c d", "Done:", "Later:")
+	})
+}
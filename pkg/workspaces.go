@@ -0,0 +1,300 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	docdb "github.com/limeleaf-coop/knbn/pkg/db"
+	"github.com/limeleaf-coop/knbn/templs"
+)
+
+// workspaceDoc is a workspace saved in the workspaces collection.
+type workspaceDoc struct {
+	Name string
+}
+
+// workspaceMemberDoc is saved in the workspace_members collection under
+// memberID, like a board's members, so an account can only be in a workspace
+// once.
+type workspaceMemberDoc struct {
+	WorkspaceID string
+	AccountID   string
+	Role        templs.WorkspaceRole
+}
+
+// Workspaces keeps track of which accounts are in which workspaces. Every
+// board belongs to exactly one workspace, and only accounts in it can be
+// members of the board.
+type Workspaces struct {
+	db *docdb.Database
+}
+
+func NewWorkspaces(db *docdb.Database) *Workspaces {
+	return &Workspaces{db: db}
+}
+
+// workspaceRole returns the role of the account in the workspace from
+// members, which may be bound to a transaction, or an empty role if it isn't
+// in it.
+func workspaceRole(ctx context.Context, members *docdb.Collection, workspaceId string, accountId string) (templs.WorkspaceRole, error) {
+	var member workspaceMemberDoc
+	if err := members.Document(memberID(workspaceId, accountId)).Get(ctx, &member); err != nil {
+		if errors.Is(err, docdb.ErrNotFound) {
+			return "", nil
+		}
+		return "", err
+	}
+
+	return member.Role, nil
+}
+
+// boardWorkspace returns the ID of the workspace the board belongs to from
+// boards, which may be bound to a transaction.
+func boardWorkspace(ctx context.Context, boards *docdb.Collection, boardId string) (string, error) {
+	var board struct {
+		WorkspaceID string
+	}
+	if err := boards.Document(boardId).Get(ctx, &board); err != nil {
+		return "", err
+	}
+
+	return board.WorkspaceID, nil
+}
+
+// ForAccount returns the workspaces the account is in, with it's role in
+// each, ordered by name.
+func (ws *Workspaces) ForAccount(ctx context.Context, accountId string) ([]templs.Workspace, error) {
+	docs, err := ws.db.Collection("workspace_members").Query(ctx, "$.AccountID", docdb.OpEqual, accountId)
+	if err != nil {
+		return nil, err
+	}
+
+	workspaces := make([]templs.Workspace, 0, len(docs))
+	for _, doc := range docs {
+		var member workspaceMemberDoc
+		if err := doc.DataTo(&member); err != nil {
+			return nil, err
+		}
+
+		var workspace templs.Workspace
+		if err := ws.db.Collection("workspaces").Document(member.WorkspaceID).Get(ctx, &workspace); err != nil {
+			if errors.Is(err, docdb.ErrNotFound) {
+				continue
+			}
+			return nil, err
+		}
+		workspace.ID = member.WorkspaceID
+		workspace.Role = member.Role
+
+		workspaces = append(workspaces, workspace)
+	}
+
+	slices.SortFunc(workspaces, func(a, b templs.Workspace) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	return workspaces, nil
+}
+
+// Create saves a new workspace with the account as it's admin.
+func (ws *Workspaces) Create(ctx context.Context, accountId string, name string) (templs.Workspace, error) {
+	workspace := templs.Workspace{ID: docdb.NewID(), Name: name, Role: templs.WorkspaceRoleAdmin}
+
+	err := ws.db.RunInTx(ctx, func(tx *docdb.Tx) error {
+		if err := tx.Collection("workspaces").Document(workspace.ID).Create(ctx, &workspaceDoc{Name: name}); err != nil {
+			return err
+		}
+
+		return setWorkspaceMember(ctx, tx, workspace.ID, accountId, templs.WorkspaceRoleAdmin)
+	})
+
+	return workspace, err
+}
+
+// Members returns the members of a workspace ordered by email.
+func (ws *Workspaces) Members(ctx context.Context, workspaceId string) ([]templs.WorkspaceMember, error) {
+	docs, err := ws.db.Collection("workspace_members").Query(ctx, "$.WorkspaceID", docdb.OpEqual, workspaceId)
+	if err != nil {
+		return nil, err
+	}
+
+	members := make([]templs.WorkspaceMember, 0, len(docs))
+	for _, doc := range docs {
+		var member workspaceMemberDoc
+		if err := doc.DataTo(&member); err != nil {
+			return nil, err
+		}
+
+		var account templs.Account
+		if err := ws.db.Collection("accounts").Document(member.AccountID).Get(ctx, &account); err != nil {
+			if errors.Is(err, docdb.ErrNotFound) {
+				continue
+			}
+			return nil, err
+		}
+		account.ID = member.AccountID
+
+		members = append(members, templs.WorkspaceMember{Account: account, Role: member.Role})
+	}
+
+	slices.SortFunc(members, func(a, b templs.WorkspaceMember) int {
+		return strings.Compare(a.Account.Email, b.Account.Email)
+	})
+
+	return members, nil
+}
+
+// SetByEmail puts the account with the email in the workspace with role, or
+// changes it's role if it's already in it. It fails with errInviteNeeded if
+// there is no account for the email.
+func (ws *Workspaces) SetByEmail(ctx context.Context, workspaceId string, email string, role templs.WorkspaceRole) error {
+	email = normalizeEmail(email)
+
+	return ws.db.RunInTx(ctx, func(tx *docdb.Tx) error {
+		accounts, err := tx.Collection("accounts").Query(ctx, "$.Email", docdb.OpEqual, email)
+		if err != nil {
+			return err
+		}
+		if len(accounts) == 0 {
+			return fmt.Errorf("%w: there's no account for %s", errInviteNeeded, email)
+		}
+
+		return setWorkspaceMember(ctx, tx, workspaceId, accounts[0].ID, role)
+	})
+}
+
+// Remove takes the account out of the workspace and off every board in it.
+func (ws *Workspaces) Remove(ctx context.Context, workspaceId string, accountId string) error {
+	return ws.db.RunInTx(ctx, func(tx *docdb.Tx) error {
+		if err := keepAdmin(ctx, tx, workspaceId, accountId); err != nil {
+			return err
+		}
+
+		if err := tx.Collection("workspace_members").Document(memberID(workspaceId, accountId)).Delete(ctx); err != nil {
+			return err
+		}
+
+		boards, err := tx.Collection("boards").Query(ctx, "$.WorkspaceID", docdb.OpEqual, workspaceId)
+		if err != nil {
+			return err
+		}
+
+		for _, board := range boards {
+			if err := tx.Collection("members").Document(memberID(board.ID, accountId)).Delete(ctx); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// setWorkspaceMember saves the account's role in the workspace within tx.
+func setWorkspaceMember(ctx context.Context, tx *docdb.Tx, workspaceId string, accountId string, role templs.WorkspaceRole) error {
+	if !slices.Contains(templs.WorkspaceRoles, role) {
+		return fmt.Errorf("%w: invalid role %q", errBadRequest, role)
+	}
+	if role != templs.WorkspaceRoleAdmin {
+		if err := keepAdmin(ctx, tx, workspaceId, accountId); err != nil {
+			return err
+		}
+	}
+
+	member := workspaceMemberDoc{WorkspaceID: workspaceId, AccountID: accountId, Role: role}
+	doc := tx.Collection("workspace_members").Document(memberID(workspaceId, accountId))
+
+	err := doc.Create(ctx, &member)
+	if errors.Is(err, docdb.ErrDuplicate) {
+		return doc.Set(ctx, &member)
+	}
+
+	return err
+}
+
+// keepAdmin fails if the account is the last admin of the workspace, like
+// keepOwner for boards.
+func keepAdmin(ctx context.Context, tx *docdb.Tx, workspaceId string, accountId string) error {
+	docs, err := tx.Collection("workspace_members").Where("$.WorkspaceID", docdb.OpEqual, workspaceId).And("$.Role", docdb.OpEqual, string(templs.WorkspaceRoleAdmin)).Documents(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(docs) == 1 && docs[0].ID == memberID(workspaceId, accountId) {
+		return fmt.Errorf("%w: a workspace needs at least one admin", errBadRequest)
+	}
+
+	return nil
+}
+
+// Current puts the current account's workspaces on the request's context for
+// CurrentNav, along with the one it's working in: the one it switched to last
+// with it's session, or it's first if it isn't in that one anymore. It must be
+// wrapped by RequireAccount.
+func (ws *Workspaces) Current(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		account := CurrentAccount(r.Context())
+
+		workspaces, err := ws.ForAccount(r.Context(), account.ID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		nav := templs.Nav{Account: account, Workspaces: workspaces}
+		if len(workspaces) > 0 {
+			nav.Workspace = workspaces[0]
+		}
+		for _, workspace := range workspaces {
+			if workspace.ID == CurrentSession(r.Context()).WorkspaceID {
+				nav.Workspace = workspace
+			}
+		}
+
+		next(w, r.WithContext(context.WithValue(r.Context(), navKey, nav)))
+	}
+}
+
+// Require only calls next for accounts in the workspace in the request's path
+// with at least the role min. Like boards, workspaces the account isn't in are
+// not found rather than forbidden. It must be wrapped by Current.
+func (ws *Workspaces) Require(min templs.WorkspaceRole) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			workspaceId := r.PathValue("workspaceId")
+
+			workspace, ok := findWorkspace(CurrentNav(r.Context()), workspaceId)
+			switch {
+			case !ok:
+				http.Error(w, fmt.Sprintf("%v: workspace %q", errNotFound, workspaceId), http.StatusNotFound)
+			case min == templs.WorkspaceRoleAdmin && workspace.Role != templs.WorkspaceRoleAdmin:
+				http.Error(w, fmt.Sprintf("%v: %s can not do that", errForbidden, workspace.Role), http.StatusForbidden)
+			default:
+				next(w, r)
+			}
+		}
+	}
+}
+
+// findWorkspace returns the workspace with the ID workspaceId out of the ones
+// the current account is in.
+func findWorkspace(nav templs.Nav, workspaceId string) (templs.Workspace, bool) {
+	idx := slices.IndexFunc(nav.Workspaces, func(workspace templs.Workspace) bool {
+		return workspace.ID == workspaceId
+	})
+	if idx < 0 {
+		return templs.Workspace{}, false
+	}
+
+	return nav.Workspaces[idx], true
+}
+
+// CurrentNav returns the current account's workspaces for a request wrapped
+// by Current.
+func CurrentNav(ctx context.Context) templs.Nav {
+	nav, _ := ctx.Value(navKey).(templs.Nav)
+	return nav
+}
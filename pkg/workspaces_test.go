@@ -0,0 +1,57 @@
+package pkg_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/limeleaf-coop/knbn/pkg"
+	"github.com/limeleaf-coop/knbn/templs"
+)
+
+func TestKeepAdmin(t *testing.T) {
+	ctx := context.Background()
+
+	db := openTestDB(t)
+	workspaces := pkg.NewWorkspaces(db)
+
+	alice := createAccount(t, db, "alice@example.com")
+	bob := createAccount(t, db, "bob@example.com")
+
+	workspace, err := workspaces.Create(ctx, alice.ID, "Acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := workspaces.Remove(ctx, workspace.ID, alice.ID); err == nil {
+		t.Error("removed the last admin")
+	}
+	if err := workspaces.SetByEmail(ctx, workspace.ID, alice.Email, templs.WorkspaceRoleMember); err == nil {
+		t.Error("demoted the last admin")
+	}
+
+	// Once there's another admin the first can step down.
+	if err := workspaces.SetByEmail(ctx, workspace.ID, bob.Email, templs.WorkspaceRoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	if err := workspaces.SetByEmail(ctx, workspace.ID, alice.Email, templs.WorkspaceRoleMember); err != nil {
+		t.Errorf("couldn't demote an admin with another admin: %v", err)
+	}
+	if err := workspaces.Remove(ctx, workspace.ID, bob.ID); err == nil {
+		t.Error("removed the new last admin")
+	}
+
+	roles := make(map[string]templs.WorkspaceRole)
+	for _, account := range []templs.Account{alice, bob} {
+		in, err := workspaces.ForAccount(ctx, account.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(in) != 1 {
+			t.Fatalf("%s is in %d workspaces, want 1", account.Email, len(in))
+		}
+		roles[account.Email] = in[0].Role
+	}
+	if roles[alice.Email] != templs.WorkspaceRoleMember || roles[bob.Email] != templs.WorkspaceRoleAdmin {
+		t.Errorf("got roles %v, want alice a member and bob an admin", roles)
+	}
+}
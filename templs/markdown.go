@@ -0,0 +1,54 @@
+package templs
+
+import (
+	"bytes"
+
+	"github.com/a-h/templ"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer/html"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+// markdownRenderer renders GitHub flavored Markdown: task lists, tables,
+// strikethrough and bare links on top of CommonMark. Without html.WithUnsafe
+// goldmark leaves out raw HTML and links to dangerous URLs like javascript:,
+// so what editors write is safe to show everyone else on the board.
+var markdownRenderer = goldmark.New(
+	goldmark.WithExtensions(extension.GFM),
+	goldmark.WithParserOptions(parser.WithASTTransformers(util.Prioritized(dangerousAutoLinks{}, 0))),
+	goldmark.WithRendererOptions(html.WithHardWraps()),
+)
+
+// dangerousAutoLinks turns autolinks like <javascript:alert(1)> into plain
+// text, since goldmark only leaves dangerous URLs out of links and images.
+type dangerousAutoLinks struct{}
+
+func (dangerousAutoLinks) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	source := reader.Source()
+
+	var links []*ast.AutoLink
+	ast.Walk(doc, func(node ast.Node, entering bool) (ast.WalkStatus, error) {
+		if link, ok := node.(*ast.AutoLink); ok && entering && html.IsDangerousURL(link.URL(source)) {
+			links = append(links, link)
+		}
+		return ast.WalkContinue, nil
+	})
+
+	for _, link := range links {
+		link.Parent().ReplaceChild(link.Parent(), link, ast.NewString(link.Label(source)))
+	}
+}
+
+// markdown renders src as sanitized HTML.
+func markdown(src string) templ.Component {
+	var buf bytes.Buffer
+	if err := markdownRenderer.Convert([]byte(src), &buf); err != nil {
+		return templ.Raw("", err)
+	}
+
+	return templ.Raw(buf.String())
+}
@@ -0,0 +1,75 @@
+package templs
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestMarkdown(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     string
+		want    []string
+		notWant []string
+	}{
+		{
+			name: "formatting",
+			src:  "**bold** and ~~gone~~\nnext line",
+			want: []string{"<strong>bold</strong>", "<del>gone</del>", "<br>"},
+		},
+		{
+			name: "task list and bare link",
+			src:  "- [x] done\n- [ ] https://example.com",
+			want: []string{`type="checkbox"`, `<a href="https://example.com">`},
+		},
+		{
+			name:    "script",
+			src:     "hi <script>alert(1)</script>",
+			notWant: []string{"<script", "alert(1)</script>"},
+		},
+		{
+			name:    "event handler",
+			src:     `<img src="x" onerror="alert(1)">`,
+			notWant: []string{"<img", "onerror"},
+		},
+		{
+			name:    "javascript link",
+			src:     "[click](javascript:alert(1))",
+			want:    []string{"click"},
+			notWant: []string{"javascript:"},
+		},
+		{
+			name:    "javascript autolink",
+			src:     "<javascript:alert(1)>",
+			want:    []string{"javascript:alert(1)"},
+			notWant: []string{`href="javascript:`},
+		},
+		{
+			name:    "data image",
+			src:     "![x](data:text/html;base64,PHNjcmlwdD4=)",
+			notWant: []string{"data:text/html"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b strings.Builder
+			if err := markdown(tt.src).Render(context.Background(), &b); err != nil {
+				t.Fatal(err)
+			}
+			html := b.String()
+
+			for _, want := range tt.want {
+				if !strings.Contains(html, want) {
+					t.Errorf("%q doesn't contain %q", html, want)
+				}
+			}
+			for _, notWant := range tt.notWant {
+				if strings.Contains(html, notWant) {
+					t.Errorf("%q contains %q", html, notWant)
+				}
+			}
+		})
+	}
+}
@@ -1,17 +1,123 @@
 package templs
 
+import (
+	"slices"
+	"time"
+)
+
+type Account struct {
+	ID    string `json:"-"`
+	Email string
+}
+
+// Role is what a member can do on a board. Each role can do everything the
+// roles before it in Roles can.
+type Role string
+
+const (
+	RoleViewer Role = "viewer"
+	RoleEditor Role = "editor"
+	RoleOwner  Role = "owner"
+)
+
+var Roles = []Role{RoleViewer, RoleEditor, RoleOwner}
+
+// Can reports whether the role can do everything min can.
+func (r Role) Can(min Role) bool {
+	return slices.Index(Roles, r) >= slices.Index(Roles, min) && slices.Contains(Roles, r)
+}
+
+type Member struct {
+	Account Account
+	Role    Role
+}
+
+// WorkspaceRole is what a member of a workspace can do. Admins manage who is
+// in the workspace and own every board in it.
+type WorkspaceRole string
+
+const (
+	WorkspaceRoleMember WorkspaceRole = "member"
+	WorkspaceRoleAdmin  WorkspaceRole = "admin"
+)
+
+var WorkspaceRoles = []WorkspaceRole{WorkspaceRoleMember, WorkspaceRoleAdmin}
+
+// Workspace groups boards and the accounts working on them. Role is the
+// current account's role in it.
+type Workspace struct {
+	ID   string `json:"-"`
+	Name string
+	Role WorkspaceRole `json:"-"`
+}
+
+type WorkspaceMember struct {
+	Account Account
+	Role    WorkspaceRole
+}
+
+// Invitation asks Email to join a workspace, and one of it's boards if Board
+// is set. Role is it's role on the board, or in the workspace if it isn't for
+// a board.
+type Invitation struct {
+	ID        string
+	Email     string
+	Role      string
+	InvitedBy string
+	Workspace string
+	Board     string
+	Expires   time.Time
+}
+
+// Nav is what the header shows a signed in account: it's workspaces and which
+// one it's working in.
+type Nav struct {
+	Account    Account
+	Workspace  Workspace
+	Workspaces []Workspace
+}
+
 type Board struct {
+	ID          string `json:"-"`
+	Revision    int64  `json:"-"`
+	WorkspaceID string
+	Title       string
+	Labels      []Label
+	Lists       []List
+}
+
+// Label is defined on a board and put on any of it's cards. Color is a hex
+// color like #4e4e4e.
+type Label struct {
 	ID    string
-	Title string
-	Lists []List
+	Name  string
+	Color string
 }
 
 type List struct {
+	ID    string
 	Title string
 	Cards []Card
 }
 
+// Card holds the IDs of the labels on it in Labels.
 type Card struct {
-	Title string
-	Desc  string
+	ID     string
+	Title  string
+	Desc   string
+	Labels []string
+}
+
+type SearchResult struct {
+	BoardID    string
+	BoardTitle string
+	ListID     string
+	CardID     string
+	Field      string
+	Snippet    []Highlight
+}
+
+type Highlight struct {
+	Text  string
+	Match bool
 }